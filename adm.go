@@ -9,11 +9,13 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -269,3 +271,145 @@ func (adm *Adm) Open() error {
 	url := fmt.Sprintf("http://localhost:%d", adm.GetPort())
 	return sysdep.OpenURL(url)
 }
+
+// Import imports list of sites from file ("-" for stdin)
+//
+// If Froxy is running, list is sent to the running Froxy,
+// otherwise the persistent state is updated directly
+func (adm *Adm) Import(file string, format SiteListFormat, flags OptFlags) error {
+	// Read the list
+	var data []byte
+	var err error
+
+	if file == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(file)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Import the list
+	var rsp struct {
+		Format   SiteListFormat  `json:"format"`
+		Imported int             `json:"imported"`
+		Errors   []SiteListError `json:"errors"`
+	}
+
+	replace := flags.Test(OptFlgReplace)
+
+	if adm.FroxyIsRunning {
+		rq := map[string]interface{}{
+			"format":  format,
+			"replace": replace,
+			"list":    string(data),
+		}
+
+		err = adm.apiRequest("POST", "/api/sitelist", rq, &rsp)
+		if err != nil {
+			return err
+		}
+	} else {
+		var sites []SiteParams
+		sites, rsp.Errors, rsp.Format, err = SiteListParse(data, format)
+		if err != nil {
+			return err
+		}
+
+		rsp.Imported = adm.ImportSites(sites, replace)
+	}
+
+	// Report results
+	for _, e := range rsp.Errors {
+		adm.Warn("%s: %s", file, &e)
+	}
+
+	adm.Info("%s: %d sites imported (%s format), %d errors",
+		file, rsp.Imported, rsp.Format, len(rsp.Errors))
+
+	return nil
+}
+
+// Export exports list of sites to file ("-" for stdout)
+func (adm *Adm) Export(file string, format SiteListFormat) error {
+	if format == SiteListAuto {
+		format = SiteListPlain
+	}
+
+	// Obtain the list
+	var list []byte
+	var err error
+
+	if adm.FroxyIsRunning {
+		var rsp struct {
+			List string `json:"list"`
+		}
+
+		query := "/api/sitelist?format=" + url.QueryEscape(string(format))
+		err = adm.apiRequest("GET", query, nil, &rsp)
+		list = []byte(rsp.List)
+	} else {
+		list, err = SiteListFormatSites(adm.GetSites(), format)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Write the list
+	if file == "-" {
+		_, err = os.Stdout.Write(list)
+	} else {
+		err = ioutil.WriteFile(file, list, 0644)
+	}
+
+	return err
+}
+
+// apiRequest sends request to the running Froxy WebAPI
+//
+// If in is not nil, it is sent as JSON request body. The "data"
+// part of response is decoded into out
+func (adm *Adm) apiRequest(method, query string, in, out interface{}) error {
+	url := fmt.Sprintf("http://localhost:%d%s", adm.GetPort(), query)
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	rq, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+
+	rsp, err := http.DefaultClient.Do(rq)
+	if err != nil {
+		return err
+	}
+
+	defer rsp.Body.Close()
+
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+
+	if rsp.StatusCode != http.StatusOK {
+		s := strings.TrimFunc(string(data), unicode.IsSpace)
+		if s == "" {
+			s = rsp.Status
+		}
+		return errors.New(s)
+	}
+
+	return json.Unmarshal(data, &struct {
+		Data interface{} `json:"data"`
+	}{out})
+}
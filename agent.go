@@ -0,0 +1,186 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// SSH agent authentication
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+//
+// Identity, available in the SSH agent
+//
+type SSHAgentKey struct {
+	Fingerprint string `json:"fingerprint"` // Key fingerprint, SHA256:...
+	Type        string `json:"type"`        // Key type, i.e., ssh-ed25519
+	Comment     string `json:"comment"`     // Key comment
+}
+
+//
+// Get identities, available in the SSH agent
+//
+func SSHAgentKeys() ([]SSHAgentKey, error) {
+	keys, err := sshAgentList()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]SSHAgentKey, len(keys))
+	for i, key := range keys {
+		out[i] = SSHAgentKey{
+			Fingerprint: ssh.FingerprintSHA256(key),
+			Type:        key.Type(),
+			Comment:     key.Comment,
+		}
+	}
+
+	return out, nil
+}
+
+//
+// Get signers for the SSH agent identities. If fingerprint is
+// not "", only the matching identity is used
+//
+// Private keys never leave the agent: each signature is requested
+// from the agent via the new connection, so signers don't hold
+// any connection open
+//
+func SSHAgentSigners(fingerprint string) ([]ssh.Signer, error) {
+	keys, err := sshAgentList()
+	if err != nil {
+		return nil, err
+	}
+
+	signers := []ssh.Signer{}
+	for _, key := range keys {
+		if fingerprint == "" || fingerprint == ssh.FingerprintSHA256(key) {
+			signers = append(signers, &sshAgentSigner{key})
+		}
+	}
+
+	if len(signers) == 0 {
+		if fingerprint != "" {
+			return nil, fmt.Errorf("SSH agent: identity %s not found",
+				fingerprint)
+		}
+		return nil, ErrSSHAgentNoKeys
+	}
+
+	return signers, nil
+}
+
+//
+// List identities, available in the SSH agent
+//
+func sshAgentList() ([]*agent.Key, error) {
+	conn, err := sshAgentDial()
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return nil, fmt.Errorf("SSH agent: %s", err)
+	}
+
+	return keys, nil
+}
+
+//
+// Connect to the SSH agent, using the SSH_AUTH_SOCK
+// environment variable
+//
+func sshAgentDial() (net.Conn, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, ErrSSHAgentNotRunning
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("SSH agent: %s", err)
+	}
+
+	return conn, nil
+}
+
+// ----- SSH agent signer -----
+//
+// ssh.Signer that signs with the SSH agent
+//
+// It implements ssh.AlgorithmSigner, so RSA keys can be signed
+// with rsa-sha2-256 and rsa-sha2-512. However, the client
+// authentication of the x/crypto version in use always calls Sign
+// with the ssh-rsa algorithm, so RSA identities, both from the agent
+// and from the key files, are signed with SHA-1 and rejected by
+// servers that disable it (i.e., OpenSSH 8.8 and up). Ed25519 and
+// ECDSA identities are not affected
+//
+type sshAgentSigner struct {
+	key *agent.Key // Identity in the agent
+}
+
+var _ = ssh.AlgorithmSigner(&sshAgentSigner{})
+
+//
+// Get the public key
+//
+func (s *sshAgentSigner) PublicKey() ssh.PublicKey {
+	return s.key
+}
+
+//
+// Sign the data
+//
+func (s *sshAgentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	conn, err := sshAgentDial()
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	return agent.NewClient(conn).Sign(s.key, data)
+}
+
+//
+// Sign the data, using the specified signature algorithm
+//
+func (s *sshAgentSigner) SignWithAlgorithm(rand io.Reader, data []byte,
+	algorithm string) (*ssh.Signature, error) {
+
+	var flags agent.SignatureFlags
+	rsa := s.key.Type() == ssh.KeyAlgoRSA
+
+	switch {
+	case algorithm == "" || algorithm == s.key.Type():
+	case rsa && algorithm == ssh.SigAlgoRSASHA2256:
+		flags = agent.SignatureFlagRsaSha256
+	case rsa && algorithm == ssh.SigAlgoRSASHA2512:
+		flags = agent.SignatureFlagRsaSha512
+	default:
+		return nil, fmt.Errorf("SSH agent: unsupported signature algorithm %q",
+			algorithm)
+	}
+
+	conn, err := sshAgentDial()
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	return agent.NewClient(conn).SignWithFlags(s.key, data, flags)
+}
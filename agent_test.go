@@ -0,0 +1,196 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// SSH agent authentication test
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+//
+// Start in-process SSH agent with RSA and Ed25519 keys and point
+// SSH_AUTH_SOCK to it. Returns public keys and cleanup function
+//
+func agentTestStart(t *testing.T) ([]ssh.PublicKey, func()) {
+	dir, err := ioutil.TempDir("", "froxy")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	keyring := agent.NewKeyring()
+	pubkeys := []ssh.PublicKey{}
+	for _, key := range []interface{}{rsaKey, &edKey} {
+		err = keyring.Add(agent.AddedKey{PrivateKey: key, Comment: "test"})
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		pubkeys = append(pubkeys, signer.PublicKey())
+	}
+
+	sock := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Skipf("unix sockets not available: %s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	oldSock, hadSock := os.LookupEnv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", sock)
+
+	return pubkeys, func() {
+		if hadSock {
+			os.Setenv("SSH_AUTH_SOCK", oldSock)
+		} else {
+			os.Unsetenv("SSH_AUTH_SOCK")
+		}
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+//
+// Test listing of agent identities and selection of signers
+//
+func TestSSHAgentSigners(t *testing.T) {
+	pubkeys, cleanup := agentTestStart(t)
+	defer cleanup()
+
+	keys, err := SSHAgentKeys()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if len(keys) != 2 || keys[0].Type != ssh.KeyAlgoRSA ||
+		keys[1].Type != ssh.KeyAlgoED25519 || keys[1].Comment != "test" {
+		t.Fatalf("keys: %+v", keys)
+	}
+
+	signers, err := SSHAgentSigners("")
+	if err != nil || len(signers) != 2 {
+		t.Fatalf("all signers: %d, %v", len(signers), err)
+	}
+
+	fp := ssh.FingerprintSHA256(pubkeys[1])
+	signers, err = SSHAgentSigners(fp)
+	if err != nil || len(signers) != 1 ||
+		ssh.FingerprintSHA256(signers[0].PublicKey()) != fp {
+		t.Fatalf("signer %s: %v", fp, err)
+	}
+
+	_, err = SSHAgentSigners("SHA256:unknown")
+	if err == nil {
+		t.Fatalf("unknown identity: error expected")
+	}
+
+	// Agent is not running
+	os.Setenv("SSH_AUTH_SOCK", "")
+	if _, err = SSHAgentSigners(""); err != ErrSSHAgentNotRunning {
+		t.Fatalf("agent not running: %v", err)
+	}
+}
+
+//
+// Test signing with the agent, using non-default algorithms
+//
+func TestSSHAgentSignWithAlgorithm(t *testing.T) {
+	pubkeys, cleanup := agentTestStart(t)
+	defer cleanup()
+
+	signers, err := SSHAgentSigners("")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	data := []byte("data to sign")
+	tests := []struct {
+		key       int
+		algorithm string
+		format    string
+	}{
+		{0, "", ssh.SigAlgoRSA},
+		{0, ssh.SigAlgoRSA, ssh.SigAlgoRSA},
+		{0, ssh.SigAlgoRSASHA2256, ssh.SigAlgoRSASHA2256},
+		{0, ssh.SigAlgoRSASHA2512, ssh.SigAlgoRSASHA2512},
+		{0, ssh.KeyAlgoED25519, ""},
+		{1, "", ssh.KeyAlgoED25519},
+		{1, ssh.KeyAlgoED25519, ssh.KeyAlgoED25519},
+		{1, ssh.SigAlgoRSASHA2256, ""},
+	}
+
+	for _, test := range tests {
+		signer := signers[test.key].(ssh.AlgorithmSigner)
+		name := signer.PublicKey().Type() + "/" + test.algorithm
+
+		sig, err := signer.SignWithAlgorithm(rand.Reader, data,
+			test.algorithm)
+
+		if test.format == "" {
+			if err == nil {
+				t.Errorf("%s: error expected", name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+
+		if sig.Format != test.format {
+			t.Errorf("%s: %s expected, %s received",
+				name, test.format, sig.Format)
+		}
+
+		if err = pubkeys[test.key].Verify(data, sig); err != nil {
+			t.Errorf("%s: verify: %s", name, err)
+		}
+	}
+
+	// Sign uses the default algorithm
+	sig, err := signers[0].Sign(rand.Reader, data)
+	if err != nil || sig.Format != ssh.SigAlgoRSA {
+		t.Errorf("Sign: %v %v", sig, err)
+	}
+}
@@ -0,0 +1,133 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Responding to blocked requests
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+//
+// Transparent 1x1 GIF image
+//
+var blockPixelGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00,
+	0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x21, 0xf9, 0x04, 0x01, 0x00,
+	0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44,
+	0x01, 0x00, 0x3b,
+}
+
+//
+// Respond to the blocked request
+//
+// For CONNECT requests, nothing useful can be returned inside the
+// tunnel, so all modes, except the error page, close the connection
+//
+func (froxy *Froxy) handleBlocked(w http.ResponseWriter, r *http.Request,
+	mode BlockMode) {
+
+	if r.Method == http.MethodConnect && mode != BlockModePage {
+		mode = BlockModeClose
+	}
+
+	froxy.Debug("%s %s %s: blocked (%s)", r.Method, r.Host, r.Proto,
+		blockModeName(mode))
+
+	switch mode {
+	case BlockModeEmpty:
+		froxy.IncCounter(&froxy.Counters.HTTPRqBlkEmpty)
+		httpNoCache(w)
+		w.WriteHeader(http.StatusNoContent)
+
+	case BlockModePixel:
+		froxy.IncCounter(&froxy.Counters.HTTPRqBlkPixel)
+		contentType, content := blockFakeContent(r)
+		if contentType == "" {
+			httpNoCache(w)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		httpNoCache(w)
+		w.WriteHeader(http.StatusOK)
+		w.Write(content)
+
+	case BlockModeClose:
+		froxy.IncCounter(&froxy.Counters.HTTPRqBlkClose)
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			froxy.httpError(w, http.StatusForbidden, ErrSiteBlocked)
+			return
+		}
+
+		conn, _, err := hijacker.Hijack()
+		if err != nil {
+			return
+		}
+
+		// Reset connection, if possible, so client will
+		// not wait for anything
+		if c, ok := conn.(*usertConn); ok {
+			if tcp, ok := c.Conn.(*net.TCPConn); ok {
+				tcp.SetLinger(0)
+			}
+		}
+
+		conn.Close()
+
+	default:
+		froxy.IncCounter(&froxy.Counters.HTTPRqBlkPage)
+		froxy.httpError(w, http.StatusForbidden, ErrSiteBlocked)
+	}
+}
+
+//
+// Choose fake content for the blocked request, by the Accept
+// header or, if it is not specific, by the file extension
+//
+// Returns content type and content. If content type is "",
+// suitable content was not found
+//
+func blockFakeContent(r *http.Request) (string, []byte) {
+	accept := strings.ToLower(r.Header.Get("Accept"))
+
+	switch {
+	case strings.Contains(accept, "image/"):
+		return "image/gif", blockPixelGIF
+	case strings.Contains(accept, "text/css"):
+		return "text/css", []byte{}
+	case strings.Contains(accept, "javascript"):
+		return "application/javascript", []byte{}
+	}
+
+	switch strings.ToLower(path.Ext(r.URL.Path)) {
+	case ".gif", ".png", ".jpg", ".jpeg", ".webp", ".ico", ".svg":
+		return "image/gif", blockPixelGIF
+	case ".css":
+		return "text/css", []byte{}
+	case ".js", ".mjs":
+		return "application/javascript", []byte{}
+	}
+
+	return "", nil
+}
+
+//
+// Get BlockMode name, for logging
+//
+func blockModeName(mode BlockMode) string {
+	if mode == BlockModePage {
+		return "page"
+	}
+	return string(mode)
+}
@@ -0,0 +1,176 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Responding to blocked requests test
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+//
+// Test choice of fake content
+//
+func TestBlockFakeContent(t *testing.T) {
+	tests := []struct {
+		accept      string
+		path        string
+		contentType string
+	}{
+		{"image/webp,image/*,*/*;q=0.8", "/banner", "image/gif"},
+		{"text/css,*/*;q=0.1", "/style", "text/css"},
+		{"application/javascript", "/script", "application/javascript"},
+		{"*/*", "/ads/banner.PNG", "image/gif"},
+		{"*/*", "/ads/track.js", "application/javascript"},
+		{"", "/ads/style.css", "text/css"},
+		{"text/html", "/ads/index.html", ""},
+		{"*/*", "/", ""},
+	}
+
+	for _, test := range tests {
+		rq := httptest.NewRequest("GET", "http://ads.example.com"+test.path, nil)
+		if test.accept != "" {
+			rq.Header.Set("Accept", test.accept)
+		}
+
+		contentType, content := blockFakeContent(rq)
+		if contentType != test.contentType {
+			t.Errorf("%q %s: %q expected, %q received",
+				test.accept, test.path, test.contentType, contentType)
+		}
+
+		if contentType == "image/gif" && !bytes.Equal(content, blockPixelGIF) {
+			t.Errorf("%q %s: content is not a pixel", test.accept, test.path)
+		}
+	}
+}
+
+//
+// Test responses in each block mode
+//
+func TestBlockModes(t *testing.T) {
+	froxy := &Froxy{
+		Env:     &Env{},
+		Ebus:    NewEbus(),
+		httpSrv: &http.Server{Addr: "localhost:8888"},
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mode := BlockMode(r.Header.Get("X-Block-Mode"))
+			froxy.handleBlocked(w, r, mode)
+		}))
+	defer srv.Close()
+
+	tests := []struct {
+		mode        BlockMode
+		path        string
+		status      int
+		contentType string
+		content     []byte
+	}{
+		{BlockModePage, "/", http.StatusForbidden, "", nil},
+		{BlockModeEmpty, "/ad.gif", http.StatusNoContent, "", []byte{}},
+		{BlockModePixel, "/ad.gif", http.StatusOK, "image/gif", blockPixelGIF},
+		{BlockModePixel, "/ad.js", http.StatusOK,
+			"application/javascript", []byte{}},
+		{BlockModePixel, "/ad", http.StatusNoContent, "", []byte{}},
+	}
+
+	for _, test := range tests {
+		name := blockModeName(test.mode) + " " + test.path
+		rq, _ := http.NewRequest("GET", srv.URL+test.path, nil)
+		rq.Header.Set("X-Block-Mode", string(test.mode))
+
+		rsp, err := http.DefaultClient.Do(rq)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+
+		content, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+
+		if rsp.StatusCode != test.status {
+			t.Errorf("%s: status %d expected, %d received",
+				name, test.status, rsp.StatusCode)
+		}
+
+		if test.contentType != "" &&
+			rsp.Header.Get("Content-Type") != test.contentType {
+			t.Errorf("%s: %q expected, %q received", name,
+				test.contentType, rsp.Header.Get("Content-Type"))
+		}
+
+		if test.content != nil && !bytes.Equal(content, test.content) {
+			t.Errorf("%s: content %q expected, %q received",
+				name, test.content, content)
+		}
+	}
+
+	// Connection is closed in close mode, and CONNECT requests
+	// are closed in all modes, except error page. Raw connection
+	// is used, as http.Client retries closed requests
+	raw := []struct {
+		method, target string
+		mode           BlockMode
+	}{
+		{"GET", "/", BlockModeClose},
+		{"CONNECT", "ads.example.com:443", BlockModeEmpty},
+		{"CONNECT", "ads.example.com:443", BlockModePixel},
+		{"CONNECT", "ads.example.com:443", BlockModePage},
+	}
+
+	for _, test := range raw {
+		name := test.method + " " + blockModeName(test.mode)
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		conn.Write([]byte(test.method + " " + test.target + " HTTP/1.1\r\n" +
+			"Host: ads.example.com:443\r\n" +
+			"X-Block-Mode: " + string(test.mode) + "\r\n\r\n"))
+
+		rq := &http.Request{Method: test.method}
+		rsp, err := http.ReadResponse(bufio.NewReader(conn), rq)
+		conn.Close()
+
+		switch {
+		case test.mode != BlockModePage && err == nil:
+			t.Errorf("%s: connection is not closed", name)
+		case test.mode == BlockModePage && err != nil:
+			t.Errorf("%s: %s", name, err)
+		case test.mode == BlockModePage &&
+			rsp.StatusCode != http.StatusForbidden:
+			t.Errorf("%s: status %d", name, rsp.StatusCode)
+		}
+	}
+
+	// Check counters
+	counters := []struct {
+		name          string
+		received, exp int32
+	}{
+		{"page", froxy.Counters.HTTPRqBlkPage, 2},
+		{"empty", froxy.Counters.HTTPRqBlkEmpty, 1},
+		{"pixel", froxy.Counters.HTTPRqBlkPixel, 3},
+		{"close", froxy.Counters.HTTPRqBlkClose, 3},
+	}
+
+	for _, c := range counters {
+		if c.received != c.exp {
+			t.Errorf("%s counter: %d expected, %d received",
+				c.name, c.exp, c.received)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Keyboard-interactive authentication challenges
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Pending keyboard-interactive challenges
+//
+// When SSH server asks questions that Froxy cannot answer by
+// itself, the challenge is shown to user via WebAPI (see
+// EventChallengesChanged), and SSH handshake waits for answers
+//
+type Challenges struct {
+	froxy   *Froxy       // Back link to Froxy
+	lock    sync.Mutex   // Access lock
+	pending []*Challenge // Pending challenges, in order of arrival
+	nextID  uint64       // Next challenge ID
+}
+
+//
+// Keyboard-interactive challenge
+//
+type Challenge struct {
+	ID          string        `json:"id"`          // Challenge ID
+	Server      string        `json:"server"`      // Server address
+	User        string        `json:"user"`        // User name
+	Name        string        `json:"name"`        // Challenge name
+	Instruction string        `json:"instruction"` // Instruction from server
+	Questions   []string      `json:"questions"`   // Questions to answer
+	Echos       []bool        `json:"echos"`       // Echo answers, per question
+	answers     chan []string // Answers, nil if canceled
+}
+
+//
+// Create new Challenges
+//
+func NewChallenges(froxy *Froxy) *Challenges {
+	return &Challenges{froxy: froxy}
+}
+
+//
+// Ask user to answer the challenge. Blocks until answers are
+// received, challenge is canceled by user, context is canceled
+// or SSH_CHALLENGE_TIMEOUT expires
+//
+func (c *Challenges) Ask(ctx context.Context, server, user, name,
+	instruction string, questions []string, echos []bool) ([]string, error) {
+
+	// Register the challenge
+	c.lock.Lock()
+	c.nextID++
+	ch := &Challenge{
+		ID:          fmt.Sprintf("%d", c.nextID),
+		Server:      server,
+		User:        user,
+		Name:        name,
+		Instruction: instruction,
+		Questions:   questions,
+		Echos:       echos,
+		answers:     make(chan []string, 1),
+	}
+	c.pending = append(c.pending, ch)
+	c.lock.Unlock()
+
+	c.froxy.Info("SSH: server %q asks for authentication response", server)
+	c.froxy.Raise(EventChallengesChanged)
+
+	defer func() {
+		c.remove(ch.ID)
+		c.froxy.Raise(EventChallengesChanged)
+	}()
+
+	// Wait for answers
+	timer := time.NewTimer(SSH_CHALLENGE_TIMEOUT)
+	defer timer.Stop()
+
+	select {
+	case answers := <-ch.answers:
+		if answers == nil {
+			return nil, ErrChallengeCanceled
+		}
+		return answers, nil
+
+	case <-timer.C:
+		return nil, ErrChallengeTimeout
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+//
+// Get pending challenges
+//
+func (c *Challenges) List() []Challenge {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	list := make([]Challenge, len(c.pending))
+	for i, ch := range c.pending {
+		list[i] = *ch
+		list[i].answers = nil
+	}
+
+	return list
+}
+
+//
+// Answer the challenge. If answers is nil, challenge is canceled
+//
+func (c *Challenges) Answer(id string, answers []string) error {
+	c.lock.Lock()
+	var ch *Challenge
+	for _, pending := range c.pending {
+		if pending.ID == id {
+			ch = pending
+		}
+	}
+	c.lock.Unlock()
+
+	switch {
+	case ch == nil:
+		return ErrNoSuchChallenge
+	case answers != nil && len(answers) != len(ch.Questions):
+		return fmt.Errorf("%d answers expected", len(ch.Questions))
+	case c.remove(id) == nil:
+		return ErrNoSuchChallenge
+	}
+
+	ch.answers <- answers
+	c.froxy.Raise(EventChallengesChanged)
+
+	return nil
+}
+
+//
+// Remove challenge from the list of pending. Returns removed
+// challenge, nil if not found
+//
+func (c *Challenges) remove(id string) *Challenge {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for i, ch := range c.pending {
+		if ch.ID == id {
+			c.pending = append(c.pending[:i:i], c.pending[i+1:]...)
+			return ch
+		}
+	}
+
+	return nil
+}
+
+// ----- Automatic answers -----
+//
+// Words in question, that indicate the password prompt
+//
+var challengePasswordWords = []string{"password", "passphrase"}
+
+//
+// Words in question, that indicate the one-time code prompt
+//
+var challengeCodeWords = []string{
+	"code", "otp", "token", "one-time", "2fa", "authenticator",
+	"verification",
+}
+
+//
+// Answer questions that Froxy can answer by itself: the password
+// prompt, if password is known, and the one-time code prompt, if
+// TOTP seed is known. Returns answers and count of answered questions
+//
+func challengeAutoAnswer(params *ServerParams, questions []string,
+	now time.Time) ([]string, int, error) {
+
+	answers := make([]string, len(questions))
+	answered := 0
+
+	for i, q := range questions {
+		switch {
+		case params.TOTP != "" && challengeMatch(q, challengeCodeWords):
+			code, err := TOTPCode(params.TOTP, now)
+			if err != nil {
+				return nil, 0, err
+			}
+			answers[i] = code
+
+		case params.Password != "" &&
+			challengeMatch(q, challengePasswordWords):
+			answers[i] = params.Password
+
+		default:
+			continue
+		}
+
+		answered++
+	}
+
+	return answers, answered, nil
+}
+
+//
+// Check if question contains any of words
+//
+func challengeMatch(question string, words []string) bool {
+	question = strings.ToLower(question)
+	for _, w := range words {
+		if strings.Contains(question, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// ----- TOTP -----
+//
+// Compute the time-based one-time password (RFC 6238) with
+// commonly used parameters: HMAC-SHA1, 30 seconds step, 6 digits
+//
+// The seed is base32-encoded, as shown by most services when
+// 2FA is enabled. Spaces and padding are ignored
+//
+func TOTPCode(seed string, now time.Time) (string, error) {
+	key, err := TOTPDecodeSeed(seed)
+	if err != nil {
+		return "", err
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(now.Unix()/30))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	off := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", code%1000000), nil
+}
+
+//
+// Decode base32-encoded TOTP seed
+//
+func TOTPDecodeSeed(seed string) ([]byte, error) {
+	seed = strings.ToUpper(strings.Replace(seed, " ", "", -1))
+	seed = strings.TrimRight(seed, "=")
+
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).
+		DecodeString(seed)
+	if err != nil || len(key) == 0 {
+		return nil, ErrTOTPSeed
+	}
+
+	return key, nil
+}
@@ -0,0 +1,329 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Keyboard-interactive authentication challenges test
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//
+// Base32-encoded seed of RFC 6238 test vectors (SHA-1)
+//
+const challengeTestSeed = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+//
+// Test TOTPCode against RFC 6238, Appendix B (SHA-1 vectors,
+// truncated to 6 digits)
+//
+func TestTOTPCode(t *testing.T) {
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, test := range tests {
+		code, err := TOTPCode(challengeTestSeed, time.Unix(test.time, 0))
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		if code != test.code {
+			t.Errorf("T=%d: %s expected, %s received",
+				test.time, test.code, code)
+		}
+	}
+}
+
+//
+// Test TOTP seed normalization
+//
+func TestTOTPDecodeSeed(t *testing.T) {
+	key := []byte("12345678901234567890")
+
+	tests := []string{
+		challengeTestSeed,
+		"gezdgnbvgy3tqojqgezdgnbvgy3tqojq",
+		"GEZD GNBV GY3T QOJQ GEZD GNBV GY3T QOJQ",
+		"gezd gnbv gy3t qojq gezd gnbv gy3t qojq",
+		"MFRGG===",
+		"MFRGG",
+		"mfrgg=",
+	}
+
+	for i, seed := range tests {
+		decoded, err := TOTPDecodeSeed(seed)
+		if err != nil {
+			t.Errorf("%q: %s", seed, err)
+			continue
+		}
+
+		expected := key
+		if i >= 4 {
+			expected = []byte("abc")
+		}
+
+		if !reflect.DeepEqual(decoded, expected) {
+			t.Errorf("%q: %q expected, %q received",
+				seed, expected, decoded)
+		}
+	}
+
+	for _, seed := range []string{"", "   ", "====", "GEZD1", "GEZ!"} {
+		_, err := TOTPDecodeSeed(seed)
+		if err != ErrTOTPSeed {
+			t.Errorf("%q: error expected", seed)
+		}
+	}
+}
+
+//
+// Test automatic answers to keyboard-interactive questions
+//
+func TestChallengeAutoAnswer(t *testing.T) {
+	now := time.Unix(59, 0)
+
+	tests := []struct {
+		params    ServerParams
+		questions []string
+		answers   []string
+		answered  int
+	}{
+		{
+			ServerParams{Password: "secret", TOTP: challengeTestSeed},
+			[]string{"Password: ", "Verification code: "},
+			[]string{"secret", "287082"},
+			2,
+		},
+		{
+			ServerParams{Password: "secret", TOTP: challengeTestSeed},
+			[]string{"Enter PASSPHRASE:", "OTP:", "Token:",
+				"One-time password:", "Your 2FA:",
+				"Authenticator app:"},
+			[]string{"secret", "287082", "287082",
+				"287082", "287082", "287082"},
+			6,
+		},
+		{
+			ServerParams{Password: "secret"},
+			[]string{"Password: ", "Verification code: "},
+			[]string{"secret", ""},
+			1,
+		},
+		{
+			ServerParams{TOTP: challengeTestSeed},
+			[]string{"Password: ", "Verification code: "},
+			[]string{"", "287082"},
+			1,
+		},
+		{
+			ServerParams{Password: "secret", TOTP: challengeTestSeed},
+			[]string{"Your favorite color?"},
+			[]string{""},
+			0,
+		},
+		{
+			ServerParams{},
+			[]string{"Password: "},
+			[]string{""},
+			0,
+		},
+	}
+
+	for _, test := range tests {
+		answers, answered, err := challengeAutoAnswer(&test.params,
+			test.questions, now)
+		if err != nil {
+			t.Errorf("%q: %s", test.questions, err)
+			continue
+		}
+
+		if answered != test.answered ||
+			!reflect.DeepEqual(answers, test.answers) {
+			t.Errorf("%q: %q (%d) expected, %q (%d) received",
+				test.questions, test.answers, test.answered,
+				answers, answered)
+		}
+	}
+
+	params := ServerParams{TOTP: "bad seed!"}
+	_, _, err := challengeAutoAnswer(&params, []string{"Code:"}, now)
+	if err != ErrTOTPSeed {
+		t.Errorf("bad seed: %v", err)
+	}
+}
+
+//
+// Start SSH server, that rejects public key and asks a question,
+// Froxy cannot answer by itself, via keyboard-interactive
+//
+func challengeTestServer(t *testing.T) net.Listener {
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (
+			*ssh.Permissions, error) {
+			return nil, errors.New("rejected")
+		},
+
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata,
+			client ssh.KeyboardInteractiveChallenge) (
+			*ssh.Permissions, error) {
+			answers, err := client("", "Answer the question",
+				[]string{"Favorite color? "}, []bool{true})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != 1 || answers[0] != "blue" {
+				return nil, errors.New("wrong answer")
+			}
+			return nil, nil
+		},
+	}
+
+	return sshTestServer(t, cfg)
+}
+
+//
+// Wait until challenge appears in the list of pending challenges
+//
+func challengeTestWait(t *testing.T, froxy *Froxy) Challenge {
+	for i := 0; i < 500; i++ {
+		if list := froxy.challenges.List(); len(list) != 0 {
+			return list[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("challenge not received")
+	return Challenge{}
+}
+
+//
+// Test that keyboard-interactive challenge, Froxy cannot answer
+// by itself, is answered by user after public key is rejected
+//
+func TestChallengeInteractiveAnswer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "froxy")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, cleanup := agentTestStart(t)
+	defer cleanup()
+
+	l := challengeTestServer(t)
+	defer l.Close()
+
+	froxy := sshTestFroxy(dir, []ServerParams{
+		{Addr: l.Addr().String(), Login: "test", Agent: true},
+	})
+	tr := NewSSHTransport(froxy, "")
+	defer tr.Reconnect(nil)
+
+	type result struct {
+		session *sshSession
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		session, err := tr.getSession(tr.ctx)
+		done <- result{session, err}
+	}()
+
+	ch := challengeTestWait(t, froxy)
+	if ch.Server != l.Addr().String() || ch.User != "test" ||
+		ch.Instruction != "Answer the question" ||
+		!reflect.DeepEqual(ch.Questions, []string{"Favorite color? "}) ||
+		!reflect.DeepEqual(ch.Echos, []bool{true}) {
+		t.Fatalf("challenge: %+v", ch)
+	}
+
+	if err = froxy.challenges.Answer(ch.ID, []string{}); err == nil {
+		t.Errorf("wrong count of answers: error expected")
+	}
+
+	if err = froxy.challenges.Answer(ch.ID, []string{"blue"}); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	rs := <-done
+	if rs.err != nil {
+		t.Fatalf("%s", rs.err)
+	}
+	rs.session.unref()
+
+	if list := froxy.challenges.List(); len(list) != 0 {
+		t.Errorf("answered challenge is still pending: %+v", list)
+	}
+
+	if err = froxy.challenges.Answer(ch.ID, []string{"blue"}); err !=
+		ErrNoSuchChallenge {
+		t.Errorf("answer twice: %v", err)
+	}
+}
+
+//
+// Test that pending challenge is removed, when connect
+// context is canceled
+//
+func TestChallengeInteractiveCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "froxy")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := challengeTestServer(t)
+	defer l.Close()
+
+	froxy := sshTestFroxy(dir, []ServerParams{
+		{Addr: l.Addr().String(), Login: "test", Password: "test"},
+	})
+	tr := NewSSHTransport(froxy, "")
+	defer tr.Reconnect(nil)
+
+	done := make(chan error, 1)
+	go func() {
+		session, err := tr.getSession(tr.ctx)
+		if err == nil {
+			session.unref()
+		}
+		done <- err
+	}()
+
+	challengeTestWait(t, froxy)
+	tr.ctx.Cancel()
+
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connect is not aborted")
+	}
+
+	if err == nil {
+		t.Errorf("connect error expected")
+	}
+
+	if list := froxy.challenges.List(); len(list) != 0 {
+		t.Errorf("challenge is still pending: %+v", list)
+	}
+}
@@ -65,6 +65,106 @@ const (
 	//
 	SSH_MAX_CONN_PER_CLIENT = 10
 
+	//
+	// How long to wait for user to answer keyboard-interactive
+	// authentication challenge
+	//
+	SSH_CHALLENGE_TIMEOUT = 2 * time.Minute
+
+	//
+	// Default interval between keepalive requests
+	//
+	SSH_KEEPALIVE_INTERVAL = 15 * time.Second
+
+	//
+	// Default count of unanswered keepalive intervals, after
+	// which session is considered dead
+	//
+	SSH_KEEPALIVE_MAX = 3
+
+	//
+	// Keepalive request name
+	//
+	SSH_KEEPALIVE_REQUEST = "keepalive@openssh.com"
+
+	//
+	// Delay before the first retry after connection failure.
+	// Each next delay doubles, up to SSH_RETRY_MAX
+	//
+	SSH_RETRY_MIN = 2 * time.Second
+
+	//
+	// Max delay between connection attempts
+	//
+	SSH_RETRY_MAX = 5 * time.Minute
+
+	//
+	// How long to wait for the proxy command to exit after
+	// it closes its output, to report its exit status
+	//
+	SSH_COMMAND_EXIT_TIMEOUT = time.Second
+
+	//
+	// TLS or WebSocket handshake timeout, when SSH goes
+	// over TLS or WebSocket
+	//
+	SSH_TUNNEL_HANDSHAKE_TIMEOUT = 20 * time.Second
+
+	//
+	// How long to wait for upstream HTTP proxy to respond
+	// to the CONNECT request
+	//
+	SSH_UPSTREAM_TIMEOUT = 20 * time.Second
+
+	// ----- Router configuration -----
+	//
+	// Timeout of resolving host names, when matching
+	// resolved addresses against CIDR blocks
+	//
+	ROUTER_RESOLVE_TIMEOUT = 5 * time.Second
+
+	// ----- Subscriptions configuration -----
+	//
+	// How often subscribed site lists are updated
+	//
+	SUBSCRIPTION_UPDATE_INTERVAL = 6 * time.Hour
+
+	//
+	// How soon to retry, if update has failed
+	//
+	SUBSCRIPTION_RETRY_INTERVAL = 10 * time.Minute
+
+	//
+	// Timeout for fetching the site list
+	//
+	SUBSCRIPTION_TIMEOUT = 60 * time.Second
+
+	//
+	// Max size of the site list
+	//
+	SUBSCRIPTION_MAX_SIZE = 16 * 1024 * 1024
+
+	// ----- Fallback to server configuration -----
+	//
+	// How long to wait for the first response data from the
+	// directly connected site before fallback to the server
+	//
+	FALLBACK_TIMEOUT = 10 * time.Second
+
+	//
+	// Max amount of data, sent by client before the first
+	// response data is received, that can be replayed to
+	// the server on fallback
+	//
+	FALLBACK_MAX_REPLAY = 64 * 1024
+
+	//
+	// Count of fallbacks, after which host is learned, and
+	// its requests are forwarded to the server without
+	// attempt of direct access
+	//
+	FALLBACK_LEARN_COUNT = 3
+
 	// ----- Logging configuration -----
 	//
 	// Max size of log file
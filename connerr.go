@@ -0,0 +1,157 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Classification of connection errors
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//
+// Machine-readable code of the connection error
+//
+type ConnErrorCode string
+
+const (
+	ConnErrorNone        = ConnErrorCode("")            // No error
+	ConnErrorDNS         = ConnErrorCode("dns")         // Host name not resolved
+	ConnErrorUnreachable = ConnErrorCode("unreachable") // TCP connection failed
+	ConnErrorTimeout     = ConnErrorCode("timeout")     // Server doesn't respond
+	ConnErrorAuth        = ConnErrorCode("auth")        // Authentication rejected
+	ConnErrorHostKey     = ConnErrorCode("hostkey")     // Host key mismatch
+	ConnErrorDialRefused = ConnErrorCode("dial")        // Server refuses to forward
+	ConnErrorOther       = ConnErrorCode("other")       // Something else
+)
+
+//
+// Classify the connection error
+//
+func ConnErrorClassify(err error) ConnErrorCode {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var opErr *net.OpError
+	var chanErr *ssh.OpenChannelError
+
+	switch {
+	case err == nil:
+		return ConnErrorNone
+
+	case errors.As(err, new(*HostKeyMismatchError)):
+		return ConnErrorHostKey
+
+	case errors.As(err, new(*SSHAuthError)):
+		return ConnErrorAuth
+
+	case errors.As(err, new(*SSHDialError)),
+		errors.As(err, &chanErr) && chanErr.Reason == ssh.Prohibited:
+		return ConnErrorDialRefused
+
+	case errors.As(err, &dnsErr):
+		return ConnErrorDNS
+
+	case errors.Is(err, ErrSSHKeepAlive),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return ConnErrorTimeout
+
+	case errors.Is(err, ErrNetDisconnected),
+		errors.As(err, &opErr) && opErr.Op == "dial":
+		return ConnErrorUnreachable
+	}
+
+	return ConnErrorOther
+}
+
+// ----- Authentication errors -----
+//
+// Authentication methods, offered by the server
+//
+type sshAuthOffered struct {
+	methods  []string // Offered methods, in order of appearance
+	rejected bool     // Authentication aborted by the probe
+}
+
+//
+// Record the offered method
+//
+func (offered *sshAuthOffered) add(method string) {
+	for _, m := range offered.methods {
+		if m == method {
+			return
+		}
+	}
+	offered.methods = append(offered.methods, method)
+}
+
+//
+// Check if handshake error means that authentication was rejected
+//
+// golang.org/x/crypto/ssh doesn't preserve the error type, so
+// the only way to recognize its own failure is the error text
+//
+func (offered *sshAuthOffered) Rejected(err error) bool {
+	return offered.rejected ||
+		strings.Contains(err.Error(), "ssh: unable to authenticate")
+}
+
+//
+// Authentication rejected by the server
+//
+type SSHAuthError struct {
+	Methods []string // Methods the server offered
+	Err     error    // Underlying error
+}
+
+//
+// Get error string -- implements error interface
+//
+func (e *SSHAuthError) Error() string {
+	methods := "none"
+	if len(e.Methods) != 0 {
+		methods = strings.Join(e.Methods, ", ")
+	}
+
+	return fmt.Sprintf("%s, server offers: %s", ErrSSHAuthRejected, methods)
+}
+
+//
+// Get underlying error
+//
+func (e *SSHAuthError) Unwrap() error {
+	return e.Err
+}
+
+// ----- Forwarding errors -----
+//
+// Server refused to forward connection, because port
+// forwarding is prohibited on the server
+//
+type SSHDialError struct {
+	Addr string // Destination address
+	Err  error  // Underlying error
+}
+
+//
+// Get error string -- implements error interface
+//
+func (e *SSHDialError) Error() string {
+	return fmt.Sprintf("Server refuses to forward connection to %q: %s",
+		e.Addr, e.Err)
+}
+
+//
+// Get underlying error
+//
+func (e *SSHDialError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,129 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Classification of connection errors test
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//
+// Test errors classification
+//
+func TestConnErrorClassify(t *testing.T) {
+	dial := &net.OpError{Op: "dial", Net: "tcp",
+		Err: errors.New("connection refused")}
+	dns := &net.OpError{Op: "dial", Net: "tcp",
+		Err: &net.DNSError{Name: "x.invalid", IsNotFound: true}}
+	dnsTimeout := &net.OpError{Op: "dial", Net: "tcp",
+		Err: &net.DNSError{IsTimeout: true}}
+
+	tests := []struct {
+		err  error
+		code ConnErrorCode
+	}{
+		{nil, ConnErrorNone},
+		{dial, ConnErrorUnreachable},
+		{dns, ConnErrorDNS},
+		{dnsTimeout, ConnErrorDNS},
+		{&net.OpError{Op: "read", Err: context.DeadlineExceeded},
+			ConnErrorTimeout},
+		{ErrSSHKeepAlive, ConnErrorTimeout},
+		{ErrNetDisconnected, ConnErrorUnreachable},
+		{&HostKeyMismatchError{}, ConnErrorHostKey},
+		{fmt.Errorf("jump host %q: %w", "jump",
+			&SSHAuthError{}), ConnErrorAuth},
+		{&SSHDialError{}, ConnErrorDialRefused},
+		{&ssh.OpenChannelError{Reason: ssh.Prohibited}, ConnErrorDialRefused},
+		{&ssh.OpenChannelError{Reason: ssh.ConnectionFailed}, ConnErrorOther},
+		{errors.New("something"), ConnErrorOther},
+	}
+
+	for _, test := range tests {
+		code := ConnErrorClassify(test.err)
+		if code != test.code {
+			t.Errorf("%v: %q expected, %q received", test.err,
+				test.code, code)
+		}
+	}
+}
+
+//
+// Test recording of authentication methods, offered by the server
+//
+func TestConnErrorAuthOffered(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Server accepts only keys, and rejects all of them
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (
+			*ssh.Permissions, error) {
+			return nil, errors.New("rejected")
+		},
+	}
+	cfg.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			ssh.NewServerConn(conn, cfg)
+			conn.Close()
+		}
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// Client uses password
+	srv := &sshServer{params: ServerParams{Login: "test", Password: "test"}}
+	offered := &sshAuthOffered{}
+	clientCfg, err := srv.SshClientConfig(context.Background(), offered)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	clientCfg.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+
+	_, _, _, err = ssh.NewClientConn(client, "test", clientCfg)
+	client.Close()
+
+	if err == nil {
+		t.Fatalf("authentication error expected")
+	}
+
+	if !offered.Rejected(err) {
+		t.Errorf("%s: not recognized as authentication error", err)
+	}
+
+	if !reflect.DeepEqual(offered.methods, []string{"publickey"}) {
+		t.Errorf("offered methods: %v", offered.methods)
+	}
+}
@@ -20,5 +20,18 @@ type Counters struct {
 	HTTPRqDirect    int32 `json:"http_rq_direct"`    // Count of direct requests
 	HTTPRqForwarded int32 `json:"http_rq_forwarded"` // Count of forwarded requests
 	HTTPRqBlocked   int32 `json:"http_rq_blocked"`   // Count of blocked requests
+	HTTPRqBlkPage   int32 `json:"http_rq_blk_page"`  // Blocked with error page
+	HTTPRqBlkEmpty  int32 `json:"http_rq_blk_empty"` // Blocked with empty response
+	HTTPRqBlkPixel  int32 `json:"http_rq_blk_pixel"` // Blocked with fake content
+	HTTPRqBlkClose  int32 `json:"http_rq_blk_close"` // Blocked by closing connection
+	HTTPRqFallback  int32 `json:"http_rq_fallback"`  // Count of direct requests, retried via server
 	FTPConnections  int32 `json:"ftp_conns"`         // Count of FTP connections
 }
+
+//
+// Per-transport SSH statistic counters
+//
+type SSHCounters struct {
+	SSHSessions    int32 `json:"ssh_sessions"` // Count of SSH client sessions
+	SSHConnections int32 `json:"ssh_conns"`    // Count of connections via SSH
+}
@@ -10,11 +10,13 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net"
+	"regexp"
 	"strings"
 )
 
 //
-// Validate domain name
+// Validate domain name or domain pattern
 //
 // This function validates international domain name, entered by user.
 // It may either accept domain as is, return an error or suggest a
@@ -25,7 +27,36 @@ import (
 // accepts user input, the returned replacement will be a pure host
 // name, converted to lower case
 //
-func DomainValidate(domain string) (string, error) {
+// Domain patterns are also accepted, and pattern type is detected
+// automatically:
+//   - domain with '*' or '?' characters is a wildcard pattern
+//     (SiteTypeGlob), where '*' matches any sequence of characters,
+//     including dots, and '?' matches any single character
+//   - string, enclosed into slashes (/regexp/), is the regular
+//     expression (SiteTypeRegexp). The expression is anchored, i.e.,
+//     it must match the entire host name. Returned replacement
+//     doesn't include slashes
+//   - IPv4 or IPv6 CIDR block (like 10.20.0.0/16) is the address
+//     range (SiteTypeCIDR). Bare IPv6 address is accepted as a /128
+//     block. Returned replacement is the canonical form of the block
+//
+func DomainValidate(domain string) (string, SiteType, error) {
+	// Check for CIDR
+	if cidr, ok := domainCheckCIDR(domain); ok {
+		return cidr, SiteTypeCIDR, nil
+	}
+
+	// Check for regexp
+	if len(domain) > 2 && domain[0] == '/' && domain[len(domain)-1] == '/' {
+		domain = domain[1 : len(domain)-1]
+		_, err := SiteRegexpCompile(domain)
+		if err != nil {
+			return "", SiteTypeRegexp, err
+		}
+
+		return domain, SiteTypeRegexp, nil
+	}
+
 	// Check for URL
 	domain = domainCheckURL(domain)
 
@@ -34,15 +65,21 @@ func DomainValidate(domain string) (string, error) {
 		domain = domain[:i]
 	}
 
+	// Check for wildcard pattern
+	typ := SiteTypeDomain
+	if strings.IndexAny(domain, "*?") >= 0 {
+		typ = SiteTypeGlob
+	}
+
 	// Decode IDN
-	domain = IDNEncode(domain)
+	domain = IDNEncodePattern(domain, typ)
 
 	// Check total length
 	switch {
 	case len(domain) < 1:
-		return "", errors.New("Domain name is empty")
+		return "", typ, errors.New("Domain name is empty")
 	case len(domain) > 253:
-		return "", errors.New("Domain name exceeds 253 bytes")
+		return "", typ, errors.New("Domain name exceeds 253 bytes")
 	}
 
 	// Check for invalid characters
@@ -52,8 +89,9 @@ func DomainValidate(domain string) (string, error) {
 		// browsers allow them, so we do the same
 		case '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' ||
 			c == '-' || c == '_' || c == '.':
+		case typ == SiteTypeGlob && (c == '*' || c == '?'):
 		default:
-			return "", fmt.Errorf("Domain name contains character '%c'", c)
+			return "", typ, fmt.Errorf("Domain name contains character '%c'", c)
 		}
 	}
 
@@ -65,13 +103,88 @@ func DomainValidate(domain string) (string, error) {
 		// browsers are tolerant
 		switch {
 		case len(label) < 1:
-			return "", errors.New("Domain name label is empty")
+			return "", typ, errors.New("Domain name label is empty")
 		case len(label) > 63:
-			return "", errors.New("Domain name label exceeds 63 bytes")
+			return "", typ, errors.New("Domain name label exceeds 63 bytes")
 		}
 	}
 
-	return IDNDecode(domain), nil
+	return IDNDecodePattern(domain, typ), typ, nil
+}
+
+//
+// Compile site regular expression. The expression is anchored,
+// so it must match the entire host name
+//
+func SiteRegexpCompile(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+//
+// Match string against the wildcard pattern, where '*' matches any
+// sequence of characters, including empty sequence, and '?' matches
+// any single character. All other characters match themselves
+//
+func wildcardMatch(pattern, s string) bool {
+	// Backtracking position of the last seen '*'
+	star, next := -1, 0
+
+	p := 0
+	for i := 0; i < len(s); {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case star >= 0:
+			next++
+			p, i = star+1, next
+		default:
+			return false
+		}
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
+
+//
+// Count non-wildcard characters in the wildcard pattern. More
+// literal characters means more specific pattern
+//
+func wildcardLiterals(pattern string) int {
+	return len(pattern) - strings.Count(pattern, "*") - strings.Count(pattern, "?")
+}
+
+//
+// Check if domain is a CIDR block or bare IPv6 address. If it is,
+// returns its canonical form
+//
+func domainCheckCIDR(domain string) (string, bool) {
+	if strings.IndexByte(domain, '/') < 0 {
+		if strings.IndexByte(domain, ':') < 0 {
+			return "", false
+		}
+
+		ip := net.ParseIP(strings.Trim(domain, "[]"))
+		if ip == nil || ip.To4() != nil {
+			return "", false
+		}
+
+		domain = ip.String() + "/128"
+	}
+
+	_, cidr, err := net.ParseCIDR(domain)
+	if err != nil {
+		return "", false
+	}
+
+	return cidr.String(), true
 }
 
 //
@@ -27,6 +27,10 @@ const (
 	EventKeysChanged
 	EventShutdownRequested
 	EventIpAddrChanged
+	EventLearnedChanged
+	EventSiteStatsChanged
+	EventSubscriptionsChanged
+	EventChallengesChanged
 )
 
 //
@@ -50,6 +54,14 @@ func (e Event) String() string {
 		return "EventShutdownRequested"
 	case EventIpAddrChanged:
 		return "EventIpAddrChanged"
+	case EventLearnedChanged:
+		return "EventLearnedChanged"
+	case EventSiteStatsChanged:
+		return "EventSiteStatsChanged"
+	case EventSubscriptionsChanged:
+		return "EventSubscriptionsChanged"
+	case EventChallengesChanged:
+		return "EventChallengesChanged"
 	}
 
 	panic("internal error")
@@ -11,9 +11,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/alexpevzner/froxy/internal/sysdep"
 )
@@ -35,6 +37,7 @@ type Env struct {
 	PathUserStartupDir string // User Startup folder
 	PathUserIconsDir   string // User icons directory
 	PathUserLockDir    string // User locks
+	PathUserSubsDir    string // Cache of subscribed site lists
 
 	// File paths
 	PathUserConfFile    string // User-specific configuration file
@@ -87,6 +90,7 @@ func NewEnv() *Env {
 	env.PathUserStartupDir = sysdep.UserStartupDir()
 	env.PathUserIconsDir = env.PathUserConfDir
 	env.PathUserLockDir = filepath.Join(env.PathUserStateDir, "lock")
+	env.PathUserSubsDir = filepath.Join(env.PathUserStateDir, "subscriptions")
 
 	progname := strings.ToLower(PROGRAM_NAME)
 
@@ -105,7 +109,8 @@ func NewEnv() *Env {
 		env.PathUserStateDir,
 		env.PathUserLogDir,
 		env.PathUserKeysDir,
-		env.PathUserLockDir} {
+		env.PathUserLockDir,
+		env.PathUserSubsDir} {
 
 		_, ok := done[dir]
 		if !ok {
@@ -258,26 +263,213 @@ func (env *Env) GetPort() int {
 }
 
 //
-// Get server parameters
+// Get servers parameters, in order of preference
 //
-func (env *Env) GetServerParams() ServerParams {
+func (env *Env) GetServers() (servers []ServerParams) {
 	env.stateLock.RLock()
-	s := env.state.Server
+	servers = env.state.Servers
+	if servers == nil {
+		servers = make([]ServerParams, 0)
+	}
 	env.stateLock.RUnlock()
+	return
+}
+
+//
+// Set servers parameters
+//
+// If server, listed at the same position, has changed its ident
+// (i.e., was renamed), sites and subscriptions that refer the server
+// by the old ident are updated to use the new one. Returns true,
+// if references were updated
+//
+func (env *Env) SetServers(servers []ServerParams) bool {
+	env.stateLock.Lock()
+	defer env.stateLock.Unlock()
+
+	renames := envServerRenames(env.state.Servers, servers)
+	updated := false
+
+	// Router may work with previous version of sites list,
+	// so lists are replaced with updated copies
+	sites := make([]SiteParams, len(env.state.Sites))
+	copy(sites, env.state.Sites)
+	for i := range sites {
+		if ident, ok := renames[sites[i].Server]; ok {
+			sites[i].Server = ident
+			updated = true
+		}
+	}
+
+	subs := make([]Subscription, len(env.state.Subscribe))
+	copy(subs, env.state.Subscribe)
+	for i := range subs {
+		if ident, ok := renames[subs[i].Server]; ok {
+			subs[i].Server = ident
+			updated = true
+		}
+	}
+
+	if updated {
+		env.state.Sites = sites
+		env.state.Subscribe = subs
+	}
+
+	env.state.Servers = servers
+	env.state.Save(env.PathUserStateFile)
+
+	return updated
+}
+
+//
+// Check that new servers parameters don't leave sites and
+// subscriptions referring servers that don't exist anymore
+//
+// References that were already broken are not reported,
+// and renamed servers are handled by SetServers
+//
+func (env *Env) CheckServersInUse(servers []ServerParams) error {
+	env.stateLock.RLock()
+	defer env.stateLock.RUnlock()
+
+	renames := envServerRenames(env.state.Servers, servers)
+	known := make(map[string]struct{})
+	for _, s := range env.state.Servers {
+		known[s.Ident()] = struct{}{}
+	}
+	for _, s := range servers {
+		delete(known, s.Ident())
+	}
+	for ident := range renames {
+		delete(known, ident)
+	}
+
+	for _, site := range env.state.Sites {
+		if _, removed := known[site.Server]; removed && site.Server != "" {
+			return fmt.Errorf("Server %q is used by site %q",
+				site.Server, site.Host)
+		}
+	}
+
+	for _, sub := range env.state.Subscribe {
+		if _, removed := known[sub.Server]; removed && sub.Server != "" {
+			return fmt.Errorf("Server %q is used by subscription %q",
+				sub.Server, sub.URL)
+		}
+	}
+
+	return nil
+}
+
+//
+// Find servers, renamed between old and new servers lists.
+// Returns map of old idents to new idents
+//
+// Server is considered renamed, if it remains at the same
+// position, but its ident has changed, and neither old nor
+// new ident is used by another server. It is how the
+// configuration page edits the server
+//
+func envServerRenames(old, new []ServerParams) map[string]string {
+	renames := make(map[string]string)
+	if len(old) != len(new) {
+		return renames
+	}
+
+	oldIdents := make(map[string]struct{})
+	newIdents := make(map[string]struct{})
+	for i := range old {
+		oldIdents[old[i].Ident()] = struct{}{}
+		newIdents[new[i].Ident()] = struct{}{}
+	}
 
-	return s
+	for i := range old {
+		o, n := old[i].Ident(), new[i].Ident()
+		_, reused := newIdents[o]
+		_, taken := oldIdents[n]
+		if o != n && o != "" && !reused && !taken {
+			renames[o] = n
+		}
+	}
+
+	return renames
+}
+
+//
+// Get subscriptions to site lists
+//
+func (env *Env) GetSubscriptions() (subs []Subscription) {
+	env.stateLock.RLock()
+	subs = env.state.Subscribe
+	if subs == nil {
+		subs = make([]Subscription, 0)
+	}
+	env.stateLock.RUnlock()
+	return
 }
 
 //
-// Set server parameters
+// Set subscriptions to site lists
 //
-func (env *Env) SetServerParams(s ServerParams) {
+func (env *Env) SetSubscriptions(subs []Subscription) {
 	env.stateLock.Lock()
-	env.state.Server = s
+	env.state.Subscribe = subs
 	env.state.Save(env.PathUserStateFile)
 	env.stateLock.Unlock()
 }
 
+//
+// Set server host key
+//
+// The key is updated for all servers with matching address.
+// Returns true if state was actually changed
+//
+func (env *Env) SetServerHostKey(addr, hostkey string) bool {
+	env.stateLock.Lock()
+	defer env.stateLock.Unlock()
+
+	servers, changed := envSetHostKey(env.state.Servers, addr, hostkey)
+	if changed {
+		env.state.Servers = servers
+		env.state.Save(env.PathUserStateFile)
+	}
+
+	return changed
+}
+
+//
+// Set host key of servers and jump hosts with the given address
+//
+// SSHTransport may work with previous version of servers list,
+// so instead of patching the list, the modified copy is returned
+//
+func envSetHostKey(list []ServerParams, addr, hostkey string) (
+	[]ServerParams, bool) {
+
+	if len(list) == 0 {
+		return list, false
+	}
+
+	servers := make([]ServerParams, len(list))
+	copy(servers, list)
+
+	changed := false
+	for i := range servers {
+		s := &servers[i]
+		if s.Addr == addr && s.HostKey != hostkey {
+			s.HostKey = hostkey
+			changed = true
+		}
+
+		if jump, ok := envSetHostKey(s.Jump, addr, hostkey); ok {
+			s.Jump = jump
+			changed = true
+		}
+	}
+
+	return servers, changed
+}
+
 //
 // Get sites
 //
@@ -294,13 +486,18 @@ func (env *Env) GetSites() (sites []SiteParams) {
 //
 // Set (add or update) a single site entry
 //
-// Please note, a site is searched by `host' parameter,
-// but if site.Host != host, the existent site will be
+// Please note, a site is searched by `key' parameter,
+// but if site.Key() != key, the existent site will be
 // renamed
 //
-func (env *Env) SetSite(host string, site SiteParams) {
-	host = strings.ToLower(host)
-	site.Host = strings.ToLower(site.Host)
+// Sites are searched case-insensitively. Host names and
+// wildcard patterns are converted to lower case, but regular
+// expressions are case-sensitive and stored as is
+//
+func (env *Env) SetSite(key SiteKey, site SiteParams) {
+	if site.Type != SiteTypeRegexp {
+		site.Host = strings.ToLower(site.Host)
+	}
 
 	// Acquire state lock
 	env.stateLock.Lock()
@@ -314,8 +511,8 @@ func (env *Env) SetSite(host string, site SiteParams) {
 
 	// Site already listed?
 	for i, s := range sites {
-		if host == s.Host {
-			if s != site {
+		if s.MatchKey(key) {
+			if !reflect.DeepEqual(s, site) {
 				sites[i] = site
 				goto SAVE
 			}
@@ -332,11 +529,212 @@ SAVE:
 }
 
 //
-// Del a site
+// Get "resolve hosts" mode. In this mode, host names that
+// don't match any site are resolved locally, and resolved
+// addresses are matched against CIDR blocks
+//
+func (env *Env) GetResolveHosts() bool {
+	env.stateLock.RLock()
+	resolve := env.state.ResolveHosts
+	env.stateLock.RUnlock()
+	return resolve
+}
+
+//
+// Set "resolve hosts" mode
+//
+func (env *Env) SetResolveHosts(resolve bool) {
+	env.stateLock.Lock()
+	env.state.ResolveHosts = resolve
+	env.state.Save(env.PathUserStateFile)
+	env.stateLock.Unlock()
+}
+
+//
+// Get "fallback" mode. In this mode, if direct access to the
+// site fails, request is retried via server
+//
+func (env *Env) GetFallback() bool {
+	env.stateLock.RLock()
+	fallback := env.state.Fallback
+	env.stateLock.RUnlock()
+	return fallback
+}
+
+//
+// Set "fallback" mode
+//
+func (env *Env) SetFallback(fallback bool) {
+	env.stateLock.Lock()
+	env.state.Fallback = fallback
+	env.state.Save(env.PathUserStateFile)
+	env.stateLock.Unlock()
+}
+
+//
+// Get hosts that needed fallback
+//
+func (env *Env) GetLearned() (learned []LearnedSite) {
+	env.stateLock.RLock()
+	learned = env.state.Learned
+	if learned == nil {
+		learned = make([]LearnedSite, 0)
+	}
+	env.stateLock.RUnlock()
+	return
+}
+
+//
+// Record fallback for the host. Returns updated LearnedSite
+//
+func (env *Env) LearnSite(host string) LearnedSite {
+	env.stateLock.Lock()
+	defer env.stateLock.Unlock()
+
+	// Create a copy of learned sites list. Router may work with
+	// previous version
+	learned := make([]LearnedSite, len(env.state.Learned))
+	copy(learned, env.state.Learned)
+
+	pos := -1
+	for i := range learned {
+		if learned[i].Host == host {
+			pos = i
+			break
+		}
+	}
+
+	if pos < 0 {
+		pos = len(learned)
+		learned = append(learned, LearnedSite{Host: host})
+	}
+
+	learned[pos].Count++
+	learned[pos].Last = time.Now()
+
+	env.state.Learned = learned
+	env.state.Save(env.PathUserStateFile)
+
+	return learned[pos]
+}
+
+//
+// Forget the learned host
+//
+func (env *Env) DelLearned(host string) {
+	env.stateLock.Lock()
+	defer env.stateLock.Unlock()
+
+	learned := make([]LearnedSite, 0, len(env.state.Learned))
+	for _, l := range env.state.Learned {
+		if l.Host != host {
+			learned = append(learned, l)
+		}
+	}
+
+	if len(learned) != len(env.state.Learned) {
+		env.state.Learned = learned
+		env.state.Save(env.PathUserStateFile)
+	}
+}
+
+//
+// Import sites
+//
+// If replace is true, existent sites are replaced with imported,
+// otherwise imported sites are merged with existent: sites already
+// listed are updated, new sites are appended to the list. Returns
+// count of imported sites
+//
+func (env *Env) ImportSites(imported []SiteParams, replace bool) int {
+	// Acquire state lock
+	env.stateLock.Lock()
+	defer env.stateLock.Unlock()
+
+	// Create a new sites list
+	sites := []SiteParams{}
+	if !replace {
+		sites = make([]SiteParams, len(env.state.Sites))
+		copy(sites, env.state.Sites)
+	}
+
+	// Index sites by key. Hosts are compared case-insensitively
+	keyOf := func(s *SiteParams) SiteKey {
+		key := s.Key()
+		key.Host = strings.ToLower(key.Host)
+		return key
+	}
+
+	index := make(map[SiteKey]int, len(sites)+len(imported))
+	for i := range sites {
+		key := keyOf(&sites[i])
+		if _, found := index[key]; !found {
+			index[key] = i
+		}
+	}
+
+	// Merge imported sites
+	seen := make(map[SiteKey]struct{}, len(imported))
+	for _, site := range imported {
+		if site.Type != SiteTypeRegexp {
+			site.Host = strings.ToLower(site.Host)
+		}
+
+		key := keyOf(&site)
+		if i, found := index[key]; found {
+			sites[i] = site
+		} else {
+			index[key] = len(sites)
+			sites = append(sites, site)
+		}
+
+		seen[key] = struct{}{}
+	}
+
+	// Update list and save
+	env.state.Sites = sites
+	env.state.Save(env.PathUserStateFile)
+
+	return len(seen)
+}
+
+//
+// Remove sites, expired at the given time
 //
-func (env *Env) DelSite(host string) {
-	host = strings.ToLower(host)
+// Returns list of removed sites and the nearest expiration
+// time of remaining sites, or zero time if none of them expires
+//
+func (env *Env) ExpireSites(now time.Time) (expired []SiteParams, next time.Time) {
+	env.stateLock.Lock()
+	defer env.stateLock.Unlock()
 
+	sites := make([]SiteParams, 0, len(env.state.Sites))
+	for _, site := range env.state.Sites {
+		switch {
+		case site.Expires == nil:
+			sites = append(sites, site)
+		case !now.Before(*site.Expires):
+			expired = append(expired, site)
+		default:
+			sites = append(sites, site)
+			if next.IsZero() || site.Expires.Before(next) {
+				next = *site.Expires
+			}
+		}
+	}
+
+	if len(expired) != 0 {
+		env.state.Sites = sites
+		env.state.Save(env.PathUserStateFile)
+	}
+
+	return
+}
+
+//
+// Del a site
+//
+func (env *Env) DelSite(key SiteKey) {
 	// Acquire state lock
 	env.stateLock.Lock()
 	defer env.stateLock.Unlock()
@@ -348,7 +746,7 @@ func (env *Env) DelSite(host string) {
 	// Find the site
 	pos := -1
 	for i, s := range sites {
-		if host == s.Host {
+		if s.MatchKey(key) {
 			pos = i
 			break
 		}
@@ -0,0 +1,75 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Environment test
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+//
+// Test that renaming the server updates sites that refer it,
+// and removing the server, still in use, is rejected
+//
+func TestEnvServerRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "froxy")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	env := &Env{state: &State{}, PathUserStateFile: dir + "/state"}
+
+	env.SetServers([]ServerParams{
+		{Name: "home", Addr: "home.example.com"},
+		{Addr: "work.example.com"},
+	})
+	env.SetSite(SiteKey{Host: "a.com"}, SiteParams{Host: "a.com", Server: "home"})
+	env.SetSite(SiteKey{Host: "b.com"}, SiteParams{Host: "b.com",
+		Server: "work.example.com"})
+	env.SetSubscriptions([]Subscription{{URL: "http://x/list", Server: "home"}})
+
+	// Rename both servers; one by name, another by address
+	servers := []ServerParams{
+		{Name: "house", Addr: "home.example.com"},
+		{Addr: "office.example.com"},
+	}
+
+	if err = env.CheckServersInUse(servers); err != nil {
+		t.Fatalf("rename rejected: %s", err)
+	}
+
+	if !env.SetServers(servers) {
+		t.Fatalf("rename: references not updated")
+	}
+
+	sites := env.GetSites()
+	if sites[0].Server != "house" || sites[1].Server != "office.example.com" {
+		t.Fatalf("rename: sites %+v", sites)
+	}
+
+	if subs := env.GetSubscriptions(); subs[0].Server != "house" {
+		t.Fatalf("rename: subscriptions %+v", subs)
+	}
+
+	// Reordering is not a rename
+	reordered := []ServerParams{servers[1], servers[0]}
+	if err := env.CheckServersInUse(reordered); err != nil {
+		t.Fatalf("reorder rejected: %s", err)
+	}
+
+	if env.SetServers(reordered) {
+		t.Fatalf("reorder: references updated")
+	}
+
+	// Removal of the server, used by site, must be rejected
+	if err := env.CheckServersInUse(reordered[:1]); err == nil {
+		t.Fatalf("removal: error expected")
+	}
+}
@@ -21,4 +21,16 @@ var (
 	ErrNoSuchKey           = errors.New("Now such key")
 	ErrSiteBlocked         = errors.New("Site blocked")
 	ErrNetDisconnected     = errors.New("Disconnected from the network")
+	ErrSSHAgentNotRunning  = errors.New("SSH agent not running (SSH_AUTH_SOCK not set)")
+	ErrSSHAgentNoKeys      = errors.New("SSH agent has no identities")
+	ErrChallengeCanceled   = errors.New("Authentication canceled by user")
+	ErrChallengeTimeout    = errors.New("Timeout waiting for authentication response")
+	ErrNoSuchChallenge     = errors.New("No such authentication challenge")
+	ErrTOTPSeed            = errors.New("Invalid TOTP seed")
+	ErrSubURLMissed        = errors.New("invalid query: subscription URL missed")
+	ErrTunnelURLMissed     = errors.New("WebSocket URL missed")
+	ErrTunnelAndCommand    = errors.New("Proxy command and tunnel cannot be used together")
+	ErrProxyAndCommand     = errors.New("Proxy command and upstream proxy cannot be used together")
+	ErrSSHKeepAlive        = errors.New("Server doesn't respond to keepalive requests")
+	ErrSSHAuthRejected     = errors.New("Authentication rejected")
 )
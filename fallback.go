@@ -0,0 +1,306 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Fallback from direct access to the server
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//
+// Transport that tries direct access first, and if it fails,
+// retries via server
+//
+// Regular HTTP requests are retried, if direct round-trip fails
+// and request body can be replayed. For CONNECT requests, the
+// following failures cause retry:
+//   - direct dial fails (connection refused, timeout etc)
+//   - directly connected site closes or resets connection
+//     right after client has sent some data (i.e., TLS ClientHello),
+//     without sending any response
+//   - directly connected site doesn't respond within the
+//     FALLBACK_TIMEOUT
+//
+// Requests, canceled by client, and HTTP-level failures don't
+// cause retry (see fallbackBlocked)
+//
+// Each fallback is recorded (see Env.LearnSite). Hosts that repeatedly
+// need fallback are learned and routed via server by the Router
+//
+type FallbackTransport struct {
+	froxy  *Froxy    // Back link to Froxy
+	host   string    // Host name, for learning
+	direct Transport // Direct transport
+	server Transport // Server transport
+}
+
+//
+// Create new FallbackTransport
+//
+func NewFallbackTransport(froxy *Froxy, host string) *FallbackTransport {
+	return &FallbackTransport{
+		froxy:  froxy,
+		host:   host,
+		direct: froxy.directTransport,
+		server: froxy.ServerTransport(""),
+	}
+}
+
+//
+// Perform HTTP round-trip
+//
+func (t *FallbackTransport) RoundTrip(rq *http.Request) (*http.Response, error) {
+	resp, err := t.direct.RoundTrip(rq)
+	if err == nil || (rq.Body != nil && rq.Body != http.NoBody) ||
+		!fallbackBlocked(rq.Context(), err) {
+		return resp, err
+	}
+
+	t.fallback(err)
+	return t.server.RoundTrip(rq)
+}
+
+//
+// Dial new TCP connection
+//
+func (t *FallbackTransport) Dial(network, addr string) (net.Conn, error) {
+	conn, err := t.direct.Dial(network, addr)
+	if err != nil {
+		if !fallbackBlocked(context.Background(), err) {
+			return nil, err
+		}
+		t.fallback(err)
+		return t.server.Dial(network, addr)
+	}
+
+	return &fallbackConn{
+		transport: t,
+		network:   network,
+		addr:      addr,
+		conn:      conn,
+	}, nil
+}
+
+//
+// Record the fallback
+//
+func (t *FallbackTransport) fallback(err error) {
+	learned := t.froxy.LearnSite(t.host)
+	t.froxy.IncCounter(&t.froxy.Counters.HTTPRqFallback)
+	t.froxy.Debug("fallback: %s: %s, retrying via server (%d times)",
+		t.host, err, learned.Count)
+
+	if learned.Count == FALLBACK_LEARN_COUNT {
+		t.froxy.Info("fallback: %s learned", t.host)
+	}
+
+	t.froxy.Raise(EventLearnedChanged)
+}
+
+//
+// Check if error means that direct access to the site is
+// blocked: dial failure, connection closed or reset by the
+// site, or timeout
+//
+// If client's request context is done, the request was canceled
+// or timed out by client, and nothing says about blocking. HTTP-level
+// failures don't cause fallback as well
+//
+func fallbackBlocked(ctx context.Context, err error) bool {
+	var netErr net.Error
+	var opErr *net.OpError
+
+	switch {
+	case err == nil, ctx.Err() != nil:
+		return false
+
+	case errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.As(err, &opErr),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return true
+	}
+
+	return false
+}
+
+// ----- Fallback connection -----
+//
+// Connection that may fallback to server
+//
+// Until the first response data is received, the data, sent
+// by client, is recorded, and if direct connection fails, it
+// is replayed to the new connection, established via server
+//
+type fallbackConn struct {
+	transport   *FallbackTransport // Back link to transport
+	network     string             // Network, for redial
+	addr        string             // Address, for redial
+	lock        sync.Mutex         // Access lock
+	conn        net.Conn           // Underlying connection
+	replay      []byte             // Data to be replayed
+	established bool               // No more fallback possible
+	closed      bool               // Connection is closed
+}
+
+//
+// Get underlying connection
+//
+func (c *fallbackConn) current() (net.Conn, bool) {
+	c.lock.Lock()
+	conn, established := c.conn, c.established
+	c.lock.Unlock()
+	return conn, established
+}
+
+//
+// Read from connection
+//
+func (c *fallbackConn) Read(buf []byte) (int, error) {
+	conn, established := c.current()
+	n, err := conn.Read(buf)
+	if established {
+		return n, err
+	}
+
+	c.lock.Lock()
+
+	switch {
+	case c.established || c.closed:
+		c.lock.Unlock()
+		return n, err
+
+	case n > 0 || len(c.replay) == 0 ||
+		!fallbackBlocked(context.Background(), err):
+		c.established = true
+		c.replay = nil
+		conn.SetReadDeadline(time.Time{})
+		c.lock.Unlock()
+		return n, err
+	}
+
+	// Fallback to server. Lock is held while connecting, so
+	// writes will wait. Fallback is recorded after the lock
+	// is released
+	c.established = true
+	replay := c.replay
+	c.replay = nil
+
+	conn2, err2 := c.transport.server.Dial(c.network, c.addr)
+	if err2 == nil {
+		_, err2 = conn2.Write(replay)
+		if err2 != nil {
+			conn2.Close()
+		}
+	}
+
+	if err2 != nil {
+		c.lock.Unlock()
+		c.transport.fallback(err)
+		return n, err
+	}
+
+	conn.Close()
+	c.conn = conn2
+	c.lock.Unlock()
+
+	c.transport.fallback(err)
+	return conn2.Read(buf)
+}
+
+//
+// Write to connection
+//
+func (c *fallbackConn) Write(data []byte) (int, error) {
+	c.lock.Lock()
+
+	if c.established {
+		conn := c.conn
+		c.lock.Unlock()
+		return conn.Write(data)
+	}
+
+	defer c.lock.Unlock()
+
+	if len(c.replay)+len(data) > FALLBACK_MAX_REPLAY {
+		// Too much to replay, give up fallback
+		c.established = true
+		c.replay = nil
+		c.conn.SetReadDeadline(time.Time{})
+		return c.conn.Write(data)
+	}
+
+	if len(c.replay) == 0 {
+		c.conn.SetReadDeadline(time.Now().Add(FALLBACK_TIMEOUT))
+	}
+
+	c.replay = append(c.replay, data...)
+
+	// If write fails, Read will fail too, and fallback will
+	// happen. So error is not returned here
+	c.conn.Write(data)
+
+	return len(data), nil
+}
+
+//
+// Close the connection
+//
+func (c *fallbackConn) Close() error {
+	c.lock.Lock()
+	c.closed = true
+	conn := c.conn
+	c.lock.Unlock()
+
+	return conn.Close()
+}
+
+//
+// Get local address
+//
+func (c *fallbackConn) LocalAddr() net.Addr {
+	conn, _ := c.current()
+	return conn.LocalAddr()
+}
+
+//
+// Get remote address
+//
+func (c *fallbackConn) RemoteAddr() net.Addr {
+	conn, _ := c.current()
+	return conn.RemoteAddr()
+}
+
+//
+// Set read and write deadlines
+//
+func (c *fallbackConn) SetDeadline(t time.Time) error {
+	conn, _ := c.current()
+	return conn.SetDeadline(t)
+}
+
+//
+// Set read deadline
+//
+func (c *fallbackConn) SetReadDeadline(t time.Time) error {
+	conn, _ := c.current()
+	return conn.SetReadDeadline(t)
+}
+
+//
+// Set write deadline
+//
+func (c *fallbackConn) SetWriteDeadline(t time.Time) error {
+	conn, _ := c.current()
+	return conn.SetWriteDeadline(t)
+}
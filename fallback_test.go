@@ -0,0 +1,100 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Fallback from direct access to the server test
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//
+// Test which errors cause fallback
+//
+func TestFallbackBlocked(t *testing.T) {
+	reset := &net.OpError{Op: "read", Net: "tcp",
+		Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	refused := &net.OpError{Op: "dial", Net: "tcp",
+		Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	canceled := &net.OpError{Op: "dial", Net: "tcp", Err: context.Canceled}
+
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		ctx     context.Context
+		err     error
+		blocked bool
+	}{
+		{context.Background(), nil, false},
+		{context.Background(), refused, true},
+		{context.Background(), reset, true},
+		{context.Background(), io.EOF, true},
+		{context.Background(), &url.Error{Op: "Get", URL: "http://x/",
+			Err: io.ErrUnexpectedEOF}, true},
+		{context.Background(), &net.DNSError{IsTimeout: true}, true},
+		{context.Background(), errors.New("malformed HTTP response"), false},
+
+		// Request, canceled by client
+		{done, refused, false},
+		{done, canceled, false},
+		{done, fmt.Errorf("wrapped: %w", context.Canceled), false},
+	}
+
+	for _, test := range tests {
+		blocked := fallbackBlocked(test.ctx, test.err)
+		if blocked != test.blocked {
+			t.Errorf("%v (client ctx: %v): %v expected",
+				test.err, test.ctx.Err(), test.blocked)
+		}
+	}
+}
+
+//
+// Test that real network timeouts cause fallback
+//
+func TestFallbackTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer l.Close()
+
+	// Dial timeout
+	dialer := net.Dialer{Timeout: time.Nanosecond}
+	conn, err := dialer.Dial("tcp", l.Addr().String())
+	if err == nil {
+		conn.Close()
+		t.Skip("dial completed within timeout")
+	}
+
+	if !fallbackBlocked(context.Background(), err) {
+		t.Errorf("dial timeout: %s: fallback expected", err)
+	}
+
+	// Read timeout
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+
+	if !fallbackBlocked(context.Background(), err) {
+		t.Errorf("read timeout: %s: fallback expected", err)
+	}
+}
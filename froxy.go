@@ -17,6 +17,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -37,12 +38,20 @@ type Froxy struct {
 	connStateLock sync.Mutex // Access lock
 	connState     ConnState  // Current state
 	connStateInfo string     // Info string
+	connStateErr  error      // Error that caused the state, if any
+
+	// Host key mismatches of per-server transports, by server
+	hostKeyMismatches map[string]error
 
 	// Statistic counters
 	Counters Counters // Collection of statistic counters
 
 	// Froxy parts
 	router      *Router                  // Request router
+	pac         *PAC                     // PAC file generator
+	siteStats   *SiteStats               // Per-site statistics
+	subs        *Subscriptions           // Subscriptions to site lists
+	challenges  *Challenges              // Keyboard-interactive challenges
 	webapi      *WebAPI                  // JS API handler
 	sysNotifier *sysdep.SysEventNotifier // System events notifier
 	connMan     *ConnMan                 // TCP connections manager
@@ -52,9 +61,11 @@ type Froxy struct {
 	httpSrv     *http.Server             // Local HTTP server instance
 
 	// Transports
-	sshTransport    *SSHTransport    // SSH transport
-	directTransport *DirectTransport // Direct transport
-	ftpProxy        *FTPProxy        // FTP-over-http proxy
+	sshTransport      *SSHTransport            // SSH transport, all servers
+	sshTransports     map[string]*SSHTransport // Per-server SSH transports
+	sshTransportsLock sync.RWMutex             // Access lock for sshTransports
+	directTransport   *DirectTransport         // Direct transport
+	ftpProxy          *FTPProxy                // FTP-over-http proxy
 }
 
 // ----- Connection state -----
@@ -67,6 +78,7 @@ const (
 	ConnNotConfigured = ConnState(iota)
 	ConnTrying
 	ConnEstablished
+	ConnHostKeyMismatch
 )
 
 //
@@ -80,6 +92,8 @@ func (s ConnState) Strings() (string, string) {
 		return "trying", "trying..."
 	case ConnEstablished:
 		return "established", "connected to the server"
+	case ConnHostKeyMismatch:
+		return "hostkey", "server host key mismatch"
 	}
 
 	panic("internal error")
@@ -88,25 +102,89 @@ func (s ConnState) Strings() (string, string) {
 //
 // Get connection state
 //
-func (froxy *Froxy) GetConnState() (state ConnState, info string) {
+// The returned error, if not nil, is the error that caused
+// the state (i.e., *HostKeyMismatchError)
+//
+// Host key mismatch, seen by per-server transport, is reported
+// as the connection state, until resolved
+//
+func (froxy *Froxy) GetConnState() (state ConnState, info string, err error) {
 	froxy.connStateLock.Lock()
 	state = froxy.connState
 	info = froxy.connStateInfo
+	err = froxy.connStateErr
+
+	if state != ConnHostKeyMismatch && len(froxy.hostKeyMismatches) != 0 {
+		servers := []string{}
+		for server := range froxy.hostKeyMismatches {
+			servers = append(servers, server)
+		}
+		sort.Strings(servers)
+
+		state = ConnHostKeyMismatch
+		err = froxy.hostKeyMismatches[servers[0]]
+		info = err.Error()
+	}
+
 	froxy.connStateLock.Unlock()
 
 	return
 }
 
+//
+// Get connection state of the transport that uses all servers
+//
+func (froxy *Froxy) mainConnState() ConnState {
+	froxy.connStateLock.Lock()
+	state := froxy.connState
+	froxy.connStateLock.Unlock()
+
+	return state
+}
+
 //
 // Set connection state
 //
-func (froxy *Froxy) SetConnState(state ConnState, info string) {
+// If err is not nil, its text is used as the state info string
+//
+func (froxy *Froxy) SetConnState(state ConnState, err error) {
+	info := ""
+	if err != nil {
+		info = err.Error()
+	}
+
 	froxy.connStateLock.Lock()
 
 	if froxy.connState != state || froxy.connStateInfo != info {
 		froxy.connState = state
 		froxy.connStateInfo = info
+		froxy.connStateErr = err
+
+		froxy.Raise(EventConnStateChanged)
+	}
+
+	froxy.connStateLock.Unlock()
+}
+
+//
+// Set or clear (if err is nil) host key mismatch, seen by the
+// per-server transport
+//
+func (froxy *Froxy) SetServerHostKeyMismatch(server string, err error) {
+	froxy.connStateLock.Lock()
+
+	old := froxy.hostKeyMismatches[server]
+	switch {
+	case err != nil:
+		if froxy.hostKeyMismatches == nil {
+			froxy.hostKeyMismatches = make(map[string]error)
+		}
+		froxy.hostKeyMismatches[server] = err
+	case old != nil:
+		delete(froxy.hostKeyMismatches, server)
+	}
 
+	if old != err {
 		froxy.Raise(EventConnStateChanged)
 	}
 
@@ -115,11 +193,101 @@ func (froxy *Froxy) SetConnState(state ConnState, info string) {
 
 // ----- Connection management -----
 //
-// Set server parameters
+// Set servers parameters
 //
-func (froxy *Froxy) SetServerParams(s ServerParams) {
-	froxy.Env.SetServerParams(s)
-	froxy.sshTransport.Reconnect(s)
+func (froxy *Froxy) SetServers(servers []ServerParams) {
+	if froxy.Env.SetServers(servers) {
+		froxy.Raise(EventSitesChanged)
+		froxy.Raise(EventSubscriptionsChanged)
+	}
+	froxy.sshTransport.Reconnect(servers)
+	froxy.updateServerTransports(servers)
+}
+
+//
+// Update per-server SSH transports
+//
+func (froxy *Froxy) updateServerTransports(servers []ServerParams) {
+	froxy.sshTransportsLock.Lock()
+	defer froxy.sshTransportsLock.Unlock()
+
+	transports := make(map[string]*SSHTransport)
+	for _, s := range servers {
+		ident := s.Ident()
+		if _, dup := transports[ident]; dup || ident == "" {
+			continue
+		}
+
+		t := froxy.sshTransports[ident]
+		if t == nil {
+			t = NewSSHTransport(froxy, ident)
+		}
+
+		t.Reconnect([]ServerParams{s})
+		transports[ident] = t
+	}
+
+	// Disconnect transports of removed servers
+	for ident, t := range froxy.sshTransports {
+		if transports[ident] == nil {
+			t.Reconnect(nil)
+		}
+	}
+
+	froxy.sshTransports = transports
+}
+
+//
+// Get SSH transport for the server, identified by ServerParams.Ident()
+// If server is "", the transport that uses all servers is returned
+//
+// Returns nil, if server is not configured
+//
+func (froxy *Froxy) ServerTransport(server string) Transport {
+	if server == "" {
+		return froxy.sshTransport
+	}
+
+	froxy.sshTransportsLock.RLock()
+	t := froxy.sshTransports[server]
+	froxy.sshTransportsLock.RUnlock()
+
+	if t == nil {
+		return nil
+	}
+
+	return t
+}
+
+//
+// Get per-transport SSH counters. The first entry is for
+// the transport that uses all servers, then per-server
+// entries follow, in order of servers
+//
+func (froxy *Froxy) GetServerCounters() []SSHTransportCounters {
+	servers := froxy.GetServers()
+	counters := []SSHTransportCounters{froxy.sshTransport.GetCounters()}
+
+	froxy.sshTransportsLock.RLock()
+	for _, s := range servers {
+		if t := froxy.sshTransports[s.Ident()]; t != nil {
+			counters = append(counters, t.GetCounters())
+		}
+	}
+	froxy.sshTransportsLock.RUnlock()
+
+	return counters
+}
+
+//
+// Save server host key, learned on first connect
+//
+// Unlike SetServers, this function doesn't cause reconnect
+//
+func (froxy *Froxy) SetServerHostKey(addr, hostkey string) {
+	if froxy.Env.SetServerHostKey(addr, hostkey) {
+		froxy.Raise(EventServerParamsChanged)
+	}
 }
 
 // ----- Statistics counters -----
@@ -251,6 +419,13 @@ func (froxy *Froxy) handleLocalRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Handle PAC file requests
+	if r.URL.Path == "/proxy.pac" || r.URL.Path == "/wpad.dat" {
+		froxy.Debug("%s %s %s", r.Method, r.URL, r.Proto)
+		froxy.pac.ServeHTTP(w, r)
+		return
+	}
+
 	// Handle requests to Froxy static pages
 	froxy.Debug("%s %s %s", r.Method, r.URL, r.Proto)
 	httpNoCache(w)
@@ -412,25 +587,41 @@ func (froxy *Froxy) httpHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check routing
-	rt := froxy.router.Route(host)
+	rt, transport, site := froxy.router.Route(r)
 
 	// Update counters
 	froxy.IncCounter(&froxy.Counters.HTTPRqReceived)
 	froxy.IncCounter(&froxy.Counters.HTTPRqPending)
 	defer froxy.DecCounter(&froxy.Counters.HTTPRqPending)
 
-	// Choose transport
-	var transport Transport
+	// Check transport
 	switch rt {
 	case RouterBypass:
 		froxy.IncCounter(&froxy.Counters.HTTPRqDirect)
-		transport = froxy.directTransport
+		if site != nil {
+			// Explicitly bypassed site, no fallback
+			cnt := froxy.siteStats.Counter(site)
+			froxy.siteStats.Request(cnt, r.Method == http.MethodConnect)
+			transport = froxy.siteStats.Transport(transport, cnt)
+		} else if froxy.GetFallback() && len(froxy.GetServers()) != 0 {
+			transport = NewFallbackTransport(froxy, host)
+		}
 	case RouterForward:
 		froxy.IncCounter(&froxy.Counters.HTTPRqForwarded)
-		transport = froxy.sshTransport
+		cnt := froxy.siteStats.Counter(site)
+		froxy.siteStats.Request(cnt, r.Method == http.MethodConnect)
+		if transport == nil {
+			froxy.siteStats.Error(cnt)
+			froxy.httpError(w, http.StatusServiceUnavailable,
+				ErrServerNotConfigured)
+			return
+		}
+		transport = froxy.siteStats.Transport(transport, cnt)
 	case RouterBlock:
 		froxy.IncCounter(&froxy.Counters.HTTPRqBlocked)
-		froxy.httpError(w, http.StatusForbidden, ErrSiteBlocked)
+		froxy.siteStats.Request(froxy.siteStats.Counter(site),
+			r.Method == http.MethodConnect)
+		froxy.handleBlocked(w, r, site.Mode)
 		return
 	default:
 		panic("internal error")
@@ -500,7 +691,10 @@ func NewFroxy(env *Env, port int) (*Froxy, error) {
 	}
 
 	froxy.webapi = NewWebAPI(froxy)
+	froxy.subs = NewSubscriptions(froxy)
+	froxy.challenges = NewChallenges(froxy)
 	froxy.router = NewRouter(froxy)
+	froxy.siteStats = NewSiteStats(froxy)
 	froxy.sysNotifier = sysdep.NewSysEventNotifier(froxy.sysEventCallback)
 
 	// Populate table of local host names
@@ -514,12 +708,14 @@ func NewFroxy(env *Env, port int) (*Froxy, error) {
 	}
 
 	froxy.localport = fmt.Sprintf("%d", port)
+	froxy.pac = NewPAC(froxy)
 
 	// Create connections manager
 	froxy.connMan = NewConnMan(froxy)
 
 	// Create transports
-	froxy.sshTransport = NewSSHTransport(froxy)
+	froxy.sshTransport = NewSSHTransport(froxy, "")
+	froxy.updateServerTransports(froxy.GetServers())
 	froxy.directTransport = NewDirectTransport(froxy)
 	froxy.ftpProxy = NewFTPProxy(froxy)
 
@@ -552,6 +748,9 @@ func NewFroxy(env *Env, port int) (*Froxy, error) {
 //
 func (froxy *Froxy) Run() {
 	go froxy.eventGoroutine()
+	go froxy.expireGoroutine()
+	go froxy.subs.goroutine()
+	froxy.sshTransport.ConnectEagerly()
 	froxy.Raise(EventStartup)
 
 	err := froxy.httpSrv.Serve(froxy.listener)
@@ -0,0 +1,112 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// SSH server host keys verification
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+//
+// Host key mismatch error
+//
+type HostKeyMismatchError struct {
+	Addr string // Server address
+	Old  string // Known (expected) key fingerprint
+	New  string // Received key fingerprint
+}
+
+//
+// Format error message
+//
+func (err *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("Server %q host key mismatch: expected %s, received %s",
+		err.Addr, err.Old, err.New)
+}
+
+//
+// Compute host key fingerprint, as stored in ServerParams.HostKey
+//
+func HostKeyFingerprint(key ssh.PublicKey) string {
+	return ssh.FingerprintSHA256(key)
+}
+
+//
+// Lookup server host key in the OpenSSH known_hosts file
+//
+// data is the known_hosts file content, addr is the server
+// address in the host or host:port form. Returns fingerprint
+// of the first matching key
+//
+// Lines are parsed one by one, and lines that cannot be parsed
+// are skipped: ssh.ParseKnownHosts doesn't return the rest of
+// data after the error
+//
+func KnownHostsLookup(data []byte, addr string) (string, error) {
+	host := knownhosts.Normalize(NetDefaultPort(addr, "22"))
+
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		marker, hosts, key, _, _, err := ssh.ParseKnownHosts(line)
+
+		switch {
+		case err != nil:
+			// io.EOF here means blank or comment line; other
+			// errors mean malformed line or unsupported key
+			continue
+		case marker != "":
+			// @revoked and @cert-authority lines are not supported
+			continue
+		}
+
+		for _, pattern := range hosts {
+			if knownHostsMatch(pattern, host) {
+				return HostKeyFingerprint(key), nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("known_hosts: host %q not found", addr)
+}
+
+//
+// Match known_hosts host pattern against the normalized host name
+//
+func knownHostsMatch(pattern, host string) bool {
+	// Hashed host name: |1|base64(salt)|base64(hmac-sha1(salt,host))
+	if strings.HasPrefix(pattern, "|1|") {
+		parts := strings.Split(pattern[3:], "|")
+		if len(parts) != 2 {
+			return false
+		}
+
+		salt, err1 := base64.StdEncoding.DecodeString(parts[0])
+		hash, err2 := base64.StdEncoding.DecodeString(parts[1])
+		if err1 != nil || err2 != nil {
+			return false
+		}
+
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(host))
+		return bytes.Equal(mac.Sum(nil), hash)
+	}
+
+	// Negated patterns are not supported, just skip them
+	if strings.HasPrefix(pattern, "!") {
+		return false
+	}
+
+	// Plain host name, probably with wildcards
+	return wildcardMatch(strings.ToLower(pattern), host)
+}
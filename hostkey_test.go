@@ -0,0 +1,76 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// SSH server host keys verification test
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+//
+// Test lookup in the known_hosts file
+//
+func TestKnownHostsLookup(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	fp := HostKeyFingerprint(key)
+	text := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	line := func(hosts string) string {
+		return knownhosts.Line([]string{hosts}, key)
+	}
+
+	data := strings.Join([]string{
+		"# comment",
+		"",
+		"@cert-authority *.example.com " + text,
+		"malformed line here",
+		"bad.example.com ssh-ed25519 AAAAnotbase64",
+		line("plain.example.com"),
+		line(knownhosts.HashHostname("hashed.example.com")),
+		line("[port.example.com]:2222"),
+		"# trailing comment",
+	}, "\n")
+
+	tests := []struct {
+		addr string
+		ok   bool
+	}{
+		{"plain.example.com", true},
+		{"plain.example.com:22", true},
+		{"hashed.example.com", true},
+		{"port.example.com:2222", true},
+		{"port.example.com", false},
+		{"cert.example.com", false},
+		{"bad.example.com", false},
+	}
+
+	for _, test := range tests {
+		hostkey, err := KnownHostsLookup([]byte(data), test.addr)
+		switch {
+		case test.ok && err != nil:
+			t.Errorf("%s: %s", test.addr, err)
+		case test.ok && hostkey != fp:
+			t.Errorf("%s: %s expected, %s received", test.addr, fp, hostkey)
+		case !test.ok && err == nil:
+			t.Errorf("%s: error expected", test.addr)
+		}
+	}
+}
@@ -29,6 +29,7 @@ var _ = json.Unmarshaler(&IDNServerParams{})
 func (p *IDNServerParams) MarshalJSON() ([]byte, error) {
 	out := ServerParams(*p)
 	out.Addr = IDNDecode(out.Addr)
+	out.Jump = idnRecodeJump(out.Jump, IDNDecode)
 	return json.Marshal(out)
 }
 
@@ -43,11 +44,81 @@ func (p *IDNServerParams) UnmarshalJSON(data []byte) error {
 	}
 
 	in.Addr = IDNEncode(in.Addr)
+	in.Jump = idnRecodeJump(in.Jump, IDNEncode)
 	*p = IDNServerParams(in)
 
 	return nil
 }
 
+//
+// Recode host names of jump hosts. Returns the modified copy
+//
+func idnRecodeJump(jump []ServerParams,
+	recode func(string) string) []ServerParams {
+
+	if len(jump) == 0 {
+		return jump
+	}
+
+	out := make([]ServerParams, len(jump))
+	for i, hop := range jump {
+		hop.Addr = recode(hop.Addr)
+		hop.Jump = idnRecodeJump(hop.Jump, recode)
+		out[i] = hop
+	}
+
+	return out
+}
+
+//
+// IDN version of []ServerParams
+//
+type IDNServerParamsList []ServerParams
+
+var _ = json.Marshaler(IDNServerParamsList(nil))
+var _ = json.Unmarshaler(&IDNServerParamsList{})
+
+//
+// Marshal IDNServerParamsList to JSON. Recodes host names to IDN on a fly
+//
+func (list IDNServerParamsList) MarshalJSON() ([]byte, error) {
+	buf := bytes.Buffer{}
+
+	buf.WriteByte('[')
+	for i := range list {
+		data, err := (*IDNServerParams)(&list[i]).MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(data)
+	}
+	buf.WriteByte(']')
+
+	return buf.Bytes(), nil
+}
+
+//
+// Unmarshal IDNServerParamsList from JSON. Recodes host names to IDN on a fly
+//
+func (list *IDNServerParamsList) UnmarshalJSON(data []byte) error {
+	var in []IDNServerParams
+	err := json.Unmarshal(data, &in)
+	if err != nil {
+		return err
+	}
+
+	*list = make(IDNServerParamsList, len(in))
+	for i := range in {
+		(*list)[i] = ServerParams(in[i])
+	}
+
+	return nil
+}
+
 //
 // IDN version of SiteParams
 //
@@ -61,7 +132,7 @@ var _ = json.Unmarshaler(&IDNSiteParams{})
 //
 func (p *IDNSiteParams) MarshalJSON() ([]byte, error) {
 	out := SiteParams(*p)
-	out.Host = IDNDecode(out.Host)
+	out.Host = IDNDecodePattern(out.Host, out.Type)
 	return json.Marshal(out)
 }
 
@@ -75,7 +146,7 @@ func (p *IDNSiteParams) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
-	in.Host = IDNEncode(in.Host)
+	in.Host = IDNEncodePattern(in.Host, in.Type)
 
 	*p = IDNSiteParams(in)
 	return nil
@@ -134,3 +205,48 @@ func IDNEncode(in string) string {
 		return in
 	}
 }
+
+//
+// Decode site pattern from IDN to UNICODE
+//
+// Regular expressions and CIDR blocks are returned as is. Wildcard
+// patterns are decoded label by label, and labels with wildcards are
+// left intact
+//
+func IDNDecodePattern(in string, typ SiteType) string {
+	return idnRecodePattern(in, typ, IDNDecode)
+}
+
+//
+// Encode site pattern from UNICODE to IDN
+//
+// Regular expressions and CIDR blocks are returned as is. Wildcard
+// patterns are encoded label by label, and labels with wildcards are
+// only converted to lower case
+//
+func IDNEncodePattern(in string, typ SiteType) string {
+	return idnRecodePattern(in, typ, IDNEncode)
+}
+
+//
+// Common part of IDNDecodePattern and IDNEncodePattern
+//
+func idnRecodePattern(in string, typ SiteType, recode func(string) string) string {
+	switch typ {
+	case SiteTypeRegexp, SiteTypeCIDR:
+		return in
+
+	case SiteTypeGlob:
+		labels := strings.Split(in, ".")
+		for i, label := range labels {
+			if strings.IndexAny(label, "*?") < 0 {
+				labels[i] = recode(label)
+			} else {
+				labels[i] = strings.ToLower(label)
+			}
+		}
+		return strings.Join(labels, ".")
+	}
+
+	return recode(in)
+}
@@ -246,23 +246,38 @@ froxy._.pleasewait = function (enable) {
 
 // ----- Public API -----
 //
-// Get server parameters - returns HTTP request
+// Get servers parameters - returns HTTP request
 //
-froxy.GetServerParams = function() {
+froxy.GetServers = function() {
     return froxy._.http_request("GET", "/api/server");
 };
 
 //
-// Set server parameters - returns HTTP request
+// Set servers parameters - returns HTTP request
 //
-froxy.SetServerParams = function(addr, login, password, keyid) {
+// Servers is the array of objects, in order of preference:
+//     {
+//         name:     "server name",
+//         addr:     "host:port",
+//         login:    "login",
+//         password: "password",
+//         keyid:    "key id",
+//         hostkey:  "host key fingerprint"
+//     }
+//
+froxy.SetServers = function(servers) {
+    return froxy._.http_request("PUT", "/api/server", servers);
+};
+
+//
+// Import server host key from the known_hosts file content - returns
+// HTTP request
+//
+froxy.ImportKnownHosts = function(known_hosts) {
     var d = {
-        addr: addr,
-        login: login,
-        password: password,
-        keyid: keyid
+        known_hosts: known_hosts
     };
-    return froxy._.http_request("PUT", "/api/server", d);
+    return froxy._.http_request("POST", "/api/knownhosts", d);
 };
 
 //
@@ -273,25 +288,189 @@ froxy.GetSites  = function() {
 };
 
 //
-// Set a site parameters - returns HTTP request
+// Make /api/sites query for the site key
+//
+// Site key identifies the site, and is the following object:
+//     {
+//         host:   "host name or pattern",
+//         port:   "port constraint",
+//         scheme: "scheme constraint"
+//     }
 //
-froxy.SetSite  = function(host, params) {
-    var q = "/api/sites";
-    if (host) {
-        q += "?" + encodeURIComponent(host);
+// Site parameters object may be used as site key
+//
+froxy._.site_query = function(key) {
+    var q = "/api/sites?host=" + encodeURIComponent(key.host);
+    if (key.port) {
+        q += "&port=" + encodeURIComponent(key.port);
+    }
+    if (key.scheme) {
+        q += "&scheme=" + encodeURIComponent(key.scheme);
     }
+    return q;
+};
 
+//
+// Set a site parameters - returns HTTP request
+//
+// Key identifies the existent site (see froxy._.site_query).
+// If key is null, new site is added
+//
+froxy.SetSite  = function(key, params) {
+    var q = froxy._.site_query(key || params);
     return froxy._.http_request("PUT", q, params);
 };
 
 //
 // Delete a site - returns HTTP request
 //
-froxy.DelSite  = function(host) {
-    var q = "/api/sites?" + encodeURIComponent(host);
+froxy.DelSite  = function(key) {
+    return froxy._.http_request("DEL", froxy._.site_query(key));
+};
+
+//
+// Get routing options - returns HTTP request
+//
+froxy.GetRouting = function () {
+    return froxy._.http_request("GET", "/api/routing");
+};
+
+//
+// Set routing options - returns HTTP request
+//
+// Routing options is the following object:
+//     {
+//         resolve_hosts: true - resolve host names and match
+//                               addresses against CIDR blocks
+//         fallback: true      - if direct access fails, retry
+//                               via server
+//     }
+//
+froxy.SetRouting = function (routing) {
+    return froxy._.http_request("PUT", "/api/routing", routing);
+};
+
+//
+// Get hosts that needed fallback to server - returns HTTP request
+//
+froxy.GetLearned = function () {
+    return froxy._.http_request("GET", "/api/learned");
+};
+
+//
+// Promote learned host to the permanent site - returns HTTP request
+//
+froxy.PromoteLearned = function (host) {
+    var q = "/api/learned?" + encodeURIComponent(host);
+    return froxy._.http_request("POST", q);
+};
+
+//
+// Forget learned host - returns HTTP request
+//
+froxy.DelLearned = function (host) {
+    var q = "/api/learned?" + encodeURIComponent(host);
+    return froxy._.http_request("DEL", q);
+};
+
+//
+// Import list of sites - returns HTTP request
+//
+// format is one of "plain", "hosts", "adblock", "gfwlist", "json",
+// or "" to auto-detect. If replace is true, existent sites are
+// replaced, otherwise imported sites are merged with existent
+//
+froxy.ImportSites = function (format, replace, list) {
+    var d = {
+        format:  format,
+        replace: replace,
+        list:    list
+    };
+    return froxy._.http_request("POST", "/api/sitelist", d);
+};
+
+//
+// Export list of sites - returns HTTP request
+//
+froxy.ExportSites = function (format) {
+    var q = "/api/sitelist?format=" + encodeURIComponent(format);
+    return froxy._.http_request("GET", q);
+};
+
+//
+// Retry connection to the server now, without waiting for the
+// scheduled retry - returns HTTP request
+//
+froxy.RetryNow = function () {
+    return froxy._.http_request("POST", "/api/state");
+};
+
+//
+// Get identities, available in the SSH agent - returns HTTP request
+//
+froxy.GetAgentKeys = function () {
+    return froxy._.http_request("GET", "/api/agent");
+};
+
+//
+// Answer keyboard-interactive authentication challenge - returns
+// HTTP request
+//
+froxy.AnswerChallenge = function (id, answers) {
+    var q = "/api/challenges?" + encodeURIComponent(id);
+    return froxy._.http_request("POST", q, answers);
+};
+
+//
+// Cancel keyboard-interactive authentication challenge - returns
+// HTTP request
+//
+froxy.CancelChallenge = function (id) {
+    var q = "/api/challenges?" + encodeURIComponent(id);
     return froxy._.http_request("DEL", q);
 };
 
+//
+// Get subscriptions to site lists with their status - returns
+// HTTP request
+//
+froxy.GetSubscriptions = function () {
+    return froxy._.http_request("GET", "/api/subscriptions");
+};
+
+//
+// Set subscriptions to site lists - returns HTTP request
+//
+// Each subscription is { url: "...", format: "...", forward: bool,
+// server: "..." }
+//
+froxy.SetSubscriptions = function (subs) {
+    return froxy._.http_request("PUT", "/api/subscriptions", subs);
+};
+
+//
+// Update subscribed site list immediately - returns HTTP request
+//
+froxy.UpdateSubscription = function (url) {
+    var q = "/api/subscriptions?" + encodeURIComponent(url);
+    return froxy._.http_request("POST", q);
+};
+
+//
+// Explain routing decision for the host or URL - returns HTTP request
+//
+froxy.ExplainRoute = function (host) {
+    var q = "/api/route?host=" + encodeURIComponent(host);
+    return froxy._.http_request("GET", q);
+};
+
+//
+// Get kinds of site patterns matches, in order of precedence
+//
+froxy.GetPatterns = function () {
+    return froxy._.http_request("GET", "/api/patterns");
+};
+
 //
 // Get statistics counters
 //
@@ -514,6 +693,18 @@ froxy.UiSetStatus = function(color, text) {
     status.innerHTML = text;
 };
 
+//
+// Show or hide the "Retry now" button in the status line
+//
+// THIS IS INTERNAL FUNCTION, DON'T CALL IT DIRECTLY
+//
+froxy._.UiShowRetry = function(show) {
+    var retry = document.getElementById("status.retry");
+    if (retry) {
+        retry.hidden = !show;
+    }
+};
+
 // ----- Background activities -----
 //
 // Update status
@@ -529,17 +720,126 @@ froxy._.BgStartStatus = function () {
         case "established": color = "steelblue"; break;
         }
 
-        froxy.UiSetStatus(color, state.info);
+        var info = state.info;
+        if (state.retry) {
+            info += " (attempt " + state.attempts + " failed, next retry at " +
+                new Date(state.retry).toLocaleTimeString() + ")";
+        }
+
+        froxy.UiSetStatus(color, info);
+        froxy._.UiShowRetry(!!state.retry);
     };
 
     var OnError = function () {
         froxy.UiSetStatus("red", "Froxy not responding");
+        froxy._.UiShowRetry(false);
         froxy._.BgReloadWhenReady();
     };
 
     froxy.BgPoll("/api/state", OnSuccess, OnError);
 };
 
+//
+// Show keyboard-interactive authentication challenges
+//
+// When SSH server asks questions, the dialog appears at the
+// top of any Froxy page
+//
+// THIS IS INTERNAL FUNCTION, DON'T CALL IT DIRECTLY
+//
+froxy._.BgStartChallenges = function () {
+    var dialog = null;
+    var shown = null;
+
+    var OnSuccess = function (challenges) {
+        var ch = challenges[0];
+
+        if (ch && shown == ch.id) {
+            return;
+        }
+
+        if (dialog) {
+            dialog.parentNode.removeChild(dialog);
+            dialog = shown = null;
+        }
+
+        if (ch) {
+            dialog = froxy._.ChallengeDialog(ch);
+            shown = ch.id;
+            document.body.insertBefore(dialog, document.body.firstChild);
+        }
+    };
+
+    froxy.BgPoll("/api/challenges", OnSuccess);
+};
+
+//
+// Create dialog for keyboard-interactive authentication challenge
+//
+// THIS IS INTERNAL FUNCTION, DON'T CALL IT DIRECTLY
+//
+froxy._.ChallengeDialog = function (ch) {
+    var dialog = document.createElement("fieldset");
+    var legend = document.createElement("legend");
+    var inputs = [];
+    var elm, i;
+
+    legend.innerText = "Server " + ch.server + " asks for authentication";
+    dialog.appendChild(legend);
+
+    if (ch.name) {
+        elm = document.createElement("div");
+        elm.innerText = ch.name;
+        dialog.appendChild(elm);
+    }
+
+    if (ch.instruction) {
+        elm = document.createElement("div");
+        elm.style.whiteSpace = "pre";
+        elm.innerText = ch.instruction;
+        dialog.appendChild(elm);
+    }
+
+    var submit = function () {
+        var answers = inputs.map(function (input) { return input.value; });
+        froxy.AnswerChallenge(ch.id, answers);
+    };
+
+    for (i = 0; i < ch.questions.length; i ++) {
+        var input = document.createElement("input");
+        input.type = ch.echos[i] ? "text" : "password";
+        input.onkeydown = function (event) {
+            if (event.keyCode == 13 && !event.repeat) {
+                submit();
+            }
+        };
+        inputs.push(input);
+
+        elm = document.createElement("div");
+        elm.innerText = ch.questions[i] + " ";
+        elm.appendChild(input);
+        dialog.appendChild(elm);
+    }
+
+    elm = document.createElement("input");
+    elm.type = "button";
+    elm.value = "Ok";
+    elm.onclick = submit;
+    dialog.appendChild(elm);
+
+    elm = document.createElement("input");
+    elm.type = "button";
+    elm.value = "Cancel";
+    elm.onclick = function () { froxy.CancelChallenge(ch.id); };
+    dialog.appendChild(elm);
+
+    if (inputs.length) {
+        setTimeout(function () { inputs[0].focus(); }, 0);
+    }
+
+    return dialog;
+};
+
 //
 // Monitor Froxy state and reload current page when it becomes ready
 //
@@ -613,7 +913,7 @@ froxy.BgWatch = function (id, url, callback) {
 
     // Fire the request to server
     watch.fire = function () {
-        var q = url + "?" + froxy.UiGetInput(id);
+        var q = url + "?" + encodeURIComponent(froxy.UiGetInput(id));
         watch.rq = froxy._.http_request("GET", q);
 
         watch.rq.OnSuccess = function (data) {
@@ -760,6 +1060,7 @@ froxy._.init = function() {
         froxy._.init_done = true;
         froxy._.BgPollInit();
         froxy._.BgStartStatus();
+        froxy._.BgStartChallenges();
     }
 };
 
@@ -8,8 +8,32 @@
 //
 // Saved parameters
 //
-var saved_server_params = {};
+var saved_servers = [];
 var saved_keys = [];
+var saved_agent_keys = [];
+var saved_state = {};
+
+//
+// Index of server being edited, -1 for new server
+//
+var editing = -1;
+
+//
+// Array of servers table rows, grows or shrinks dynamically
+//
+var table = [];
+
+//
+// Array of jump hosts table rows of server being edited
+//
+var jump_table = [];
+
+//
+// Get parameters of server being edited
+//
+function EditedServer () {
+    return saved_servers[editing] || {};
+}
 
 // ----- Authentication method selection -----
 //
@@ -18,15 +42,15 @@ var saved_keys = [];
 // Called when either keys or server parameters changed
 //
 function AuthMethodUpdate() {
-    var keyid = saved_server_params.keyid || "";
+    var keyid = EditedServer().keyid || "";
     var keyid_ok = false;
     var auth = document.getElementById("auth");
     var method = auth.value;
-    var method_ok = method == "auth.password";
+    var method_ok = method == "auth.password" || method == "auth.agent";
     var i, elm, s, key;
 
     // Purge selection options.
-    while (auth.children.length > 2) {
+    while (auth.children.length > 3) {
         auth.removeChild(auth.children[auth.children.length-1]);
     }
 
@@ -61,7 +85,9 @@ function AuthMethodUpdate() {
         // Do nothing
     } else if (keyid_ok) {
         method = keyid;
-    } else if (!keyid && saved_server_params.password) {
+    } else if (!keyid && EditedServer().agent) {
+        method = "auth.agent";
+    } else if (!keyid && EditedServer().password) {
         method = "auth.password";
     } else {
         method = "auth.none";
@@ -69,8 +95,9 @@ function AuthMethodUpdate() {
 
     auth.value = method;
 
-    // Enable/disable password input
+    // Enable/disable password and agent identity inputs
     PasswordConditionallyEnable();
+    AgentKeyConditionallyEnable();
 }
 
 //
@@ -78,6 +105,71 @@ function AuthMethodUpdate() {
 //
 function AuthMethodOnChange () {
     PasswordConditionallyEnable();
+    AgentKeyConditionallyEnable();
+}
+
+// ----- SSH agent identity -----
+//
+// Update SSH agent identity selection control
+//
+// Called when either agent identities or server parameters changed.
+// The selected identity is preserved, even if agent doesn't have it
+//
+function AgentKeyUpdate (agentkey) {
+    var sel = document.getElementById("agentkey");
+    var i, elm, key;
+
+    // Rebuild selection options
+    while (sel.children.length > 1) {
+        sel.removeChild(sel.children[sel.children.length-1]);
+    }
+
+    for (i = 0; i < saved_agent_keys.length; i ++) {
+        key = saved_agent_keys[i];
+
+        elm = document.createElement("option");
+        elm.value = key.fingerprint;
+        elm.innerText = key.type + " " + key.fingerprint +
+            (key.comment ? " (" + key.comment + ")" : "");
+
+        sel.appendChild(elm);
+    }
+
+    sel.value = agentkey;
+    if (sel.value != agentkey) {
+        elm = document.createElement("option");
+        elm.value = agentkey;
+        elm.innerText = agentkey + " (not in agent)";
+        sel.appendChild(elm);
+        sel.value = agentkey;
+    }
+}
+
+//
+// Enable/Disable SSH agent identity selection
+//
+function AgentKeyConditionallyEnable () {
+    var sel = document.getElementById("agentkey");
+    sel.disabled = froxy.UiGetInput("auth") != "auth.agent";
+}
+
+//
+// Load identities from the SSH agent
+//
+function AgentKeysLoad () {
+    var rq = froxy.GetAgentKeys();
+
+    rq.OnSuccess = function (keys) {
+        saved_agent_keys = keys;
+        froxy.UiSetInput("agentkey.status", "");
+        AgentKeyUpdate(froxy.UiGetInput("agentkey"));
+    };
+
+    rq.OnError = function (err) {
+        saved_agent_keys = [];
+        froxy.UiSetInput("agentkey.status", err.reason);
+        AgentKeyUpdate(froxy.UiGetInput("agentkey"));
+    };
 }
 
 // ----- Password -----
@@ -91,39 +183,522 @@ function PasswordConditionallyEnable () {
     password.disabled = auth != "auth.password";
 }
 
+// ----- Tunnel -----
+//
+// Enable/Disable tunnel parameters, depending on tunnel type
+//
+function TunnelConditionallyEnable () {
+    var tunnel = froxy.UiGetInput("tunnel");
+
+    document.getElementById("sni").disabled = tunnel == "";
+    document.getElementById("url").disabled = tunnel != "websocket";
+}
+
+// ----- Jump hosts -----
+//
+// Rebuild authentication options of the jump host
+//
+// Options are: password, agent and the keys
+//
+function JumpAuthOptions (sel, method) {
+    var i, elm, key;
+
+    while (sel.children.length > 2) {
+        sel.removeChild(sel.children[sel.children.length-1]);
+    }
+
+    for (i = 0; i < saved_keys.length; i ++) {
+        key = saved_keys[i];
+
+        elm = document.createElement("option");
+        elm.value = key.id;
+        elm.innerText = "Key " + (i + 1) + " (" + key.type +
+            (key.comment ? ", " + key.comment : "") + ")";
+
+        sel.appendChild(elm);
+    }
+
+    sel.value = method;
+    if (sel.value != method) {
+        sel.value = "auth.password";
+    }
+}
+
+//
+// Get authentication method of the jump host
+//
+function JumpAuthMethod (hop) {
+    if (hop.keyid) {
+        return hop.keyid;
+    } else if (hop.agent) {
+        return "auth.agent";
+    }
+    return "auth.password";
+}
+
+//
+// Append row to the jump hosts table
+//
+function JumpAppend (hop) {
+    var row = document.getElementById("jump.template").cloneNode(true);
+    var del, auth;
+
+    row.hidden = false;
+    row.removeAttribute("id");
+
+    row.querySelector("[name=addr]").value = hop.addr || "";
+    row.querySelector("[name=login]").value = hop.login || "";
+    row.querySelector("[name=password]").value = hop.password || "";
+
+    auth = row.querySelector("[name=auth]");
+    JumpAuthOptions(auth, JumpAuthMethod(hop));
+    auth.onchange = function () {
+        JumpPasswordConditionallyEnable(row);
+    };
+    JumpPasswordConditionallyEnable(row);
+
+    del = row.querySelector("[name=del]");
+    del.onclick = froxy.Ui.bind(null, function () {
+        var i = jump_table.indexOf(row);
+        if (i >= 0) {
+            jump_table.splice(i, 1);
+            row.parentNode.removeChild(row);
+        }
+    });
+
+    row.froxy_hop = hop;
+
+    document.getElementById("jump").appendChild(row);
+    jump_table.push(row);
+}
+
+//
+// Enable/Disable password of the jump host
+//
+function JumpPasswordConditionallyEnable (row) {
+    row.querySelector("[name=password]").disabled =
+        row.querySelector("[name=auth]").value != "auth.password";
+}
+
+//
+// Load jump hosts into the table
+//
+function JumpLoad (jump) {
+    var row;
+
+    while (jump_table.length > 0) {
+        row = jump_table.pop();
+        row.parentNode.removeChild(row);
+    }
+
+    for (var i = 0; jump && i < jump.length; i ++) {
+        JumpAppend(jump[i]);
+    }
+}
+
+//
+// Update authentication options of all jump hosts
+//
+// Called when keys changed
+//
+function JumpUpdateKeys () {
+    for (var i = 0; i < jump_table.length; i ++) {
+        var auth = jump_table[i].querySelector("[name=auth]");
+        JumpAuthOptions(auth, auth.value);
+        JumpPasswordConditionallyEnable(jump_table[i]);
+    }
+}
+
+//
+// Add new jump host
+//
+function JumpAdd () {
+    JumpAppend({});
+}
+
+//
+// Collect jump hosts parameters from the table
+//
+function JumpCollect () {
+    var jump = [];
+
+    for (var i = 0; i < jump_table.length; i ++) {
+        var row = jump_table[i];
+        var old = row.froxy_hop;
+        var method = row.querySelector("[name=auth]").value;
+        var hop = {
+            addr: row.querySelector("[name=addr]").value.trim(),
+            login: row.querySelector("[name=login]").value,
+        };
+
+        if (!hop.addr) {
+            continue;
+        }
+
+        switch (method) {
+        case "auth.password":
+            hop.password = row.querySelector("[name=password]").value;
+            break;
+
+        case "auth.agent":
+            hop.agent = true;
+            hop.agentkey = old.agent ? old.agentkey : "";
+            break;
+
+        default:
+            hop.keyid = method;
+        }
+
+        // Known host key remains valid only while address
+        // is not changed
+        if (hop.addr == old.addr) {
+            hop.hostkey = old.hostkey;
+        }
+
+        jump.push(hop);
+    }
+
+    return jump;
+}
+
+// ----- Servers table -----
+//
+// Update table of servers
+//
+function UpdateTable () {
+    var sz = saved_servers.length;
+    var row;
+
+    // Resize table
+    while (table.length > sz) {
+        row = table.pop();
+        row.parentNode.removeChild(row);
+    }
+
+    var tbody = document.getElementById("servers");
+
+    while (table.length < sz) {
+        row = document.getElementById("servers.template").cloneNode(true);
+        row.hidden = false;
+        row.removeAttribute("id");
+
+        var elements = froxy.DomChildren(row);
+        for (var i = 0; i < elements.length; i ++) {
+            var elm = elements[i];
+            var nm = elm.getAttribute("name");
+
+            if (nm) {
+                elm.id = table.length + "." + nm;
+            }
+
+            if (elm.type == "button") {
+                elm.onclick = function(n, i) {
+                    return froxy.Ui.bind(null, function() {
+                        TableButtonClicked(n, i);
+                    });
+                }(nm, table.length);
+            }
+        }
+
+        tbody.appendChild(row);
+        table.push(row);
+    }
+
+    // Update rows
+    for (var n = 0; n < table.length; n ++) {
+        var srv = saved_servers[n];
+        var active = srv.addr == saved_state.server;
+
+        froxy.UiSetInput(n + ".active", active ? "●" : "");
+        froxy.UiSetInput(n + ".name", srv.name);
+        froxy.UiSetInput(n + ".addr", srv.addr);
+        froxy.UiSetInput(n + ".login", srv.login);
+
+        document.getElementById(n + ".up").disabled = n == 0;
+        document.getElementById(n + ".down").disabled = n == sz - 1;
+    }
+}
+
+//
+// Called when servers table button is clicked
+//
+function TableButtonClicked (button, n) {
+    var servers = saved_servers.slice();
+    var srv = servers[n];
+    var m = n;
+
+    switch (button) {
+    case "edit":
+        ServerEdit(n);
+        return;
+
+    case "up":
+        m = n - 1;
+        break;
+
+    case "down":
+        m = n + 1;
+        break;
+
+    case "del":
+        servers.splice(n, 1);
+        if (editing == n) {
+            editing = -1;
+        } else if (editing > n) {
+            editing --;
+        }
+
+        SetServers(servers);
+        return;
+    }
+
+    if (m < 0 || m >= servers.length) {
+        return;
+    }
+
+    servers[n] = servers[m];
+    servers[m] = srv;
+
+    if (editing == n) {
+        editing = m;
+    } else if (editing == m) {
+        editing = n;
+    }
+
+    SetServers(servers);
+}
+
+// ----- Server editing -----
+//
+// Load server parameters into the editor
+//
+function ServerEdit (n) {
+    editing = n < saved_servers.length ? n : -1;
+
+    var srv = EditedServer();
+
+    if (editing < 0) {
+        froxy.UiSetInput("legend", "New Server");
+    } else {
+        froxy.UiSetInput("legend", "Server " + (editing + 1));
+    }
+
+    froxy.UiSetInput("name", srv.name);
+    froxy.UiSetInput("addr", srv.addr);
+    froxy.UiSetInput("login", srv.login);
+    froxy.UiSetInput("password", srv.password);
+    froxy.UiSetInput("totp", srv.totp);
+    froxy.UiSetInput("command", srv.command);
+    froxy.UiSetInput("proxy", srv.proxy);
+    froxy.UiSetInput("keepalive", srv.keepalive ? "" + srv.keepalive : "");
+    froxy.UiSetInput("keepalive_max",
+        srv.keepalive_max ? "" + srv.keepalive_max : "");
+    froxy.UiSetInput("tunnel", srv.tunnel || "");
+    froxy.UiSetInput("sni", srv.sni);
+    froxy.UiSetInput("url", srv.url);
+    TunnelConditionallyEnable();
+    AgentKeyUpdate(srv.agentkey || "");
+    froxy.UiSetInput("hostkey", srv.hostkey ||
+        "unknown, will be trusted on first connect");
+    JumpLoad(srv.jump);
+
+    AuthMethodUpdate();
+}
+
 // ----- User inputs callbacks -----
+//
+// Start editing of new server
+//
+function NewServer () {
+    ServerEdit(-1);
+}
+
 //
 // Submit server parameters
 //
 function SubmitServerParams () {
     var keyid = froxy.UiGetInput("auth");
+    var servers = saved_servers.slice();
+    var srv = {
+        name: froxy.UiGetInput("name"),
+        addr: froxy.UiGetInput("addr"),
+        login: froxy.UiGetInput("login"),
+        password: froxy.UiGetInput("password"),
+        totp: froxy.UiGetInput("totp").trim(),
+        command: froxy.UiGetInput("command").trim(),
+        proxy: froxy.UiGetInput("proxy").trim(),
+        keepalive: parseInt(froxy.UiGetInput("keepalive"), 10) || 0,
+        keepalive_max: parseInt(froxy.UiGetInput("keepalive_max"), 10) || 0,
+        tunnel: froxy.UiGetInput("tunnel"),
+        sni: froxy.UiGetInput("sni").trim(),
+        url: froxy.UiGetInput("url").trim(),
+        jump: JumpCollect(),
+    };
 
     switch (keyid) {
+    case "auth.agent":
+        srv.agent = true;
+        srv.agentkey = froxy.UiGetInput("agentkey");
+        keyid = "";
+        break;
+
     case "auth.none":
     case "auth.password":
         keyid = "";
     }
 
-    froxy.SetServerParams(
-        froxy.UiGetInput("addr"),
-        froxy.UiGetInput("login"),
-        froxy.UiGetInput("password"),
-        keyid
-    );
+    srv.keyid = keyid;
+
+    // Known host key remains valid only while server address
+    // is not changed
+    if (srv.addr == EditedServer().addr) {
+        srv.hostkey = EditedServer().hostkey;
+    }
+
+    if (editing < 0) {
+        editing = servers.length;
+        servers.push(srv);
+    } else {
+        servers[editing] = srv;
+    }
+
+    SetServers(servers);
 }
 
-// ----- Poll callbacks -----
 //
-// Poll callback for server parameters
+// Save servers parameters. Errors (i.e., server still used
+// by sites) are reported next to the servers table
 //
-function PollServerParams (data) {
-    saved_server_params = data;
+function SetServers (servers) {
+    var rq = froxy.SetServers(servers);
 
-    froxy.UiSetInput("addr", saved_server_params.addr);
-    froxy.UiSetInput("login", saved_server_params.login);
-    froxy.UiSetInput("password", saved_server_params.password);
+    froxy.UiSetInput("servers.status", "");
 
-    AuthMethodUpdate();
+    rq.OnError = function (err) {
+        froxy.UiSetInput("servers.status", err.reason);
+    };
+}
+
+//
+// Accept new server host key
+//
+function AcceptHostKey () {
+    SetServers(AcceptHostKeyIn(saved_servers));
+}
+
+//
+// Update host key of servers and jump hosts in the list.
+// Returns the modified copy
+//
+function AcceptHostKeyIn (list) {
+    var servers = [];
+
+    for (var i = 0; list && i < list.length; i ++) {
+        var srv = Object.assign({}, list[i]);
+        if (srv.addr == saved_state.hostkey_addr) {
+            srv.hostkey = saved_state.hostkey_new;
+        }
+        if (srv.jump) {
+            srv.jump = AcceptHostKeyIn(srv.jump);
+        }
+        servers.push(srv);
+    }
+
+    return servers;
+}
+
+//
+// Import servers host keys from the known_hosts file
+//
+function ImportKnownHosts () {
+    var rq = froxy.ImportKnownHosts(froxy.UiGetInput("knownhosts"));
+
+    froxy.UiSetInput("knownhosts.status", "");
+
+    rq.OnSuccess = function (data) {
+        var s = [];
+        for (var addr in data.hostkeys) {
+            s.push(addr + ": " + data.hostkeys[addr]);
+        }
+
+        froxy.UiSetInput("knownhosts", "");
+        froxy.UiSetInput("knownhosts.status", "Imported " + s.join(", "));
+    };
+
+    rq.OnError = function (err) {
+        froxy.UiSetInput("knownhosts.status", err.reason);
+    };
+}
+
+// ----- Connection problems -----
+//
+// Explanations and suggested fixes, by the connection error code
+//
+var conn_problems = {
+    dns: {
+        explain: "Server host name cannot be resolved.",
+        fix: "Check the server address for typos and check that " +
+             "DNS works in your network."
+    },
+    unreachable: {
+        explain: "Server is not reachable over the network.",
+        fix: "Check the server address and port, your network " +
+             "connection, and that no firewall blocks the connection."
+    },
+    timeout: {
+        explain: "Server doesn't respond in time.",
+        fix: "Check that server is up. If your network is slow or " +
+             "filtered, try the upstream proxy or the tunnel."
+    },
+    auth: {
+        explain: "Server rejected authentication.",
+        fix: "Check the login and the password or the key. Make sure " +
+             "that authentication method you use is offered by server."
+    },
+    dial: {
+        explain: "Server refuses to forward connections, so Froxy " +
+                 "cannot open sites through it.",
+        fix: "Ask the server administrator to enable TCP forwarding " +
+             "(AllowTcpForwarding in the OpenSSH sshd_config)."
+    },
+    other: {
+        explain: "Connection to the server failed.",
+        fix: "See the error message for details."
+    }
+};
+
+//
+// Show or hide connection problem explanation
+//
+function ConnProblemShow (data) {
+    var problem = conn_problems[data.code];
+
+    document.getElementById("connerr").hidden = !problem;
+    if (!problem) {
+        return;
+    }
+
+    var explain = problem.explain;
+    if (data.code == "auth") {
+        explain += " Server offers: " +
+            (data.methods ? data.methods.join(", ") : "nothing we support") +
+            ".";
+    }
+
+    froxy.UiSetInput("connerr.info", data.info);
+    froxy.UiSetInput("connerr.explain", explain);
+    froxy.UiSetInput("connerr.fix", problem.fix);
+}
+
+// ----- Poll callbacks -----
+//
+// Poll callback for servers parameters
+//
+function PollServers (data) {
+    saved_servers = data;
+
+    UpdateTable();
+    ServerEdit(editing);
 }
 
 //
@@ -132,6 +707,24 @@ function PollServerParams (data) {
 function PollKeys (data) {
     saved_keys = data;
     AuthMethodUpdate();
+    JumpUpdateKeys();
+}
+
+//
+// Poll callback for connection state
+//
+function PollState (data) {
+    saved_state = data;
+
+    document.getElementById("hostkey.mismatch").hidden =
+        data.state != "hostkey";
+
+    froxy.UiSetInput("hostkey.addr", data.hostkey_addr);
+    froxy.UiSetInput("hostkey.old", data.hostkey_old);
+    froxy.UiSetInput("hostkey.new", data.hostkey_new);
+
+    ConnProblemShow(data);
+    UpdateTable();
 }
 
 
@@ -140,8 +733,10 @@ function PollKeys (data) {
 // Page initialization
 //
 function init() {
-    froxy.BgPoll("/api/server", PollServerParams);
+    froxy.BgPoll("/api/server", PollServers);
     froxy.BgPoll("/api/keys", PollKeys);
+    froxy.BgPoll("/api/state", PollState);
+    AgentKeysLoad();
 }
 
 window.onload = init;
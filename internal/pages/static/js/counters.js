@@ -16,6 +16,81 @@ function GetCountersCallback (data) {
             }
         }
     }
+
+    UpdateServers(data.servers || []);
+}
+
+//
+// Update per-server counters table
+//
+function UpdateServers (servers) {
+    var tbody = document.getElementById("servers");
+
+    while (tbody.children.length) {
+        tbody.removeChild(tbody.children[0]);
+    }
+
+    for (var i = 0; i < servers.length; i ++) {
+        var s = servers[i];
+        var row = document.createElement("tr");
+        var cells = [s.server || "All servers", s.ssh_sessions, s.ssh_conns];
+
+        for (var j = 0; j < cells.length; j ++) {
+            var td = document.createElement("td");
+            td.innerText = cells[j];
+            row.appendChild(td);
+        }
+
+        tbody.appendChild(row);
+    }
+}
+
+//
+// Update per-site statistics table. Sites that use most
+// of traffic go first
+//
+function UpdateSiteStats (stats) {
+    var tbody = document.getElementById("sites");
+
+    while (tbody.children.length) {
+        tbody.removeChild(tbody.children[0]);
+    }
+
+    stats.sort(function(a, b) {
+        return (b.bytes_in + b.bytes_out) - (a.bytes_in + a.bytes_out) ||
+            (b.requests + b.connects) - (a.requests + a.connects);
+    });
+
+    for (var i = 0; i < stats.length; i ++) {
+        var s = stats[i];
+        var row = document.createElement("tr");
+        var site = s.site.host;
+
+        if (s.site.port) {
+            site += " port " + s.site.port;
+        }
+        if (s.site.scheme) {
+            site += " " + s.site.scheme;
+        }
+
+        var cells = [
+            site,
+            s.requests,
+            s.connects,
+            s.bytes_in,
+            s.bytes_out,
+            s.errors,
+            s.last_used ? new Date(s.last_used).toLocaleString() : "Never"
+        ];
+
+        for (var j = 0; j < cells.length; j ++) {
+            var td = document.createElement("td");
+            td.innerText = cells[j];
+            row.appendChild(td);
+        }
+
+        tbody.appendChild(row);
+    }
 }
 
 //
@@ -23,6 +98,7 @@ function GetCountersCallback (data) {
 //
 function init() {
     froxy.BgPoll("/api/counters", GetCountersCallback);
+    froxy.BgPoll("/api/stats/sites", UpdateSiteStats);
 }
 
 window.onload = init;
@@ -10,6 +10,13 @@
 //
 var table = [];
 
+//
+// Saved list of sites, servers and subscriptions
+//
+var saved_sites = [];
+var saved_servers = [];
+var saved_subs = [];
+
 //
 // Add a site
 //
@@ -19,25 +26,94 @@ function AddSite () {
         var host = elm.getAttribute("hostname");
         var params = {
             host: host,
+            type: elm.getAttribute("hosttype"),
+            port: froxy.UiGetInput("add.port"),
+            scheme: froxy.UiGetInput("add.scheme"),
             rec: froxy.UiGetInput("add.rec"),
-            block: froxy.UiGetInput("add.block")
+            server: froxy.UiGetInput("add.server"),
+            expires: ParseExpires(froxy.UiGetInput("add.expires")),
+            schedule: ParseSchedule(froxy.UiGetInput("add.schedule"))
         };
 
-        froxy.SetSite(params.host, params);
+        SetSiteAction(params, froxy.UiGetInput("add.action"));
+
+        froxy.SetSite(null, params);
 
         froxy.UiSetInput("add.host", "");
+        froxy.UiSetInput("add.port", "");
+        froxy.UiSetInput("add.scheme", "");
         froxy.UiSetInput("add.rec", true);
-        froxy.UiSetInput("add.block", false);
+        froxy.UiSetInput("add.action", "");
+        froxy.UiSetInput("add.server", "");
+        froxy.UiSetInput("add.expires", "");
+        froxy.UiSetInput("add.schedule", "");
         elm.removeAttribute("hostname");
+        elm.removeAttribute("hosttype");
+        froxy.UiSetInput("add.type", "");
     }
 }
 
+//
+// Import list of sites
+//
+function ImportSites () {
+    var rq = froxy.ImportSites(
+        froxy.UiGetInput("sitelist.format"),
+        froxy.UiGetInput("sitelist.replace"),
+        froxy.UiGetInput("sitelist")
+    );
+
+    froxy.UiSetInput("sitelist.status", "");
+    froxy.UiSetInput("sitelist.errors", "");
+
+    rq.OnSuccess = function (data) {
+        var errs = data.errors || [];
+        var s = [];
+
+        for (var i = 0; i < errs.length; i ++) {
+            s.push("line " + errs[i].line + ": " + errs[i].text + ": " + errs[i].err);
+        }
+
+        froxy.UiSetInput("sitelist", "");
+        froxy.UiSetInput("sitelist.status", "Imported " + data.imported +
+            " sites (" + data.format + " format), " + errs.length + " errors");
+        froxy.UiSetInput("sitelist.errors", s.join("\n"));
+    };
+
+    rq.OnError = function (err) {
+        froxy.UiSetInput("sitelist.status", err.reason);
+    };
+}
+
+//
+// Export list of sites
+//
+function ExportSites () {
+    var format = froxy.UiGetInput("sitelist.format") || "plain";
+    var rq = froxy.ExportSites(format);
+
+    froxy.UiSetInput("sitelist.status", "");
+    froxy.UiSetInput("sitelist.errors", "");
+
+    rq.OnSuccess = function (data) {
+        froxy.UiSetInput("sitelist", data.list);
+    };
+
+    rq.OnError = function (err) {
+        froxy.UiSetInput("sitelist.status", err.reason);
+    };
+}
+
 //
 // Called when table button is clicked
 //
 function TableButtonClicked (button, rownum) {
     var row = table[rownum];
-    var oldhost = row.getAttribute("host");
+    var key = {
+        host: row.getAttribute("host"),
+        port: row.getAttribute("port"),
+        scheme: row.getAttribute("scheme")
+    };
 
     switch (button) {
     case "update":
@@ -48,19 +124,74 @@ function TableButtonClicked (button, rownum) {
 
         var params = {
             host: elm.getAttribute("hostname"),
+            type: elm.getAttribute("hosttype"),
+            port: froxy.UiGetInput(rownum + ".port"),
+            scheme: froxy.UiGetInput(rownum + ".scheme"),
             rec: froxy.UiGetInput(rownum + ".rec"),
-            block: froxy.UiGetInput(rownum + ".block")
+            server: froxy.UiGetInput(rownum + ".server"),
+            expires: ParseExpires(froxy.UiGetInput(rownum + ".expires")),
+            schedule: ParseSchedule(froxy.UiGetInput(rownum + ".schedule"))
         };
 
-        froxy.SetSite(oldhost, params);
+        SetSiteAction(params, froxy.UiGetInput(rownum + ".action"));
+
+        froxy.SetSite(key, params);
         break;
 
     case "del":
-        froxy.DelSite(oldhost);
+        froxy.DelSite(key);
         break;
     }
 }
 
+//
+// Update servers selection controls
+//
+// Each site may be bound to the particular server, identified
+// by server name or address, if name is not set
+//
+function UpdateServers () {
+    var selects = document.getElementsByClassName("server");
+    var idents = [];
+    var i, j;
+
+    for (i = 0; i < saved_servers.length; i ++) {
+        idents.push(saved_servers[i].name || saved_servers[i].addr);
+    }
+
+    for (i = 0; i < selects.length; i ++) {
+        var sel = selects[i];
+        var value = sel.value;
+
+        while (sel.children.length) {
+            sel.removeChild(sel.children[0]);
+        }
+
+        var opt = document.createElement("option");
+        opt.value = "";
+        opt.innerText = "Any";
+        sel.appendChild(opt);
+
+        for (j = 0; j < idents.length; j ++) {
+            opt = document.createElement("option");
+            opt.value = idents[j];
+            opt.innerText = idents[j];
+            sel.appendChild(opt);
+        }
+
+        sel.value = value;
+    }
+}
+
+//
+// Poll callback for servers
+//
+function PollServers (servers) {
+    saved_servers = servers;
+    UpdateServers();
+    UpdateTable(saved_sites);
+}
+
 //
 // Update table of sites
 //
@@ -68,6 +199,8 @@ function UpdateTable (sites) {
     var sz = sites.length;
     var row;
 
+    saved_sites = sites;
+
     // Sort sites
     sites.sort(function(a, b) { return a.host.localeCompare(b.host); });
 
@@ -86,7 +219,7 @@ function UpdateTable (sites) {
 
             row.hidden = false;
 
-            var inputs = row.getElementsByTagName("input");
+            var inputs = row.querySelectorAll("[name]");
             for (var i = 0; i < inputs.length; i ++) {
                 var elm = inputs[i];
                 var nm = elm.getAttribute("name");
@@ -109,18 +242,47 @@ function UpdateTable (sites) {
             tbody.appendChild(row);
             table.push(row);
         }
+
+        UpdateServers();
     }
 
     // Update rows
     for (var n = 0; n < table.length; n ++) {
-        froxy.UiSetInput(n + ".host", sites[n].host);
+        froxy.UiSetInput(n + ".host", SiteHostText(sites[n]));
+        froxy.UiSetInput(n + ".type", sites[n].type);
+        froxy.UiSetInput(n + ".port", sites[n].port);
+        froxy.UiSetInput(n + ".scheme", sites[n].scheme);
         froxy.UiSetInput(n + ".rec", sites[n].rec);
-        froxy.UiSetInput(n + ".block", sites[n].block);
+        froxy.UiSetInput(n + ".action", GetSiteAction(sites[n]));
+        SetServerInput(n + ".server", sites[n].server);
+        froxy.UiSetInput(n + ".expires", FormatExpires(sites[n].expires));
+        froxy.UiSetInput(n + ".schedule", (sites[n].schedule || []).join("; "));
         table[n].setAttribute("host", sites[n].host);
+        table[n].setAttribute("port", sites[n].port || "");
+        table[n].setAttribute("scheme", sites[n].scheme || "");
         froxy.BgWatch(n + ".host", "/api/domain", DomainChecked);
     }
 }
 
+//
+// Set server selection control value. If server is not configured,
+// it is added to the list of choices, so it is not lost
+//
+function SetServerInput (id, server) {
+    var sel = document.getElementById(id);
+
+    server = server || "";
+    sel.value = server;
+
+    if (sel.value != server) {
+        var opt = document.createElement("option");
+        opt.value = server;
+        opt.innerText = server + " (not configured)";
+        sel.appendChild(opt);
+        sel.value = server;
+    }
+}
+
 //
 // This function is called when domain name being edited
 // by user was checked by Froxy
@@ -131,10 +293,14 @@ function DomainChecked (id, reply) {
 
     if (ok) {
         elm.setAttribute("hostname", reply.host);
+        elm.setAttribute("hosttype", reply.type || "");
     } else {
         elm.removeAttribute("hostname");
+        elm.removeAttribute("hosttype");
     }
 
+    froxy.UiSetInput(id.replace(/host$/, "type"), reply.type);
+
     if (elm.value && !ok) {
         elm.style.borderColor = "red";
         elm.style.borderStyle = "dashed";
@@ -144,11 +310,338 @@ function DomainChecked (id, reply) {
     }
 }
 
+//
+// Get site action: "" (forward), "block[:mode]" or "bypass"
+//
+function GetSiteAction (site) {
+    if (site.block) {
+        return site.mode ? "block:" + site.mode : "block";
+    }
+    if (site.bypass) {
+        return "bypass";
+    }
+    return "";
+}
+
+//
+// Set site action: "" (forward), "block[:mode]" or "bypass"
+//
+function SetSiteAction (site, action) {
+    var mode = action.split(":");
+
+    site.block = mode[0] == "block";
+    site.bypass = mode[0] == "bypass";
+    site.mode = mode[1] || "";
+}
+
+//
+// Parse site expiration time, entered by user as "YYYY-MM-DD HH:MM",
+// local time. Returns ISO time string or null, if time is not set.
+// Invalid input is returned as is, so Froxy will report an error
+//
+function ParseExpires (text) {
+    var m = /^\s*(\d{4})-(\d{1,2})-(\d{1,2})(?:\s+(\d{1,2}):(\d{2}))?\s*$/.exec(text);
+    if (!m) {
+        return text.trim() || null;
+    }
+
+    var t = new Date(+m[1], +m[2] - 1, +m[3], +(m[4] || 0), +(m[5] || 0));
+    return t.toISOString();
+}
+
+//
+// Format site expiration time for user
+//
+function FormatExpires (expires) {
+    if (!expires) {
+        return "";
+    }
+
+    var t = new Date(expires);
+    var pad = function (n) { return (n < 10 ? "0" : "") + n; };
+
+    return t.getFullYear() + "-" + pad(t.getMonth() + 1) + "-" + pad(t.getDate()) +
+        " " + pad(t.getHours()) + ":" + pad(t.getMinutes());
+}
+
+//
+// Parse site schedule, entered by user as semicolon-separated
+// list of time windows
+//
+function ParseSchedule (text) {
+    var schedule = [];
+    var windows = text.split(";");
+
+    for (var i = 0; i < windows.length; i ++) {
+        var w = windows[i].trim();
+        if (w) {
+            schedule.push(w);
+        }
+    }
+
+    return schedule;
+}
+
+//
+// Get site host, as entered by user. Regular expressions are
+// enclosed into slashes
+//
+function SiteHostText (site) {
+    if (site.type == "regexp") {
+        return "/" + site.host + "/";
+    }
+    return site.host;
+}
+
+//
+// Load list of site patterns matches, in order of precedence
+//
+function LoadPatterns () {
+    var rq = froxy.GetPatterns();
+
+    rq.OnSuccess = function (patterns) {
+        var list = document.getElementById("patterns");
+
+        for (var i = 0; i < patterns.length; i ++) {
+            var item = document.createElement("li");
+            item.innerText = patterns[i].text;
+            list.appendChild(item);
+        }
+    };
+}
+
+//
+// Explain routing decision for the host or URL, entered by user
+//
+function ExplainRoute () {
+    var host = froxy.UiGetInput("route.host");
+    if (!host) {
+        return;
+    }
+
+    var rq = froxy.ExplainRoute(host);
+
+    rq.OnSuccess = function (ex) {
+        var text = ex.scheme + " " + ex.host + ":" + ex.port + ": " +
+                   ex.answer + "\n" + ex.reason + "\n";
+
+        if (ex.site && ex.site.server) {
+            text += "Server: " + ex.site.server + "\n";
+        }
+
+        if (ex.candidates.length) {
+            text += "\nOther candidates:\n";
+            for (var i = 0; i < ex.candidates.length; i ++) {
+                var c = ex.candidates[i];
+                var site = SiteHostText(c.site);
+
+                if (c.site.port) {
+                    site += " port " + c.site.port;
+                }
+                if (c.site.scheme) {
+                    site += " scheme " + c.site.scheme;
+                }
+
+                if (c.subscribed) {
+                    site += " from subscription";
+                }
+
+                text += "  " + site + " (" + c.match + "): " + c.reason + "\n";
+            }
+        }
+
+        froxy.UiSetInput("route.result", text);
+    };
+
+    rq.OnError = function (err) {
+        froxy.UiSetInput("route.result", err.reason);
+    };
+}
+
+//
+// Set routing options
+//
+function SetRouting () {
+    froxy.SetRouting({
+        resolve_hosts: froxy.UiGetInput("resolve_hosts"),
+        fallback: froxy.UiGetInput("fallback")
+    });
+}
+
+//
+// Poll callback for routing options
+//
+function PollRouting (routing) {
+    froxy.UiSetInput("resolve_hosts", routing.resolve_hosts);
+    froxy.UiSetInput("fallback", routing.fallback);
+}
+
+//
+// Update table of learned hosts
+//
+function UpdateLearned (learned) {
+    var tbody = document.getElementById("learned");
+
+    while (tbody.children.length) {
+        tbody.removeChild(tbody.children[0]);
+    }
+
+    learned.sort(function(a, b) { return a.host.localeCompare(b.host); });
+
+    for (var i = 0; i < learned.length; i ++) {
+        var l = learned[i];
+        var row = document.createElement("tr");
+        var cells = [
+            l.host,
+            l.count,
+            new Date(l.last).toLocaleString(),
+            l.learned ? "Forwarded" : "Not yet"
+        ];
+
+        for (var j = 0; j < cells.length; j ++) {
+            var td = document.createElement("td");
+            td.innerText = cells[j];
+            row.appendChild(td);
+        }
+
+        var buttons = [
+            ["Promote", froxy.PromoteLearned],
+            ["Forget", froxy.DelLearned]
+        ];
+
+        for (j = 0; j < buttons.length; j ++) {
+            td = document.createElement("td");
+            var btn = document.createElement("input");
+            btn.type = "button";
+            btn.value = buttons[j][0];
+            btn.onclick = froxy.Ui.bind(null, buttons[j][1].bind(null, l.host));
+            td.appendChild(btn);
+            row.appendChild(td);
+        }
+
+        tbody.appendChild(row);
+    }
+}
+
+//
+// Add subscription to the site list
+//
+function AddSubscription () {
+    var sub = {
+        url:     froxy.UiGetInput("subs.url").trim(),
+        format:  froxy.UiGetInput("subs.format"),
+        forward: froxy.UiGetInput("subs.forward"),
+        server:  froxy.UiGetInput("subs.server")
+    };
+
+    if (!sub.url) {
+        return;
+    }
+
+    var subs = saved_subs.map(function (s) {
+        return { url: s.url, format: s.format, forward: s.forward,
+                 server: s.server };
+    });
+    subs.push(sub);
+
+    var rq = froxy.SetSubscriptions(subs);
+
+    froxy.UiSetInput("subs.status", "");
+
+    rq.OnSuccess = function () {
+        froxy.UiSetInput("subs.url", "");
+    };
+
+    rq.OnError = function (err) {
+        froxy.UiSetInput("subs.status", err.reason);
+    };
+}
+
+//
+// Delete subscription to the site list
+//
+function DelSubscription (url) {
+    var subs = [];
+    for (var i = 0; i < saved_subs.length; i ++) {
+        var s = saved_subs[i];
+        if (s.url != url) {
+            subs.push({ url: s.url, format: s.format, forward: s.forward,
+                        server: s.server });
+        }
+    }
+
+    return froxy.SetSubscriptions(subs);
+}
+
+//
+// Update table of subscriptions
+//
+function UpdateSubscriptions (subs) {
+    var tbody = document.getElementById("subs");
+    var date = function (ms) {
+        return ms ? new Date(ms).toLocaleString() : "Never";
+    };
+
+    saved_subs = subs;
+
+    while (tbody.children.length) {
+        tbody.removeChild(tbody.children[0]);
+    }
+
+    for (var i = 0; i < subs.length; i ++) {
+        var s = subs[i];
+        var status = s.error || "OK";
+        var via = s.forward ? " via " + (s.server || "server") : "";
+
+        if (!s.error && s.errors) {
+            status = s.errors + " lines skipped";
+        }
+
+        var row = document.createElement("tr");
+        var cells = [
+            s.url + via,
+            s.used || s.format || "auto",
+            s.sites,
+            date(s.updated),
+            status,
+            date(s.next)
+        ];
+
+        for (var j = 0; j < cells.length; j ++) {
+            var td = document.createElement("td");
+            td.innerText = cells[j];
+            row.appendChild(td);
+        }
+
+        var buttons = [
+            ["Update now", froxy.UpdateSubscription],
+            ["Del", DelSubscription]
+        ];
+
+        for (j = 0; j < buttons.length; j ++) {
+            td = document.createElement("td");
+            var btn = document.createElement("input");
+            btn.type = "button";
+            btn.value = buttons[j][0];
+            btn.onclick = froxy.Ui.bind(null, buttons[j][1].bind(null, s.url));
+            td.appendChild(btn);
+            row.appendChild(td);
+        }
+
+        tbody.appendChild(row);
+    }
+}
+
 //
 // Page initialization
 //
 function init () {
+    LoadPatterns();
     froxy.BgPoll("/api/sites", UpdateTable);
+    froxy.BgPoll("/api/server", PollServers);
+    froxy.BgPoll("/api/routing", PollRouting);
+    froxy.BgPoll("/api/learned", UpdateLearned);
+    froxy.BgPoll("/api/subscriptions", UpdateSubscriptions);
     froxy.BgWatch("add.host", "/api/domain", DomainChecked);
 }
 
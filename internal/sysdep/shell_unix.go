@@ -0,0 +1,24 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Run command via system shell -- UNIX version
+//
+// +build darwin dragonfly freebsd linux nacl netbsd openbsd solaris
+
+package sysdep
+
+import (
+	"context"
+	"os/exec"
+)
+
+//
+// Create command that runs the command line via system shell
+//
+// The process is killed when context is canceled
+//
+func ShellCommand(ctx context.Context, cmdline string) *exec.Cmd {
+	return exec.CommandContext(ctx, "/bin/sh", "-c", cmdline)
+}
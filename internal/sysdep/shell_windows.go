@@ -0,0 +1,32 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Run command via system shell -- Windows version
+
+package sysdep
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+)
+
+//
+// Create command that runs the command line via system shell
+//
+// The process is killed when context is canceled
+//
+func ShellCommand(ctx context.Context, cmdline string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "cmd")
+
+	// cmd.exe has its own quoting rules, so command line
+	// is passed as is
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		HideWindow: true,
+		CmdLine:    `cmd /S /C "` + cmdline + `"`,
+	}
+
+	return cmd
+}
@@ -54,6 +54,17 @@ func (l *Logger) LogToFile(path string) error {
 	return l.reopen()
 }
 
+//
+// Check if messages of the given level are logged. It allows
+// to avoid preparing message arguments in vain
+//
+func (l *Logger) Enabled(level LogLevel) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return level >= l.level
+}
+
 //
 // Write Trace-level log message
 //
@@ -31,6 +31,10 @@ func FroxyAdm(env *Env, opt *Options) {
 		err = adm.Run()
 	case OptCmdOpen:
 		err = adm.Open()
+	case OptCmdImport:
+		err = adm.Import(opt.ListFile, opt.ListFormat, opt.Flags)
+	case OptCmdExport:
+		err = adm.Export(opt.ListFile, opt.ListFormat)
 	default:
 		panic("Internal error")
 	}
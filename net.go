@@ -8,10 +8,17 @@
 package main
 
 import (
+	"context"
 	"net"
 	"strings"
+	"time"
 )
 
+//
+// Function that dials network connections
+//
+type NetDialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
 //
 // Split network address into host and port
 //
@@ -52,3 +59,31 @@ func NetNormalizeIP(ip net.IP) net.IP {
 	}
 	return ip
 }
+
+//
+// Perform blocking I/O on connection, that may be interrupted via
+// context. The I/O is limited in time by timeout
+//
+func NetDoContext(ctx context.Context, conn net.Conn, timeout time.Duration,
+	io func() error) error {
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	err := io()
+	conn.SetDeadline(time.Time{})
+	close(done)
+
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	return err
+}
@@ -25,8 +25,10 @@ type OptCmd int
 const (
 	OptCmdNone OptCmd = iota
 	OptCmdDebug
+	OptCmdExport
 	OptCmdRunFg
 	OptCmdHelp
+	OptCmdImport
 	OptCmdInstall
 	OptCmdKill
 	OptCmdOpen
@@ -43,6 +45,7 @@ const (
 	OptFlgNoRun OptFlags = 1 << iota
 	OptFlgNoAutostart
 	OptFlgNoShortcut
+	OptFlgReplace
 )
 
 //
@@ -59,6 +62,10 @@ type Options struct {
 	Cmd   OptCmd   // Froxy command
 	Flags OptFlags // Command flags
 	Port  int      // TCP port
+
+	// Sites import/export
+	ListFile   string         // File to import from or export to
+	ListFormat SiteListFormat // Sites list format
 }
 
 //
@@ -78,7 +85,9 @@ func (opt *Options) Parse(env *Env) error {
 	flagset.SetOutput(ioutil.Discard)
 
 	debug := flagset.Bool("debug", false, "")
+	export := flagset.String("export", "", "")
 	fg := flagset.Bool("fg", false, "")
+	imprt := flagset.String("import", "", "")
 	install := flagset.Bool("i", false, "")
 	kill := flagset.Bool("k", false, "")
 	open := flagset.Bool("open", false, "")
@@ -87,6 +96,8 @@ func (opt *Options) Parse(env *Env) error {
 
 	norun := flagset.Bool("norun", false, "")
 	noautostart := flagset.Bool("noautostart", false, "")
+	format := flagset.String("format", "", "")
+	replace := flagset.Bool("replace", false, "")
 	port := flagset.Int("p", env.GetPort(), "")
 
 	// Parse arguments
@@ -110,7 +121,9 @@ func (opt *Options) Parse(env *Env) error {
 		cmd OptCmd
 	}{
 		{*debug, OptCmdDebug},
+		{*export != "", OptCmdExport},
 		{*fg, OptCmdRunFg},
+		{*imprt != "", OptCmdImport},
 		{*install, OptCmdInstall},
 		{*kill, OptCmdKill},
 		{*open, OptCmdOpen},
@@ -140,6 +153,7 @@ func (opt *Options) Parse(env *Env) error {
 	}{
 		{*norun, OptFlgNoRun},
 		{*noautostart, OptFlgNoAutostart},
+		{*replace, OptFlgReplace},
 	}
 
 	var bits OptFlags
@@ -154,10 +168,24 @@ func (opt *Options) Parse(env *Env) error {
 		return fmt.Errorf("Port number %d out of range", *port)
 	}
 
+	// Check list format
+	listFormat := SiteListFormat(*format)
+	if !listFormat.Valid() {
+		return fmt.Errorf("Unknown list format %q", *format)
+	}
+
 	// Pack result
 	opt.Cmd = cmd
 	opt.Flags = bits
 	opt.Port = *port
+	opt.ListFormat = listFormat
+
+	switch cmd {
+	case OptCmdExport:
+		opt.ListFile = *export
+	case OptCmdImport:
+		opt.ListFile = *imprt
+	}
 
 	return nil
 }
@@ -182,19 +210,25 @@ Common commands:
 	const full_usage = `Usage: froxy command [options]
 Commands:
   -debug        Run ${PROG} in debug mode
+  -export file  Export list of sites ("-" for stdout)
   -fg           Run ${PROG} in foreground
   -h            Print help page
   -i            Install and start the ${PROG}
+  -import file  Import list of sites ("-" for stdin)
   -k            Kill running ${PROG}
   -open         Open ${PROG} configuration in browser window
   -r            Run ${PROG} in background
   -u            Uninstall the ${PROG}
 
 Options:
+  -format fmt   List format for -import/-export: plain, hosts,
+                adblock, gfwlist or json (default: auto-detect
+                for import, plain for export)
   -noautostart  Don't add ${PROG} to autostart
   -norun        Don't run after installation
   -noshortcut   Don't create desktop shortcut
   -p port       TCP port (default ${PORT})
+  -replace      Replace existent sites on import, instead of merge
 
 Advanced options:
   -fg           Run in foreground
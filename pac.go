@@ -0,0 +1,303 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Proxy Auto-Config (PAC) file generator
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+//
+// PAC file generator
+//
+// The PAC script sends to Froxy all hosts that match some site
+// (either forwarded or blocked), and lets clients to connect
+// directly to all other hosts, without extra hop via Froxy
+//
+// IPv4 CIDR blocks are matched with isInNet(). If Froxy resolves
+// host names (see Env.GetResolveHosts), the PAC script does the same,
+// using dnsResolve(). As PAC scripts have no portable way to match
+// IPv6 addresses, if there are IPv6 CIDR blocks, all hosts, specified
+// by IPv6 address, are sent to Froxy
+//
+// Sites with port or scheme constraints are matched against URL,
+// passed to the FindProxyForURL(). As clients use CONNECT for HTTPS
+// and secure WebSocket, "connect" scheme matches https:// and wss://
+// URLs
+//
+// Bypassed sites are not included into the script: hosts that match
+// them may also match less specific forwarded sites, and Froxy will
+// decide how to route them
+//
+// Sites from subscriptions (see Subscriptions) and learned hosts
+// (see Env.GetLearned) are sent to Froxy as well.
+// If fallback to server is enabled (see Env.GetFallback), Froxy
+// needs to see all requests, so all hosts are sent to Froxy
+//
+// The script is regenerated when list of sites or learned hosts changes
+//
+type PAC struct {
+	froxy  *Froxy       // Back link to Froxy
+	script atomic.Value // Current script, []byte
+}
+
+//
+// Create new PAC generator
+//
+func NewPAC(froxy *Froxy) *PAC {
+	pac := &PAC{
+		froxy: froxy,
+	}
+
+	events := froxy.Sub(EventSitesChanged, EventLearnedChanged)
+	pac.script.Store(pac.generate(pac.sites()))
+
+	go pac.goroutine(events)
+
+	return pac
+}
+
+//
+// PAC goroutine. Regenerates the script when list of sites
+// or learned hosts changes
+//
+func (pac *PAC) goroutine(events <-chan Event) {
+	for range events {
+		pac.script.Store(pac.generate(pac.sites()))
+	}
+}
+
+//
+// Get user's sites and sites from subscriptions
+//
+func (pac *PAC) sites() []SiteParams {
+	sites := pac.froxy.GetSites()
+	subscribed := pac.froxy.subs.Sites()
+
+	all := make([]SiteParams, 0, len(sites)+len(subscribed))
+	all = append(all, sites...)
+	return append(all, subscribed...)
+}
+
+//
+// Serve the PAC file
+//
+func (pac *PAC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	script := pac.script.Load().([]byte)
+
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	httpNoCache(w)
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method != "HEAD" {
+		w.Write(script)
+	}
+}
+
+//
+// Generate the PAC script
+//
+func (pac *PAC) generate(sites []SiteParams) []byte {
+	exact := make(map[string]bool)
+	rec := make(map[string]bool)
+	globs := []string{}
+	regexps := []string{}
+	cidrs := [][2]string{}
+	cidr6 := false
+	rules := []SiteParams{}
+
+	for _, site := range sites {
+		if site.Bypass {
+			continue
+		}
+
+		if site.Constraints() != 0 {
+			rules = append(rules, site)
+			continue
+		}
+
+		switch site.Type {
+		case SiteTypeDomain:
+			exact[site.Host] = true
+			if site.Rec {
+				rec[site.Host] = true
+			}
+		case SiteTypeGlob:
+			globs = append(globs, site.Host)
+		case SiteTypeRegexp:
+			regexps = append(regexps, site.Host)
+		case SiteTypeCIDR:
+			_, cidr, err := net.ParseCIDR(site.Host)
+			switch {
+			case err != nil:
+			case len(cidr.IP) == net.IPv4len:
+				mask := net.IP(cidr.Mask).String()
+				cidrs = append(cidrs, [2]string{cidr.IP.String(), mask})
+			default:
+				cidr6 = true
+			}
+		}
+	}
+
+	for _, l := range pac.froxy.GetLearned() {
+		if l.Learned() {
+			exact[l.Host] = true
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	js := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+
+	fmt.Fprintf(buf, "// Generated by %s. Do not edit\n\n", PROGRAM_NAME)
+	fmt.Fprintf(buf, "var froxy = %q;\n", "PROXY localhost:"+pac.froxy.localport)
+	fmt.Fprintf(buf, "var exact = %s;\n", js(exact))
+	fmt.Fprintf(buf, "var rec = %s;\n", js(rec))
+	fmt.Fprintf(buf, "var globs = %s;\n", js(globs))
+	fmt.Fprintf(buf, "var regexps = %s;\n", js(regexps))
+	fmt.Fprintf(buf, "var cidrs = %s;\n", js(cidrs))
+	fmt.Fprintf(buf, "var cidr6 = %v;\n", cidr6)
+	fmt.Fprintf(buf, "var resolve = %v;\n", pac.froxy.GetResolveHosts())
+	fmt.Fprintf(buf, "var rules = %s;\n", js(rules))
+	fmt.Fprintf(buf, "var fallback = %v;\n", pac.froxy.GetFallback())
+
+	buf.WriteString(pacScript)
+
+	return buf.Bytes()
+}
+
+//
+// Static part of the PAC script
+//
+// If some regular expression cannot be compiled by the JavaScript
+// engine, all requests are sent to Froxy, and Froxy will decide
+//
+const pacScript = `
+var all = fallback;
+for (var i = 0; i < regexps.length; i ++) {
+    try {
+        regexps[i] = new RegExp("^(?:" + regexps[i] + ")$");
+    } catch (e) {
+        all = true;
+    }
+}
+
+for (var i = 0; i < rules.length; i ++) {
+    if (rules[i].type == "regexp") {
+        try {
+            rules[i].re = new RegExp("^(?:" + rules[i].host + ")$");
+        } catch (e) {
+            all = true;
+        }
+    }
+}
+
+var schemes = {
+    http:    ["http", "ws"],
+    ftp:     ["ftp"],
+    connect: ["https", "wss"]
+};
+
+var ports = {
+    http:  "80",
+    ws:    "80",
+    https: "443",
+    wss:   "443",
+    ftp:   "21"
+};
+
+function MatchRule(rule, url, host) {
+    var scheme = url.substr(0, url.indexOf(":")).toLowerCase();
+
+    if (rule.scheme && schemes[rule.scheme].indexOf(scheme) < 0) {
+        return false;
+    }
+
+    if (rule.port) {
+        var m = /^[^:]*:\/\/(\[[^\]]*\]|[^\/:]*)(:([0-9]+))?/.exec(url);
+        var port = (m && m[3]) || ports[scheme];
+        if (port != rule.port) {
+            return false;
+        }
+    }
+
+    switch (rule.type || "") {
+    case "":
+        return host == rule.host ||
+            (rule.rec && host.substr(-rule.host.length - 1) == "." + rule.host);
+    case "glob":
+        return shExpMatch(host, rule.host);
+    case "regexp":
+        return rule.re.test(host);
+    case "cidr":
+        // Let Froxy decide
+        return /^[0-9.:]+$/.test(host) || resolve;
+    }
+
+    return false;
+}
+
+function FindProxyForURL(url, host) {
+    if (all) {
+        return froxy;
+    }
+
+    host = host.toLowerCase();
+    for (var i = 0; i < rules.length; i ++) {
+        if (MatchRule(rules[i], url, host)) {
+            return froxy;
+        }
+    }
+    if (exact.hasOwnProperty(host)) {
+        return froxy;
+    }
+
+    for (var i = host.indexOf("."); i >= 0; i = host.indexOf(".", i + 1)) {
+        if (rec.hasOwnProperty(host.substr(i + 1))) {
+            return froxy;
+        }
+    }
+
+    for (var i = 0; i < globs.length; i ++) {
+        if (shExpMatch(host, globs[i])) {
+            return froxy;
+        }
+    }
+
+    for (var i = 0; i < regexps.length; i ++) {
+        if (regexps[i].test(host)) {
+            return froxy;
+        }
+    }
+
+    if (host.indexOf(":") >= 0) {
+        return cidr6 ? froxy : "DIRECT";
+    }
+
+    if (cidrs.length) {
+        var addr = host;
+        if (!/^[0-9.]+$/.test(addr)) {
+            addr = resolve ? dnsResolve(host) : null;
+        }
+
+        for (var i = 0; addr && i < cidrs.length; i ++) {
+            if (isInNet(addr, cidrs[i][0], cidrs[i][1])) {
+                return froxy;
+            }
+        }
+    }
+
+    return "DIRECT";
+}
+`
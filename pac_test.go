@@ -0,0 +1,174 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Proxy Auto-Config (PAC) file generator test
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os/exec"
+	"testing"
+)
+
+//
+// PAC functions, provided by browsers, for running the
+// script with node
+//
+const pacTestRuntime = `
+function shExpMatch(str, exp) {
+    exp = exp.replace(/[.+^${}()|[\]\\]/g, "\\$&");
+    exp = exp.replace(/\*/g, ".*").replace(/\?/g, ".");
+    return new RegExp("^" + exp + "$").test(str);
+}
+
+function pacTestAddr(addr) {
+    var b = addr.split(".");
+    return ((b[0] << 24) | (b[1] << 16) | (b[2] << 8) | b[3]) >>> 0;
+}
+
+function isInNet(addr, net, mask) {
+    var m = pacTestAddr(mask);
+    return ((pacTestAddr(addr) & m) >>> 0) == ((pacTestAddr(net) & m) >>> 0);
+}
+
+function dnsResolve(host) {
+    return null;
+}
+`
+
+//
+// Run the PAC script with node and call FindProxyForURL for
+// each (url, host) pair. Returns results of calls
+//
+func pacTestFindProxy(t *testing.T, node string, script []byte,
+	args [][2]string) []string {
+
+	buf := bytes.NewBufferString(pacTestRuntime)
+	buf.Write(script)
+	buf.WriteString("\nvar tests = ")
+
+	data, _ := json.Marshal(args)
+	buf.Write(data)
+
+	buf.WriteString(`;
+var out = [];
+for (var i = 0; i < tests.length; i ++) {
+    out.push(FindProxyForURL(tests[i][0], tests[i][1]));
+}
+console.log(JSON.stringify(out));
+`)
+
+	cmd := exec.Command(node)
+	cmd.Stdin = buf
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("node: %s\n%s", err, script)
+	}
+
+	var results []string
+	err = json.Unmarshal(output, &results)
+	if err != nil || len(results) != len(args) {
+		t.Fatalf("node: bad output %q", output)
+	}
+
+	return results
+}
+
+//
+// Test FindProxyForURL of the generated script
+//
+func TestPACScript(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node not found, PAC script can't be tested")
+	}
+
+	froxy := &Froxy{
+		Env:       &Env{state: &State{}},
+		localport: "8888",
+	}
+
+	pac := &PAC{froxy: froxy}
+	script := pac.generate([]SiteParams{
+		{Host: "exact.example.com", Type: SiteTypeDomain},
+		{Host: "rec.example.com", Type: SiteTypeDomain, Rec: true},
+		{Host: "direct.rec.example.com", Type: SiteTypeDomain,
+			Bypass: true},
+		{Host: "bypass.example.net", Type: SiteTypeDomain, Rec: true,
+			Bypass: true},
+		{Host: "ads.example.net", Type: SiteTypeDomain, Block: true},
+		{Host: "*.glob.example.org", Type: SiteTypeGlob},
+		{Host: "re[0-9]+\\.example\\.org", Type: SiteTypeRegexp},
+		{Host: "10.0.0.0/8", Type: SiteTypeCIDR},
+		{Host: "port.example.com", Type: SiteTypeDomain, Port: "8080"},
+	})
+
+	froxyProxy := "PROXY localhost:8888"
+	tests := []struct {
+		url, host, proxy string
+	}{
+		// Exact and recursive domains
+		{"http://exact.example.com/", "exact.example.com", froxyProxy},
+		{"http://EXACT.example.com/", "EXACT.example.com", froxyProxy},
+		{"http://www.exact.example.com/", "www.exact.example.com", "DIRECT"},
+		{"http://rec.example.com/", "rec.example.com", froxyProxy},
+		{"http://a.b.rec.example.com/", "a.b.rec.example.com", froxyProxy},
+		{"http://xrec.example.com/", "xrec.example.com", "DIRECT"},
+
+		// Bypassed sites are left to Froxy, if they match
+		// forwarded site, and go direct otherwise
+		{"http://direct.rec.example.com/", "direct.rec.example.com",
+			froxyProxy},
+		{"http://bypass.example.net/", "bypass.example.net", "DIRECT"},
+		{"http://www.bypass.example.net/", "www.bypass.example.net",
+			"DIRECT"},
+
+		// Blocked sites are sent to Froxy
+		{"http://ads.example.net/", "ads.example.net", froxyProxy},
+		{"http://www.ads.example.net/", "www.ads.example.net", "DIRECT"},
+
+		// Wildcards and regular expressions
+		{"http://a.glob.example.org/", "a.glob.example.org", froxyProxy},
+		{"http://glob.example.org/", "glob.example.org", "DIRECT"},
+		{"http://re42.example.org/", "re42.example.org", froxyProxy},
+		{"http://rex.example.org/", "rex.example.org", "DIRECT"},
+
+		// CIDR blocks
+		{"http://10.1.2.3/", "10.1.2.3", froxyProxy},
+		{"http://11.1.2.3/", "11.1.2.3", "DIRECT"},
+		{"http://[::1]/", "::1", "DIRECT"},
+
+		// Port constraints
+		{"http://port.example.com:8080/", "port.example.com", froxyProxy},
+		{"http://port.example.com/", "port.example.com", "DIRECT"},
+
+		// Anything else
+		{"https://example.com/", "example.com", "DIRECT"},
+	}
+
+	args := [][2]string{}
+	for _, test := range tests {
+		args = append(args, [2]string{test.url, test.host})
+	}
+
+	results := pacTestFindProxy(t, node, script, args)
+	for i, test := range tests {
+		if results[i] != test.proxy {
+			t.Errorf("%s (%s): %q expected, %q received",
+				test.url, test.host, test.proxy, results[i])
+		}
+	}
+
+	// Fallback sends everything to Froxy
+	froxy.state.Fallback = true
+	results = pacTestFindProxy(t, node, pac.generate(nil),
+		[][2]string{{"https://example.com/", "example.com"}})
+	if results[0] != froxyProxy {
+		t.Errorf("fallback: %q expected, %q received",
+			froxyProxy, results[0])
+	}
+}
@@ -0,0 +1,291 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Proxy command (OpenSSH ProxyCommand-like) connections
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexpevzner/froxy/internal/sysdep"
+)
+
+//
+// Connection to the SSH server via proxy command stdin/stdout
+//
+type proxyCommandConn struct {
+	froxy     *Froxy        // Back link to Froxy
+	command   string        // Expanded command line
+	process   *os.Process   // Command's process
+	counter   *int32        // Statistics counter
+	stdin     *os.File      // Command's stdin
+	stdout    *os.File      // Command's stdout
+	done      chan struct{} // Closed when command exits
+	lock      sync.Mutex    // Access lock
+	exitErr   error         // Command exit error
+	lastErr   string        // Last line, written to stderr
+	closeOnce sync.Once     // Close connection once
+}
+
+var _ = net.Conn(&proxyCommandConn{})
+
+//
+// Address of the proxy command connection
+//
+type proxyCommandAddr string
+
+//
+// Get network name -- implements net.Addr interface
+//
+func (addr proxyCommandAddr) Network() string {
+	return "command"
+}
+
+//
+// Get address string -- implements net.Addr interface
+//
+func (addr proxyCommandAddr) String() string {
+	return string(addr)
+}
+
+//
+// Expand the proxy command line: %h is replaced with host,
+// %p with port, %r with login and %% with %
+//
+func ProxyCommandExpand(command, addr, login string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "22"
+	}
+
+	r := strings.NewReplacer("%%", "%", "%h", host, "%p", port, "%r", login)
+	return r.Replace(command)
+}
+
+//
+// Start the proxy command and connect to its stdin/stdout
+//
+// The command runs until connection is closed or context
+// is canceled. Command's stderr goes to the log
+//
+func ProxyCommandDial(ctx context.Context, froxy *Froxy,
+	command string, counter *int32) (net.Conn, error) {
+
+	cmd := sysdep.ShellCommand(ctx, command)
+
+	// Create pipes
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return nil, err
+	}
+
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		stdoutR.Close()
+		stdoutW.Close()
+		return nil, err
+	}
+
+	cmd.Stdin = stdinR
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+
+	// Start the command. Child's ends of pipes are not needed
+	// anymore after that
+	err = cmd.Start()
+	stdinR.Close()
+	stdoutW.Close()
+	stderrW.Close()
+
+	if err != nil {
+		stdinW.Close()
+		stdoutR.Close()
+		stderrR.Close()
+		return nil, fmt.Errorf("proxy command: %s", err)
+	}
+
+	froxy.Debug("SSH: proxy command %q started", command)
+
+	conn := &proxyCommandConn{
+		froxy:   froxy,
+		command: command,
+		process: cmd.Process,
+		counter: counter,
+		stdin:   stdinW,
+		stdout:  stdoutR,
+		done:    make(chan struct{}),
+	}
+
+	froxy.IncCounter(counter)
+
+	// Copy stderr to the log
+	stderrDone := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(stderrR)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" {
+				froxy.Info("SSH: proxy command: %s", line)
+				conn.lock.Lock()
+				conn.lastErr = line
+				conn.lock.Unlock()
+			}
+		}
+		stderrR.Close()
+		close(stderrDone)
+	}()
+
+	// Wait for command termination. Command's children may
+	// still hold its stdout, so pipes are closed explicitly to
+	// let the session know that connection is lost
+	go func() {
+		err := cmd.Wait()
+
+		froxy.Debug("SSH: proxy command %q exited: %v", command, err)
+
+		select {
+		case <-stderrDone:
+		case <-time.After(SSH_COMMAND_EXIT_TIMEOUT):
+		}
+
+		conn.lock.Lock()
+		conn.exitErr = err
+		conn.lock.Unlock()
+
+		close(conn.done)
+
+		conn.stdin.Close()
+		conn.stdout.Close()
+	}()
+
+	return conn, nil
+}
+
+//
+// Read from the connection -- implements net.Conn interface
+//
+// If command has exited, the error tells why
+//
+func (conn *proxyCommandConn) Read(b []byte) (int, error) {
+	n, err := conn.stdout.Read(b)
+	if err != nil {
+		err = conn.exitError(err)
+	}
+	return n, err
+}
+
+//
+// Write to the connection -- implements net.Conn interface
+//
+func (conn *proxyCommandConn) Write(b []byte) (int, error) {
+	n, err := conn.stdin.Write(b)
+	if err != nil {
+		err = conn.exitError(err)
+	}
+	return n, err
+}
+
+//
+// Close the connection -- implements net.Conn interface
+//
+// The command is expected to exit when its stdin is closed.
+// If it doesn't, it is killed
+//
+func (conn *proxyCommandConn) Close() error {
+	conn.closeOnce.Do(func() {
+		conn.froxy.DecCounter(conn.counter)
+		conn.stdin.Close()
+		conn.stdout.Close()
+
+		go func() {
+			select {
+			case <-conn.done:
+			case <-time.After(SSH_COMMAND_EXIT_TIMEOUT):
+				conn.froxy.Debug("SSH: proxy command %q still running, killed",
+					conn.command)
+				conn.process.Kill()
+			}
+		}()
+	})
+
+	return nil
+}
+
+//
+// Convert I/O error into the command exit error, if
+// command has exited
+//
+func (conn *proxyCommandConn) exitError(err error) error {
+	select {
+	case <-conn.done:
+	case <-time.After(SSH_COMMAND_EXIT_TIMEOUT):
+		return err
+	}
+
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	switch {
+	case conn.lastErr != "":
+		return fmt.Errorf("proxy command: %s", conn.lastErr)
+	case conn.exitErr != nil:
+		return fmt.Errorf("proxy command: %s", conn.exitErr)
+	}
+
+	return fmt.Errorf("proxy command: exited")
+}
+
+//
+// Get local address -- implements net.Conn interface
+//
+func (conn *proxyCommandConn) LocalAddr() net.Addr {
+	return proxyCommandAddr("localhost")
+}
+
+//
+// Get remote address -- implements net.Conn interface
+//
+func (conn *proxyCommandConn) RemoteAddr() net.Addr {
+	return proxyCommandAddr(conn.command)
+}
+
+//
+// Set I/O deadline -- implements net.Conn interface
+//
+func (conn *proxyCommandConn) SetDeadline(t time.Time) error {
+	conn.stdin.SetWriteDeadline(t)
+	return conn.stdout.SetReadDeadline(t)
+}
+
+//
+// Set read deadline -- implements net.Conn interface
+//
+func (conn *proxyCommandConn) SetReadDeadline(t time.Time) error {
+	return conn.stdout.SetReadDeadline(t)
+}
+
+//
+// Set write deadline -- implements net.Conn interface
+//
+func (conn *proxyCommandConn) SetWriteDeadline(t time.Time) error {
+	return conn.stdin.SetWriteDeadline(t)
+}
@@ -0,0 +1,149 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Proxy command connections test
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+//
+// Host name, that proxy command helper connects to localhost.
+// It cannot be resolved, so server is reachable only via the
+// proxy command
+//
+const proxyCommandTestHost = "froxy-test.invalid"
+
+//
+// Test expansion of the proxy command line
+//
+func TestProxyCommandExpand(t *testing.T) {
+	tests := []struct {
+		command, addr, login, expanded string
+	}{
+		{"nc %h %p", "example.com:2222", "user", "nc example.com 2222"},
+		{"nc %h %p", "example.com", "user", "nc example.com 22"},
+		{"nc %h %p", "[::1]:22", "user", "nc ::1 22"},
+		{"ssh -W %h:%p %r@gw", "example.com:22", "user",
+			"ssh -W example.com:22 user@gw"},
+		{"echo 100%% %%h %x", "example.com:22", "user",
+			"echo 100% %h %x"},
+	}
+
+	for _, test := range tests {
+		expanded := ProxyCommandExpand(test.command, test.addr, test.login)
+		if expanded != test.expanded {
+			t.Errorf("%q %s %s: %q expected, %q received",
+				test.command, test.addr, test.login,
+				test.expanded, expanded)
+		}
+	}
+}
+
+//
+// Proxy command helper: when started by the test as a proxy
+// command, connects its stdin/stdout to host and port, given
+// after "--"
+//
+func TestProxyCommandHelper(t *testing.T) {
+	if os.Getenv("FROXY_TEST_PROXY_COMMAND") != "1" {
+		return
+	}
+
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+
+	if len(args) != 3 {
+		os.Exit(2)
+	}
+
+	host := args[1]
+	if host == proxyCommandTestHost {
+		host = "127.0.0.1"
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, args[2]))
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		os.Exit(1)
+	}
+
+	go io.Copy(conn, os.Stdin)
+	io.Copy(os.Stdout, conn)
+	os.Exit(0)
+}
+
+//
+// Test connection to the SSH server via the proxy command
+//
+func TestProxyCommandSession(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses /bin/sh syntax")
+	}
+
+	dir, err := ioutil.TempDir("", "froxy")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("FROXY_TEST_PROXY_COMMAND", "1")
+	defer os.Unsetenv("FROXY_TEST_PROXY_COMMAND")
+
+	l := sshTestServer(t, nil)
+	defer l.Close()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	helper := "'" + os.Args[0] + "' -test.run=TestProxyCommandHelper -- %h %p"
+
+	tests := []struct {
+		command string // Proxy command
+		err     string // Expected error, "" if none
+	}{
+		{helper, ""},
+		{"echo 'Connection refused by gateway' >&2; exit 1",
+			"proxy command: Connection refused by gateway"},
+		{"exit 3", "proxy command: exit status 3"},
+	}
+
+	for _, test := range tests {
+		servers := []ServerParams{
+			{Addr: proxyCommandTestHost + ":" + port, Login: "test",
+				Password: "test", Command: test.command},
+		}
+
+		froxy := sshTestFroxy(dir, servers)
+		tr := NewSSHTransport(froxy, "")
+
+		session, err := tr.getSession(tr.ctx)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%q: %s", test.command, err)
+		case test.err == "" && froxy.Counters.SSHSessions != 1:
+			t.Errorf("%q: session is not counted", test.command)
+		case test.err != "" && err == nil:
+			t.Errorf("%q: error expected", test.command)
+		case test.err != "" && !strings.Contains(err.Error(), test.err):
+			t.Errorf("%q: %q expected, %q received",
+				test.command, test.err, err)
+		}
+
+		if err == nil {
+			session.unref()
+		}
+
+		tr.Reconnect(nil)
+	}
+}
@@ -8,14 +8,68 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 //
 // Request router
 //
+// If multiple sites match the host, the most specific match wins.
+// Matches are ranked by RouterMatch, in order of precedence:
+//
+//   1. Exact match of host name
+//   2. Match of domain with subdomains. Longest domain wins
+//   3. Match of wildcard pattern. The pattern with most non-wildcard
+//      characters wins
+//   4. Match of regular expression
+//   5. Match of IP address against CIDR block. Longest prefix wins
+//   6. Exact match of learned host (see Env.GetLearned)
+//
+// Sites from subscriptions are ranked the same way, but only if
+// none of user's sites matches. Learned hosts are tried last
+//
+// The matched site determines the action: request is forwarded via
+// server, blocked or, if site has the Bypass flag, goes directly.
+// Bypass sites allow to make exceptions from less specific sites,
+// for example, to forward google.com with subdomains, except
+// maps.google.com
+//
+// Sites may have expiration time and weekly schedule. Such sites
+// match only while they are active (see SiteParams.Active)
+//
+// Sites may have port and scheme constraints (see SiteParams).
+// Such sites only match requests that satisfy these constraints.
+// If multiple sites have the same rank, the site with more constraints
+// wins. Otherwise, the first listed site wins
+//
+// CIDR blocks match hosts, specified by IP address. Optionally,
+// if host name doesn't match any site, it may be resolved locally,
+// and resolved addresses are matched against CIDR blocks
+// (see Env.GetResolveHosts)
+//
+// Sites from subscriptions (see Subscriptions) form the layer under
+// the user's own sites: they are only tried if none of user's sites
+// matches
+//
+// Learned hosts are hosts, for which direct access has repeatedly
+// failed, so requests were retried via server (see FallbackTransport).
+// They are forwarded to the default server, unless some site matches
+//
+// For fast lookup, list of sites is compiled into the immutable
+// routerTable, which is rebuilt when list of sites changes and
+// atomically replaced, so lookups don't need any locking
+//
 type Router struct {
-	froxy *Froxy // Back link to Froxy
+	froxy *Froxy       // Back link to Froxy
+	table atomic.Value // Current *routerTable
 }
 
 //
@@ -45,47 +99,802 @@ func (a RouterAnswer) String() string {
 	panic("internal error")
 }
 
+//
+// Kind of site match, in order of precedence
+//
+type RouterMatch int
+
+const (
+	RouterMatchExact = RouterMatch(iota)
+	RouterMatchSuffix
+	RouterMatchGlob
+	RouterMatchRegexp
+	RouterMatchCIDR
+	RouterMatchLearned
+)
+
+//
+// All kinds of site match, in order of precedence
+//
+var RouterMatchAll = []RouterMatch{
+	RouterMatchExact,
+	RouterMatchSuffix,
+	RouterMatchGlob,
+	RouterMatchRegexp,
+	RouterMatchCIDR,
+	RouterMatchLearned,
+}
+
+//
+// RouterMatch->("name", "description")
+//
+func (m RouterMatch) Strings() (string, string) {
+	switch m {
+	case RouterMatchExact:
+		return "exact", "Exact match of host name"
+	case RouterMatchSuffix:
+		return "suffix", "Domain with subdomains, longest domain wins"
+	case RouterMatchGlob:
+		return "glob", "Wildcard pattern, pattern with most non-wildcard characters wins"
+	case RouterMatchRegexp:
+		return "regexp", "Regular expression"
+	case RouterMatchCIDR:
+		return "cidr", "IP address within CIDR block, longest prefix wins"
+	case RouterMatchLearned:
+		return "learned", "Host learned after failed direct access"
+	}
+
+	panic("internal error")
+}
+
 //
 // Create new router
 //
 func NewRouter(froxy *Froxy) *Router {
-	return &Router{
+	r := &Router{
 		froxy: froxy,
 	}
+
+	events := froxy.Sub(EventSitesChanged, EventLearnedChanged)
+	r.rebuild()
+
+	go r.goroutine(events)
+
+	return r
 }
 
 //
-// Route the URL. Returns true if site must be routed via server,
-// false if site must be accessed directly
+// Router goroutine. Rebuilds routerTable when list of sites
+// or learned hosts changes
 //
-func (r *Router) Route(host string) (answer RouterAnswer) {
-	sites := r.froxy.GetSites()
-	found := (*SiteParams)(nil)
+func (r *Router) goroutine(events <-chan Event) {
+	for range events {
+		r.rebuild()
+	}
+}
+
+//
+// Rebuild the routerTable
+//
+func (r *Router) rebuild() {
+	table := newRouterTable(r.froxy.Env, r.froxy.GetSites())
+	if subscribed := r.froxy.subs.Sites(); len(subscribed) != 0 {
+		table.under = newRouterTable(r.froxy.Env, subscribed)
+	}
+	table.resolve = r.froxy.GetResolveHosts()
+	table.addLearned(r.froxy.GetLearned())
+	r.table.Store(table)
+}
+
+//
+// Route the request. Returns router answer, transport to use
+// and the matched site, if any
+//
+// For RouterForward, returned transport may be nil, if site refers
+// not configured server. For RouterBlock, transport is always nil
+//
+func (r *Router) Route(rq *http.Request) (answer RouterAnswer,
+	transport Transport, site *SiteParams) {
+
+	host, port, scheme := RouterRequestParams(rq)
+
+	table := r.table.Load().(*routerTable)
+	site, match, ip := r.lookup(table, host, port, scheme)
+	answer, transport = r.answer(site)
+
+	// Formatting of the reason allocates memory, so it is
+	// skipped if debug messages are not logged
+	if r.froxy.Enabled(LogLevelDebug) {
+		r.froxy.Debug("router: %s %s:%s: %s, %s", scheme, host, port,
+			answer, routerReason(site, match, ip))
+	}
+
+	return
+}
+
+//
+// Lookup the host in the routerTable. If host is resolved, the
+// address that matched CIDR block is returned as well
+//
+func (r *Router) lookup(table *routerTable, host, port string,
+	scheme SiteScheme) (*SiteParams, RouterMatch, net.IP) {
+
+	found, match := table.Lookup(host, port, scheme)
+
+	if found == nil && table.resolve && table.hasCIDRs() &&
+		routerParseIP(host) == nil {
+		return r.resolve(table, host, port, scheme)
+	}
+
+	return found, match, nil
+}
+
+//
+// Make routing decision for the found site. Returns router
+// answer and transport to use
+//
+func (r *Router) answer(found *SiteParams) (RouterAnswer, Transport) {
+	switch {
+	case found == nil || found.Bypass:
+		return RouterBypass, r.froxy.directTransport
+	case found.Block:
+		return RouterBlock, nil
+	}
+
+	return RouterForward, r.froxy.ServerTransport(found.Server)
+}
+
+//
+// Get request parameters, used for routing: host name,
+// converted to lower case, port and scheme. If port is
+// not specified, the scheme default is used
+//
+func RouterRequestParams(rq *http.Request) (host, port string, scheme SiteScheme) {
+	scheme = SiteSchemeHTTP
+	defport := "80"
+
+	switch {
+	case rq.Method == http.MethodConnect:
+		scheme = SiteSchemeConnect
+		defport = "443"
+	case rq.URL.Scheme == "ftp":
+		scheme = SiteSchemeFTP
+		defport = "21"
+	case rq.URL.Scheme == "https":
+		defport = "443"
+	}
+
+	host, port = NetSplitHostPort(strings.ToLower(rq.Host), defport)
+	return
+}
+
+//
+// Resolve the host name and match resolved addresses
+// against CIDR blocks
+//
+func (r *Router) resolve(table *routerTable, host, port string,
+	scheme SiteScheme) (*SiteParams, RouterMatch, net.IP) {
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		ROUTER_RESOLVE_TIMEOUT)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		r.froxy.Debug("router: %s", err)
+		return nil, 0, nil
+	}
+
+	for _, addr := range addrs {
+		site, match := table.LookupIP(addr.IP, port, scheme)
+		if site != nil {
+			r.froxy.Debug("router: %s resolved to %s, matches %s",
+				host, addr.IP, site.Host)
+			return site, match, addr.IP
+		}
+	}
+
+	return nil, 0, nil
+}
+
+// ----- Compiled table of sites -----
+//
+// Compiled table of sites
+//
+// Domains are organized into the trie, indexed by domain labels,
+// starting from the top-level domain. Wildcard patterns and CIDR
+// blocks are sorted by specificity, regular expressions are precompiled
+//
+// Sites of the same rank are ordered by count of constraints,
+// so sites with more constraints are tried first
+//
+type routerTable struct {
+	root    routerNode             // Root of domains trie
+	globs   []*SiteParams          // Wildcard patterns, most specific first
+	regexps []routerRegexp         // Regular expressions, in order of sites
+	cidrs   []routerCIDR           // CIDR blocks, longest prefix first
+	learned map[string]*SiteParams // Learned hosts
+	under   *routerTable           // Sites from subscriptions, if any
+	resolve bool                   // Resolve hosts, see Env.GetResolveHosts
+	timed   bool                   // Some sites are timed
+}
+
+//
+// Node of domains trie
+//
+type routerNode struct {
+	children map[string]*routerNode // Child nodes, by label
+	exact    []*SiteParams          // Sites with exactly this domain
+	rec      []*SiteParams          // Sites with this domain and subdomains
+}
+
+//
+// Compiled regular expression
+//
+type routerRegexp struct {
+	site *SiteParams    // The site
+	re   *regexp.Regexp // Compiled SiteParams.Host
+}
+
+//
+// Parsed CIDR block
+//
+type routerCIDR struct {
+	site *SiteParams // The site
+	net  *net.IPNet  // Parsed SiteParams.Host
+	ones int         // Prefix length
+}
+
+//
+// Create new routerTable
+//
+func newRouterTable(env *Env, sites []SiteParams) *routerTable {
+	table := &routerTable{}
+	nodes := []*routerNode{}
+
+	for i := range sites {
+		site := &sites[i]
+		if site.Timed() {
+			table.timed = true
+		}
+
+		switch site.Type {
+		case SiteTypeDomain:
+			node := table.root.add(site.Host)
+			if node.exact == nil && node.rec == nil {
+				nodes = append(nodes, node)
+			}
+
+			node.exact = append(node.exact, site)
+			if site.Rec {
+				node.rec = append(node.rec, site)
+			}
+
+		case SiteTypeGlob:
+			table.globs = append(table.globs, site)
+
+		case SiteTypeRegexp:
+			re, err := SiteRegexpCompile(site.Host)
+			if err != nil {
+				env.Debug("invalid site regexp %q: %s", site.Host, err)
+				continue
+			}
+
+			table.regexps = append(table.regexps, routerRegexp{site, re})
+
+		case SiteTypeCIDR:
+			_, cidr, err := net.ParseCIDR(site.Host)
+			if err != nil {
+				env.Debug("invalid site CIDR %q: %s", site.Host, err)
+				continue
+			}
+
+			ones, _ := cidr.Mask.Size()
+			table.cidrs = append(table.cidrs, routerCIDR{site, cidr, ones})
+		}
+	}
+
+	// Sort everything by specificity
+	for _, node := range nodes {
+		routerSortSites(node.exact)
+		routerSortSites(node.rec)
+	}
+
+	sort.SliceStable(table.globs, func(i, j int) bool {
+		l1 := wildcardLiterals(table.globs[i].Host)
+		l2 := wildcardLiterals(table.globs[j].Host)
+		return l1 > l2 || (l1 == l2 &&
+			table.globs[i].Constraints() > table.globs[j].Constraints())
+	})
+
+	sort.SliceStable(table.regexps, func(i, j int) bool {
+		return table.regexps[i].site.Constraints() >
+			table.regexps[j].site.Constraints()
+	})
+
+	sort.SliceStable(table.cidrs, func(i, j int) bool {
+		c1, c2 := &table.cidrs[i], &table.cidrs[j]
+		return c1.ones > c2.ones || (c1.ones == c2.ones &&
+			c1.site.Constraints() > c2.site.Constraints())
+	})
+
+	return table
+}
+
+//
+// Add learned hosts to the table. Only hosts that are
+// actually learned (see LearnedSite.Learned) are added
+//
+func (table *routerTable) addLearned(learned []LearnedSite) {
+	for _, l := range learned {
+		if l.Learned() {
+			if table.learned == nil {
+				table.learned = make(map[string]*SiteParams)
+			}
+			table.learned[l.Host] = &SiteParams{Host: l.Host}
+		}
+	}
+}
+
+//
+// Sort sites of the same rank by count of constraints
+//
+func routerSortSites(sites []*SiteParams) {
+	sort.SliceStable(sites, func(i, j int) bool {
+		return sites[i].Constraints() > sites[j].Constraints()
+	})
+}
+
+//
+// Get current time, if table contains timed sites. Otherwise,
+// zero time is returned, so time.Now() is not called in vain
+//
+func (table *routerTable) now() time.Time {
+	if table.timed {
+		return time.Now()
+	}
+	return time.Time{}
+}
+
+//
+// Check if site matches port and scheme and is active
+//
+func routerMatchSite(site *SiteParams, port string, scheme SiteScheme,
+	now time.Time) bool {
+
+	return site.MatchConstraints(port, scheme) &&
+		(!site.Timed() || site.Active(now))
+}
+
+//
+// Select first site that matches port and scheme and is active
+//
+func routerSelectSite(sites []*SiteParams, port string,
+	scheme SiteScheme, now time.Time) *SiteParams {
 
 	for _, site := range sites {
-		if site.Host == host {
-			found = &site
-			break
+		if routerMatchSite(site, port, scheme, now) {
+			return site
 		}
+	}
 
-		if site.Rec &&
-			strings.HasSuffix(host, site.Host) &&
-			host[len(host)-len(site.Host)-1] == '.' {
+	return nil
+}
 
-			// More specific match wins
-			if found == nil || len(found.Host) < len(site.Host) {
-				found = &site
+//
+// Add domain to the trie. Returns node that corresponds
+// to the domain
+//
+func (node *routerNode) add(domain string) *routerNode {
+	for end := len(domain); end >= 0; {
+		dot := strings.LastIndexByte(domain[:end], '.')
+		label := domain[dot+1 : end]
+
+		next := node.children[label]
+		if next == nil {
+			if node.children == nil {
+				node.children = make(map[string]*routerNode)
 			}
+			next = &routerNode{}
+			node.children[label] = next
 		}
+
+		node = next
+		end = dot
+	}
+
+	return node
+}
+
+//
+// Lookup the host. Returns the most specific matching site, if any,
+// and kind of match
+//
+// This function doesn't allocate memory, unless host is
+// the IP address and there are CIDR blocks to match against
+//
+func (table *routerTable) Lookup(host, port string,
+	scheme SiteScheme) (*SiteParams, RouterMatch) {
+
+	site, match := table.lookupSites(host, port, scheme)
+
+	if site == nil && table.under != nil {
+		site, match = table.under.lookupSites(host, port, scheme)
+	}
+
+	if site == nil {
+		if l := table.learned[host]; l != nil {
+			site, match = l, RouterMatchLearned
+		}
+	}
+
+	return site, match
+}
+
+//
+// Lookup the host in sites of this table only, without
+// subscriptions and learned hosts
+//
+func (table *routerTable) lookupSites(host, port string,
+	scheme SiteScheme) (*SiteParams, RouterMatch) {
+
+	now := table.now()
+
+	// Walk the trie, from the top-level domain
+	node := &table.root
+	found := (*SiteParams)(nil)
+
+	for end := len(host); end >= 0; {
+		dot := strings.LastIndexByte(host[:end], '.')
+		label := host[dot+1 : end]
+
+		node = node.children[label]
+		if node == nil {
+			break
+		}
+
+		if dot < 0 {
+			// Entire host matched
+			site := routerSelectSite(node.exact, port, scheme, now)
+			if site != nil {
+				return site, RouterMatchExact
+			}
+		} else if site := routerSelectSite(node.rec, port, scheme, now); site != nil {
+			// Deeper nodes are more specific
+			found = site
+		}
+
+		end = dot
 	}
 
 	if found != nil {
-		if found.Block {
-			return RouterBlock
-		} else {
-			return RouterForward
+		return found, RouterMatchSuffix
+	}
+
+	// Try wildcard patterns
+	for _, site := range table.globs {
+		if routerMatchSite(site, port, scheme, now) &&
+			wildcardMatch(site.Host, host) {
+			return site, RouterMatchGlob
+		}
+	}
+
+	// Try regular expressions
+	for _, re := range table.regexps {
+		if routerMatchSite(re.site, port, scheme, now) &&
+			re.re.MatchString(host) {
+			return re.site, RouterMatchRegexp
+		}
+	}
+
+	// Try CIDR blocks
+	if len(table.cidrs) != 0 {
+		if ip := routerParseIP(host); ip != nil {
+			return table.lookupIP(ip, port, scheme)
+		}
+	}
+
+	return nil, 0
+}
+
+//
+// Lookup the IP address in CIDR blocks
+//
+func (table *routerTable) LookupIP(ip net.IP, port string,
+	scheme SiteScheme) (*SiteParams, RouterMatch) {
+
+	site, match := table.lookupIP(ip, port, scheme)
+	if site == nil && table.under != nil {
+		site, match = table.under.lookupIP(ip, port, scheme)
+	}
+
+	return site, match
+}
+
+//
+// Lookup the IP address in CIDR blocks of this table only
+//
+func (table *routerTable) lookupIP(ip net.IP, port string,
+	scheme SiteScheme) (*SiteParams, RouterMatch) {
+
+	now := table.now()
+	for _, cidr := range table.cidrs {
+		if routerMatchSite(cidr.site, port, scheme, now) &&
+			cidr.net.Contains(ip) {
+			return cidr.site, RouterMatchCIDR
+		}
+	}
+
+	return nil, 0
+}
+
+//
+// Check if table or subscriptions contain CIDR blocks
+//
+func (table *routerTable) hasCIDRs() bool {
+	return len(table.cidrs) != 0 ||
+		(table.under != nil && len(table.under.cidrs) != 0)
+}
+
+//
+// Parse host as IP address. IPv6 address may be enclosed
+// into square brackets. Returns nil if host is not an IP address
+//
+func routerParseIP(host string) net.IP {
+	switch {
+	case strings.IndexByte(host, ':') >= 0:
+		// Looks like IPv6 address
+	case host != "" && '0' <= host[0] && host[0] <= '9':
+		// Looks like IPv4 address
+	default:
+		return nil
+	}
+
+	if len(host) > 2 && host[0] == '[' && host[len(host)-1] == ']' {
+		host = host[1 : len(host)-1]
+	}
+
+	return net.ParseIP(host)
+}
+
+// ----- Routing explanation -----
+//
+// Explanation of the routing decision, for diagnostics
+//
+type RouterExplanation struct {
+	Host       string            // Host name
+	Port       string            // Port
+	Scheme     SiteScheme        // Scheme
+	Answer     RouterAnswer      // Routing decision
+	Site       *SiteParams       // Matched site, nil if none
+	Match      RouterMatch       // Kind of match, if Site != nil
+	Subscribed bool              // Site comes from subscription
+	Resolved   net.IP            // Resolved address that matched, if any
+	Reason     string            // Why the decision was made
+	Candidates []RouterCandidate // Other sites that were considered
+}
+
+//
+// Site that was considered, but didn't win
+//
+type RouterCandidate struct {
+	Site       *SiteParams // The site
+	Match      RouterMatch // Kind of match
+	Subscribed bool        // Site comes from subscription
+	Reason     string      // Why the site didn't win
+}
+
+//
+// Explain routing decision for the host, port and scheme
+//
+// Host must be in lower case and IDN-encoded. If port is "",
+// the scheme default is used
+//
+func (r *Router) Explain(host, port string, scheme SiteScheme) *RouterExplanation {
+	if port == "" {
+		switch scheme {
+		case SiteSchemeConnect:
+			port = "443"
+		case SiteSchemeFTP:
+			port = "21"
+		default:
+			port = "80"
+		}
+	}
+
+	table := r.table.Load().(*routerTable)
+	found, match, ip := r.lookup(table, host, port, scheme)
+
+	ex := &RouterExplanation{
+		Host:     host,
+		Port:     port,
+		Scheme:   scheme,
+		Site:     found,
+		Match:    match,
+		Resolved: ip,
+	}
+
+	ex.Answer, _ = r.answer(found)
+
+	if ip == nil {
+		ip = routerParseIP(host)
+	}
+
+	candidates := table.Candidates(host, ip)
+	for _, c := range candidates {
+		if c.Site == found {
+			ex.Subscribed = c.Subscribed
+		}
+	}
+
+	ex.Reason = routerReason(found, match, ip)
+	if ex.Subscribed {
+		ex.Reason += ", from subscription"
+	}
+
+	for _, c := range candidates {
+		if c.Site != found {
+			c.Reason = routerLoseReason(ex, c)
+			ex.Candidates = append(ex.Candidates, c)
+		}
+	}
+
+	return ex
+}
+
+//
+// Explain why the site was selected
+//
+func routerReason(found *SiteParams, match RouterMatch, ip net.IP) string {
+	if found == nil {
+		return "no site matches"
+	}
+
+	name, _ := match.Strings()
+	reason := fmt.Sprintf("%s match of %s", name, found.Host)
+
+	if ip != nil {
+		reason += fmt.Sprintf(" (host resolved to %s)", ip)
+	}
+
+	return reason
+}
+
+//
+// Explain why the candidate didn't win over the found site
+//
+func routerLoseReason(ex *RouterExplanation, c RouterCandidate) string {
+	found, match := ex.Site, ex.Match
+	site := c.Site
+
+	switch {
+	case site.Port != "" && site.Port != ex.Port:
+		return fmt.Sprintf("port %s doesn't match", site.Port)
+	case site.Scheme != "" && site.Scheme != ex.Scheme:
+		return fmt.Sprintf("scheme %s doesn't match", site.Scheme)
+	case !site.Active(time.Now()):
+		return "site is not active now (expired or out of schedule)"
+	case found == nil:
+		return "invalid site"
+	case c.Subscribed && !ex.Subscribed && match != RouterMatchLearned:
+		return "user's sites take precedence over subscriptions"
+	case c.Match != match:
+		name1, _ := match.Strings()
+		name2, _ := c.Match.Strings()
+		return fmt.Sprintf("%s match takes precedence over %s match",
+			name1, name2)
+	}
+
+	// Same rank
+	switch match {
+	case RouterMatchSuffix:
+		if len(found.Host) > len(site.Host) {
+			return "longer domain wins"
+		}
+	case RouterMatchGlob:
+		if wildcardLiterals(found.Host) > wildcardLiterals(site.Host) {
+			return "pattern with more non-wildcard characters wins"
+		}
+	case RouterMatchCIDR:
+		_, net1, err1 := net.ParseCIDR(found.Host)
+		_, net2, err2 := net.ParseCIDR(site.Host)
+		if err1 == nil && err2 == nil {
+			ones1, _ := net1.Mask.Size()
+			ones2, _ := net2.Mask.Size()
+			if ones1 > ones2 {
+				return "longer prefix wins"
+			}
+		}
+	}
+
+	if found.Constraints() > site.Constraints() {
+		return "site with more port and scheme constraints wins"
+	}
+
+	return "first listed site wins"
+}
+
+//
+// Get all sites that match the host, ignoring port and scheme
+// constraints. If ip is not nil, it is matched against CIDR blocks
+//
+// This function is slow and intended for diagnostics only
+//
+func (table *routerTable) Candidates(host string, ip net.IP) []RouterCandidate {
+	candidates := table.candidates(host, ip)
+
+	if table.under != nil {
+		for _, c := range table.under.candidates(host, ip) {
+			c.Subscribed = true
+			candidates = append(candidates, c)
+		}
+	}
+
+	if site := table.learned[host]; site != nil {
+		candidates = append(candidates,
+			RouterCandidate{Site: site, Match: RouterMatchLearned})
+	}
+
+	return candidates
+}
+
+//
+// Get matching sites of this table only, without subscriptions
+// and learned hosts
+//
+func (table *routerTable) candidates(host string, ip net.IP) []RouterCandidate {
+	candidates := []RouterCandidate{}
+	add := func(sites []*SiteParams, match RouterMatch) {
+		for _, site := range sites {
+			candidates = append(candidates,
+				RouterCandidate{Site: site, Match: match})
+		}
+	}
+
+	// Collect domains, from the most specific
+	node := &table.root
+	nodes := []*routerNode{}
+
+	for end := len(host); end >= 0 && node != nil; {
+		dot := strings.LastIndexByte(host[:end], '.')
+		node = node.children[host[dot+1:end]]
+
+		if node != nil {
+			if dot < 0 {
+				add(node.exact, RouterMatchExact)
+			} else {
+				nodes = append(nodes, node)
+			}
+		}
+
+		end = dot
+	}
+
+	for i := len(nodes) - 1; i >= 0; i-- {
+		add(nodes[i].rec, RouterMatchSuffix)
+	}
+
+	// Collect patterns and regular expressions
+	for _, site := range table.globs {
+		if wildcardMatch(site.Host, host) {
+			add([]*SiteParams{site}, RouterMatchGlob)
+		}
+	}
+
+	for _, re := range table.regexps {
+		if re.re.MatchString(host) {
+			add([]*SiteParams{re.site}, RouterMatchRegexp)
+		}
+	}
+
+	// Collect CIDR blocks
+	if ip != nil {
+		for _, cidr := range table.cidrs {
+			if cidr.net.Contains(ip) {
+				add([]*SiteParams{cidr.site}, RouterMatchCIDR)
+			}
 		}
 	}
 
-	return RouterBypass
+	return candidates
 }
@@ -0,0 +1,291 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Router test
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+)
+
+//
+// Reference implementation of routerTable.Lookup: a linear scan
+// through the list of sites, which checks each site in turn
+//
+func routerLinearLookup(sites []SiteParams, host string) (*SiteParams, RouterMatch) {
+	var found *SiteParams
+	var match RouterMatch
+	var weight int
+
+	for i := range sites {
+		site := &sites[i]
+		var m RouterMatch
+		var w int
+
+		switch site.Type {
+		case SiteTypeDomain:
+			switch {
+			case site.Host == host:
+				m = RouterMatchExact
+			case site.Rec && strings.HasSuffix(host, "."+site.Host):
+				m, w = RouterMatchSuffix, len(site.Host)
+			default:
+				continue
+			}
+
+		case SiteTypeGlob:
+			if !wildcardMatch(site.Host, host) {
+				continue
+			}
+			m, w = RouterMatchGlob, wildcardLiterals(site.Host)
+
+		case SiteTypeRegexp:
+			re, err := SiteRegexpCompile(site.Host)
+			if err != nil || !re.MatchString(host) {
+				continue
+			}
+			m = RouterMatchRegexp
+		}
+
+		if found == nil || m < match || (m == match && w > weight) {
+			found, match, weight = site, m, w
+		}
+	}
+
+	return found, match
+}
+
+//
+// Generate list of n random sites
+//
+func routerTestSites(rnd *rand.Rand, n int) []SiteParams {
+	sites := make([]SiteParams, n)
+	for i := range sites {
+		sites[i] = SiteParams{
+			Host: routerTestHost(rnd),
+			Rec:  rnd.Intn(2) == 0,
+		}
+	}
+	return sites
+}
+
+//
+// Generate random host name
+//
+func routerTestHost(rnd *rand.Rand) string {
+	tlds := []string{"com", "net", "org", "ru"}
+	host := tlds[rnd.Intn(len(tlds))]
+
+	for i := rnd.Intn(3) + 1; i > 0; i-- {
+		host = fmt.Sprintf("d%d.%s", rnd.Intn(50), host)
+	}
+
+	return host
+}
+
+//
+// Test that routerTable.Lookup agrees with the linear scan
+//
+func TestRouterTable(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	sites := routerTestSites(rnd, 2000)
+	sites = append(sites,
+		SiteParams{Host: "*.d1.com", Type: SiteTypeGlob},
+		SiteParams{Host: "d?.d2.net", Type: SiteTypeGlob},
+		SiteParams{Host: "d1*.org", Type: SiteTypeGlob},
+		SiteParams{Host: `d[0-9]+\.ru`, Type: SiteTypeRegexp},
+		SiteParams{Host: `.*\.d4[0-9]\.com`, Type: SiteTypeRegexp},
+	)
+
+	table := newRouterTable(&Env{}, sites)
+
+	for i := 0; i < 20000; i++ {
+		host := routerTestHost(rnd)
+
+		site1, match1 := table.Lookup(host, "80", SiteSchemeHTTP)
+		site2, match2 := routerLinearLookup(sites, host)
+
+		if site1 != site2 || match1 != match2 {
+			t.Fatalf("%s: trie %v/%d, linear %v/%d",
+				host, site1, match1, site2, match2)
+		}
+	}
+}
+
+//
+// Test that routerTable.Lookup doesn't allocate memory
+//
+func TestRouterTableAllocs(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	table := newRouterTable(&Env{}, routerTestSites(rnd, 1000))
+	host := "d1.d2.d3.example.com"
+
+	allocs := testing.AllocsPerRun(100, func() {
+		table.Lookup(host, "80", SiteSchemeHTTP)
+	})
+
+	if allocs != 0 {
+		t.Fatalf("routerTable.Lookup: %v allocations per call", allocs)
+	}
+}
+
+//
+// Benchmark lookup in the list of 100k sites, using linear scan
+//
+func BenchmarkRouterLinear100k(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	sites := routerTestSites(rnd, 100000)
+	hosts := make([]string, 1024)
+	for i := range hosts {
+		hosts[i] = routerTestHost(rnd)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		routerLinearLookup(sites, hosts[i%len(hosts)])
+	}
+}
+
+//
+// Benchmark lookup in the list of 100k sites, using compiled table
+//
+func BenchmarkRouterTable100k(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	table := newRouterTable(&Env{}, routerTestSites(rnd, 100000))
+	hosts := make([]string, 1024)
+	for i := range hosts {
+		hosts[i] = routerTestHost(rnd)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.Lookup(hosts[i%len(hosts)], "80", SiteSchemeHTTP)
+	}
+}
+
+//
+// Test matching of IP addresses against CIDR blocks
+//
+func TestRouterCIDR(t *testing.T) {
+	sites := []SiteParams{
+		{Host: "10.0.0.0/8", Type: SiteTypeCIDR},
+		{Host: "10.1.0.0/16", Type: SiteTypeCIDR, Block: true},
+		{Host: "10.1.2.0/24", Type: SiteTypeCIDR, Port: "443"},
+		{Host: "2001:db8::/32", Type: SiteTypeCIDR},
+		{Host: "10.9.9.9", Type: SiteTypeDomain},
+	}
+
+	table := newRouterTable(&Env{}, sites)
+
+	tests := []struct {
+		host  string
+		port  string
+		site  *SiteParams
+		match RouterMatch
+	}{
+		{"10.2.3.4", "80", &sites[0], RouterMatchCIDR},
+		{"10.1.3.4", "80", &sites[1], RouterMatchCIDR},
+		{"10.1.2.3", "443", &sites[2], RouterMatchCIDR},
+		{"10.1.2.3", "80", &sites[1], RouterMatchCIDR},
+		{"2001:db8::1", "80", &sites[3], RouterMatchCIDR},
+		{"[2001:db8::1]", "80", &sites[3], RouterMatchCIDR},
+		{"10.9.9.9", "80", &sites[4], RouterMatchExact},
+		{"11.1.2.3", "80", nil, 0},
+		{"2001:db9::1", "80", nil, 0},
+		{"10.example.com", "80", nil, 0},
+	}
+
+	for _, test := range tests {
+		site, match := table.Lookup(test.host, test.port, SiteSchemeHTTP)
+		if site != test.site || (site != nil && match != test.match) {
+			t.Errorf("%s:%s: %+v/%d expected, %+v/%d received",
+				test.host, test.port, test.site, test.match,
+				site, match)
+		}
+	}
+}
+
+//
+// Test matching of resolved host addresses against CIDR blocks
+//
+func TestRouterResolve(t *testing.T) {
+	addrs, err := net.LookupIP("localhost")
+	if err != nil || len(addrs) == 0 {
+		t.Skip("localhost can't be resolved")
+	}
+
+	sites := []SiteParams{
+		{Host: "127.0.0.0/8", Type: SiteTypeCIDR},
+		{Host: "::1/128", Type: SiteTypeCIDR},
+		{Host: "example.com", Type: SiteTypeDomain, Block: true},
+	}
+
+	r := &Router{froxy: &Froxy{Env: &Env{}}}
+	table := newRouterTable(&Env{}, sites)
+
+	// Resolving disabled
+	site, _, ip := r.lookup(table, "localhost", "80", SiteSchemeHTTP)
+	if site != nil || ip != nil {
+		t.Errorf("resolving disabled: localhost matches %+v (%s)", site, ip)
+	}
+
+	// Resolving enabled
+	table.resolve = true
+	site, match, ip := r.lookup(table, "localhost", "80", SiteSchemeHTTP)
+	if site == nil || match != RouterMatchCIDR || !ip.IsLoopback() {
+		t.Errorf("resolving enabled: localhost matches %+v/%d (%s)",
+			site, match, ip)
+	}
+
+	// Hosts, matched by name, are not resolved
+	site, match, ip = r.lookup(table, "example.com", "80", SiteSchemeHTTP)
+	if site != &sites[2] || match != RouterMatchExact || ip != nil {
+		t.Errorf("example.com matches %+v/%d (%s)", site, match, ip)
+	}
+}
+
+//
+// Test that bypassed sites make exceptions from less specific sites
+//
+func TestRouterBypass(t *testing.T) {
+	r := &Router{froxy: &Froxy{Env: &Env{}}}
+	table := newRouterTable(&Env{}, []SiteParams{
+		{Host: "example.com", Rec: true},
+		{Host: "maps.example.com", Bypass: true},
+		{Host: "cdn.example.com", Rec: true, Bypass: true},
+		{Host: "static.cdn.example.com"},
+		{Host: "*.ads.example.net", Type: SiteTypeGlob, Block: true},
+		{Host: "ok.ads.example.net", Bypass: true},
+	})
+
+	tests := []struct {
+		host   string
+		answer RouterAnswer
+	}{
+		{"www.example.com", RouterForward},
+		{"maps.example.com", RouterBypass},
+		{"www.maps.example.com", RouterForward},
+		{"a.cdn.example.com", RouterBypass},
+		{"static.cdn.example.com", RouterForward},
+		{"x.ads.example.net", RouterBlock},
+		{"ok.ads.example.net", RouterBypass},
+		{"example.org", RouterBypass},
+	}
+
+	for _, test := range tests {
+		site, _ := table.Lookup(test.host, "80", SiteSchemeHTTP)
+		answer, _ := r.answer(site)
+		if answer != test.answer {
+			t.Errorf("%s: %s expected, %s received (site %+v)",
+				test.host, test.answer, answer, site)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Scheduled and expiring sites
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+//
+// Weekly time window, when site is active. The syntax is:
+//
+//     [days] HH:MM-HH:MM
+//
+// Days is the comma-separated list of days of week (sun, mon, tue,
+// wed, thu, fri, sat) or ranges of days (like mon-fri). If days are
+// omitted, window applies to every day. Time is local
+//
+// If end time is less than start time, window crosses midnight and
+// ends at the next day. If start and end times are equal, window
+// lasts the entire day
+//
+// For example:
+//
+//     mon-fri 09:00-18:00
+//     sat,sun 22:00-06:00
+//
+type SiteWindow string
+
+//
+// Names of days of week, in order of time.Weekday
+//
+var siteWindowDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+//
+// Check window syntax
+//
+func (w SiteWindow) Check() error {
+	_, _, _, ok := w.parse()
+	if !ok {
+		return fmt.Errorf("Invalid schedule %q", w)
+	}
+	return nil
+}
+
+//
+// Check if window contains the given time
+//
+// This function doesn't allocate memory, so it is safe to be
+// used by routerTable.Lookup
+//
+func (w SiteWindow) Match(t time.Time) bool {
+	days, from, to, ok := w.parse()
+	if !ok {
+		return false
+	}
+
+	day := uint(t.Weekday())
+	hour, min, _ := t.Clock()
+	now := hour*60 + min
+
+	today := days&(1<<day) != 0
+	yesterday := days&(1<<((day+6)%7)) != 0
+
+	switch {
+	case from == to:
+		return today
+	case from < to:
+		return today && from <= now && now < to
+	}
+
+	return (today && now >= from) || (yesterday && now < to)
+}
+
+//
+// Parse the window. Returns bitmask of days (bit 0 is Sunday),
+// start and end time in minutes since midnight
+//
+func (w SiteWindow) parse() (days uint, from, to int, ok bool) {
+	s := strings.TrimSpace(string(w))
+
+	days = 0x7f
+	if i := strings.LastIndexByte(s, ' '); i >= 0 {
+		days, ok = siteParseDays(strings.TrimSpace(s[:i]))
+		if !ok {
+			return
+		}
+		s = s[i+1:]
+	}
+
+	i := strings.IndexByte(s, '-')
+	if i < 0 {
+		return 0, 0, 0, false
+	}
+
+	from, ok = siteParseClock(s[:i])
+	if ok {
+		to, ok = siteParseClock(s[i+1:])
+	}
+
+	return
+}
+
+//
+// Parse comma-separated list of days or ranges of days
+//
+func siteParseDays(s string) (days uint, ok bool) {
+	for s != "" {
+		item := s
+		if i := strings.IndexByte(s, ','); i >= 0 {
+			item, s = s[:i], s[i+1:]
+		} else {
+			s = ""
+		}
+
+		first, last := item, item
+		if i := strings.IndexByte(item, '-'); i >= 0 {
+			first, last = item[:i], item[i+1:]
+		}
+
+		d1, d2 := siteParseDay(first), siteParseDay(last)
+		if d1 < 0 || d2 < 0 {
+			return 0, false
+		}
+
+		for d := d1; ; d = (d + 1) % 7 {
+			days |= 1 << uint(d)
+			if d == d2 {
+				break
+			}
+		}
+	}
+
+	return days, days != 0
+}
+
+//
+// Parse day of week. Returns -1 on error
+//
+func siteParseDay(s string) int {
+	s = strings.TrimSpace(s)
+	for i, name := range siteWindowDays {
+		if strings.EqualFold(s, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+//
+// Parse time of day (HH:MM). Returns minutes since midnight
+//
+func siteParseClock(s string) (int, bool) {
+	s = strings.TrimSpace(s)
+
+	i := strings.IndexByte(s, ':')
+	if i < 1 || i > 2 || len(s)-i != 3 {
+		return 0, false
+	}
+
+	hour, min := 0, 0
+	for _, c := range s[:i] {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		hour = hour*10 + int(c-'0')
+	}
+
+	for _, c := range s[i+1:] {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		min = min*10 + int(c-'0')
+	}
+
+	if hour > 24 || min > 59 || (hour == 24 && min != 0) {
+		return 0, false
+	}
+
+	return hour*60 + min, true
+}
+
+// ----- Sites expiration -----
+//
+// Sites expiration goroutine. Removes expired sites and
+// raises EventSitesChanged
+//
+func (froxy *Froxy) expireGoroutine() {
+	events := froxy.Sub(EventSitesChanged)
+	timer := time.NewTimer(0)
+
+	for {
+		select {
+		case <-events:
+		case <-timer.C:
+		}
+
+		expired, next := froxy.ExpireSites(time.Now())
+		for _, site := range expired {
+			froxy.Info("site %s expired", site.Host)
+		}
+
+		if len(expired) != 0 {
+			froxy.Raise(EventSitesChanged)
+		}
+
+		timer.Stop()
+		select {
+		case <-timer.C:
+		default:
+		}
+
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
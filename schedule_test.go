@@ -0,0 +1,236 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Scheduled and expiring sites test
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//
+// Make local time at the given day of week and time of day.
+// January 1, 2024 is Monday
+//
+func scheduleTestTime(day time.Weekday, hour, min int) time.Time {
+	mday := 1 + (int(day)+6)%7
+	return time.Date(2024, time.January, mday, hour, min, 0, 0, time.Local)
+}
+
+//
+// Test syntax check of time windows
+//
+func TestSiteWindowCheck(t *testing.T) {
+	valid := []SiteWindow{
+		"09:00-18:00",
+		"9:00-18:00",
+		"mon-fri 09:00-18:00",
+		"MON-FRI 09:00-18:00",
+		"sat,sun 22:00-06:00",
+		"sat, sun 22:00-06:00",
+		"fri-mon 00:00-24:00",
+		"mon,wed-thu,sat 12:00-13:00",
+		"sun 00:00-00:00",
+		"  tue 10:00-11:00  ",
+		"22:00-24:00",
+	}
+
+	invalid := []SiteWindow{
+		"",
+		"mon",
+		"mon-fri",
+		"09:00",
+		"9-18",
+		"09:00-",
+		"-18:00",
+		"09:00-18:00-20:00",
+		"25:00-26:00",
+		"24:01-10:00",
+		"09:60-10:00",
+		"090:00-10:00",
+		"09:0-10:00",
+		"0a:00-10:00",
+		"mon-xyz 09:00-10:00",
+		"mon,,tue 09:00-10:00",
+		"monday 09:00-10:00",
+		"mon 09:00 - 10:00",
+	}
+
+	for _, w := range valid {
+		if err := w.Check(); err != nil {
+			t.Errorf("%q: %s", w, err)
+		}
+	}
+
+	for _, w := range invalid {
+		if err := w.Check(); err == nil {
+			t.Errorf("%q: error expected", w)
+		}
+	}
+}
+
+//
+// Test matching of time against windows
+//
+func TestSiteWindowMatch(t *testing.T) {
+	tests := []struct {
+		window SiteWindow
+		day    time.Weekday
+		hour   int
+		min    int
+		match  bool
+	}{
+		// Simple window, every day
+		{"09:00-18:00", time.Wednesday, 9, 0, true},
+		{"09:00-18:00", time.Sunday, 17, 59, true},
+		{"09:00-18:00", time.Wednesday, 18, 0, false},
+		{"09:00-18:00", time.Wednesday, 8, 59, false},
+
+		// Range of days
+		{"mon-fri 09:00-18:00", time.Monday, 12, 0, true},
+		{"mon-fri 09:00-18:00", time.Friday, 12, 0, true},
+		{"mon-fri 09:00-18:00", time.Saturday, 12, 0, false},
+		{"mon-fri 09:00-18:00", time.Sunday, 12, 0, false},
+
+		// Weekend, as range and as list
+		{"sat-sun 10:00-12:00", time.Saturday, 11, 0, true},
+		{"sat-sun 10:00-12:00", time.Sunday, 11, 0, true},
+		{"sat-sun 10:00-12:00", time.Monday, 11, 0, false},
+		{"sat,sun 10:00-12:00", time.Sunday, 11, 0, true},
+		{"sat,sun 10:00-12:00", time.Friday, 11, 0, false},
+
+		// Range, that wraps the week
+		{"fri-mon 12:00-13:00", time.Friday, 12, 30, true},
+		{"fri-mon 12:00-13:00", time.Sunday, 12, 30, true},
+		{"fri-mon 12:00-13:00", time.Monday, 12, 30, true},
+		{"fri-mon 12:00-13:00", time.Tuesday, 12, 30, false},
+		{"fri-mon 12:00-13:00", time.Thursday, 12, 30, false},
+
+		// Window, that crosses midnight, ends at the next day
+		{"22:00-06:00", time.Tuesday, 23, 0, true},
+		{"22:00-06:00", time.Tuesday, 5, 59, true},
+		{"22:00-06:00", time.Tuesday, 6, 0, false},
+		{"22:00-06:00", time.Tuesday, 21, 59, false},
+		{"fri 22:00-06:00", time.Friday, 23, 0, true},
+		{"fri 22:00-06:00", time.Saturday, 3, 0, true},
+		{"fri 22:00-06:00", time.Friday, 3, 0, false},
+		{"fri 22:00-06:00", time.Saturday, 23, 0, false},
+		{"sat 22:00-06:00", time.Sunday, 1, 0, true},
+		{"sun 22:00-06:00", time.Monday, 1, 0, true},
+		{"sun 22:00-06:00", time.Sunday, 1, 0, false},
+
+		// 24:00 and entire day windows
+		{"22:00-24:00", time.Monday, 23, 59, true},
+		{"22:00-24:00", time.Monday, 0, 0, false},
+		{"00:00-24:00", time.Monday, 0, 0, true},
+		{"00:00-24:00", time.Monday, 23, 59, true},
+		{"sun 00:00-00:00", time.Sunday, 23, 59, true},
+		{"sun 00:00-00:00", time.Monday, 0, 0, false},
+		{"sat 24:00-24:00", time.Saturday, 12, 0, true},
+
+		// Malformed window never matches
+		{"mon 25:00-26:00", time.Monday, 12, 0, false},
+	}
+
+	for _, test := range tests {
+		tm := scheduleTestTime(test.day, test.hour, test.min)
+		if tm.Weekday() != test.day {
+			t.Fatalf("%s: bad test time", tm)
+		}
+
+		if match := test.window.Match(tm); match != test.match {
+			t.Errorf("%q at %s %2.2d:%2.2d: %v expected",
+				test.window, test.day, test.hour, test.min, test.match)
+		}
+	}
+}
+
+//
+// Test that Match doesn't allocate memory
+//
+func TestSiteWindowMatchAllocs(t *testing.T) {
+	w := SiteWindow("mon-fri,sun 09:00-18:00")
+	tm := scheduleTestTime(time.Monday, 12, 0)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		w.Match(tm)
+	})
+
+	if allocs != 0 {
+		t.Fatalf("SiteWindow.Match: %v allocations per call", allocs)
+	}
+}
+
+//
+// Test removal of expired sites
+//
+func TestExpireSites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "froxy")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	soon := now.Add(time.Hour)
+	later := now.Add(2 * time.Hour)
+
+	sites := []SiteParams{
+		{Host: "past.example.com", Expires: &past},
+		{Host: "forever.example.com"},
+		{Host: "later.example.com", Expires: &later},
+		{Host: "now.example.com", Expires: &now},
+		{Host: "soon.example.com", Expires: &soon},
+	}
+
+	env := &Env{
+		state:             &State{Sites: sites},
+		PathUserStateFile: filepath.Join(dir, "state"),
+	}
+
+	expired, next := env.ExpireSites(now)
+	if !reflect.DeepEqual(expired, []SiteParams{sites[0], sites[3]}) {
+		t.Errorf("expired: %+v", expired)
+	}
+
+	if !next.Equal(soon) {
+		t.Errorf("next expiration: %s expected, %s received", soon, next)
+	}
+
+	remaining := []SiteParams{sites[1], sites[2], sites[4]}
+	if got := env.GetSites(); !reflect.DeepEqual(got, remaining) {
+		t.Errorf("remaining: %+v", got)
+	}
+
+	// Nothing more expires now
+	expired, next = env.ExpireSites(now)
+	if len(expired) != 0 || !next.Equal(soon) {
+		t.Errorf("second pass: expired %+v, next %s", expired, next)
+	}
+
+	// Remaining sites expire later, one that never expires is kept
+	expired, next = env.ExpireSites(later)
+	if len(expired) != 2 || !next.IsZero() {
+		t.Errorf("later: expired %+v, next %s", expired, next)
+	}
+
+	if got := env.GetSites(); !reflect.DeepEqual(got, sites[1:2]) {
+		t.Errorf("remaining later: %+v", got)
+	}
+
+	// Expired sites are removed from the saved state as well
+	state := &State{}
+	state.Load(env.PathUserStateFile)
+	if len(state.Sites) != 1 || state.Sites[0].Host != sites[1].Host {
+		t.Errorf("saved: %+v", state.Sites)
+	}
+}
@@ -0,0 +1,530 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Import and export of site lists
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+//
+// Format of site list
+//
+type SiteListFormat string
+
+const (
+	SiteListAuto    = SiteListFormat("")        // Auto-detect (import only)
+	SiteListPlain   = SiteListFormat("plain")   // One host per line
+	SiteListHosts   = SiteListFormat("hosts")   // /etc/hosts format
+	SiteListAdBlock = SiteListFormat("adblock") // AdBlock rules, block
+	SiteListGFWList = SiteListFormat("gfwlist") // gfwlist rules, forward
+	SiteListJSON    = SiteListFormat("json")    // Froxy JSON format
+)
+
+//
+// All known site list formats
+//
+var SiteListFormats = []SiteListFormat{
+	SiteListPlain,
+	SiteListHosts,
+	SiteListAdBlock,
+	SiteListGFWList,
+	SiteListJSON,
+}
+
+//
+// Check if format is valid. SiteListAuto is considered valid
+//
+func (format SiteListFormat) Valid() bool {
+	if format == SiteListAuto {
+		return true
+	}
+
+	for _, f := range SiteListFormats {
+		if f == format {
+			return true
+		}
+	}
+
+	return false
+}
+
+//
+// Per-line site list import error
+//
+type SiteListError struct {
+	Line int    `json:"line"` // Line number, 1-based
+	Text string `json:"text"` // Line text
+	Err  string `json:"err"`  // Error message
+}
+
+//
+// Format error message
+//
+func (err *SiteListError) Error() string {
+	return fmt.Sprintf("line %d: %q: %s", err.Line, err.Text, err.Err)
+}
+
+//
+// Site list errors
+//
+var (
+	errSiteListFormat  = errors.New("unknown site list format")
+	errSiteListAddr    = errors.New("only 0.0.0.0 and loopback addresses are supported")
+	errSiteListOptions = errors.New("rules with options are not supported")
+	errSiteListRegexp  = errors.New("URL regular expressions are not supported")
+	errSiteListRule    = errors.New("unsupported rule")
+)
+
+// ----- Import -----
+//
+// Parse site list
+//
+// Lines that cannot be parsed are reported as SiteListError-s,
+// all other lines are imported. Returned error is not nil
+// only if the whole list cannot be parsed
+//
+// If format is SiteListAuto, it is guessed from the content.
+// Actually used format is returned
+//
+func SiteListParse(data []byte, format SiteListFormat) (
+	sites []SiteParams, errs []SiteListError, used SiteListFormat, err error) {
+
+	if format == SiteListAuto {
+		format = siteListDetect(data)
+	}
+
+	var parse func(string) ([]SiteParams, error)
+
+	switch format {
+	case SiteListPlain:
+		parse = siteListParsePlain
+	case SiteListHosts:
+		parse = siteListParseHosts
+	case SiteListAdBlock:
+		parse = func(line string) ([]SiteParams, error) {
+			return siteListParseRule(line, true)
+		}
+	case SiteListGFWList:
+		data = siteListDecodeGFWList(data)
+		parse = func(line string) ([]SiteParams, error) {
+			return siteListParseRule(line, false)
+		}
+	case SiteListJSON:
+		sites, errs, err = siteListParseJSON(data)
+		return siteListDedup(sites), errs, format, err
+	default:
+		return nil, nil, format, errSiteListFormat
+	}
+
+	sites = []SiteParams{}
+	errs = []SiteListError{}
+
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+
+		s, err := parse(line)
+		if err != nil {
+			errs = append(errs, SiteListError{n + 1, line, err.Error()})
+		}
+		sites = append(sites, s...)
+	}
+
+	return siteListDedup(sites), errs, format, nil
+}
+
+//
+// Remove duplicated sites, keeping the first one. Duplicates are
+// common, as, for example, exact domain is listed in AdBlock format
+// twice, for http:// and https://
+//
+func siteListDedup(sites []SiteParams) []SiteParams {
+	if sites == nil {
+		return nil
+	}
+
+	seen := make(map[SiteKey]struct{})
+	out := sites[:0]
+
+	for _, site := range sites {
+		key := site.Key()
+		if _, dup := seen[key]; !dup {
+			seen[key] = struct{}{}
+			out = append(out, site)
+		}
+	}
+
+	return out
+}
+
+//
+// Guess site list format
+//
+func siteListDetect(data []byte) SiteListFormat {
+	text := strings.TrimSpace(string(data))
+
+	switch {
+	case strings.HasPrefix(text, "["):
+		if strings.HasPrefix(text, "[Adblock") {
+			return SiteListAdBlock
+		}
+		if strings.HasPrefix(text, "[AutoProxy") {
+			return SiteListGFWList
+		}
+		return SiteListJSON
+
+	case !bytes.Equal(siteListDecodeGFWList(data), data):
+		return SiteListGFWList
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "||") || strings.HasPrefix(line, "!"):
+			return SiteListAdBlock
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			return SiteListHosts
+		}
+
+		return SiteListPlain
+	}
+
+	return SiteListPlain
+}
+
+//
+// gfwlist is often distributed base64-encoded. If data looks
+// like base64-encoded rules, decode it, otherwise return data as is
+//
+func siteListDecodeGFWList(data []byte) []byte {
+	text := strings.Join(strings.Fields(string(data)), "")
+	if text == "" {
+		return data
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(text)
+	if err != nil || !bytes.HasPrefix(decoded, []byte("[AutoProxy")) {
+		return data
+	}
+
+	return decoded
+}
+
+//
+// Create site from the domain or domain pattern
+//
+func siteListSite(domain string, rec, block bool) (SiteParams, error) {
+	host, typ, err := DomainValidate(domain)
+	if err != nil {
+		return SiteParams{}, err
+	}
+
+	site := SiteParams{
+		Host:  IDNEncodePattern(host, typ),
+		Type:  typ,
+		Rec:   rec && typ == SiteTypeDomain,
+		Block: block,
+	}
+
+	return site, nil
+}
+
+//
+// Parse line of plain list of hosts
+//
+func siteListParsePlain(line string) ([]SiteParams, error) {
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	site, err := siteListSite(line, true, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return []SiteParams{site}, nil
+}
+
+//
+// Parse line of the hosts file. Hosts, mapped to the 0.0.0.0
+// or loopback address, are imported as blocked
+//
+func siteListParseHosts(line string) ([]SiteParams, error) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	ip := net.ParseIP(fields[0])
+	switch {
+	case ip == nil:
+		return nil, fmt.Errorf("invalid address %q", fields[0])
+	case !ip.IsUnspecified() && !ip.IsLoopback():
+		return nil, errSiteListAddr
+	}
+
+	sites := []SiteParams{}
+	for _, host := range fields[1:] {
+		switch strings.ToLower(host) {
+		case "localhost", "localhost.localdomain", "local",
+			"broadcasthost", "ip6-localhost", "ip6-loopback":
+			// Local names are commonly listed in hosts files,
+			// don't block them
+			continue
+		}
+
+		site, err := siteListSite(host, false, true)
+		if err != nil {
+			return sites, err
+		}
+		sites = append(sites, site)
+	}
+
+	return sites, nil
+}
+
+//
+// Parse AdBlock or gfwlist rule
+//
+// Supported rules are:
+//     ||domain^       - domain with subdomains
+//     |http://domain/ - exact domain
+//     .domain         - domain with subdomains (gfwlist)
+//     domain          - domain with subdomains (gfwlist)
+//
+// Exception rules (prefixed with @@) are imported as bypassed sites
+//
+func siteListParseRule(line string, block bool) ([]SiteParams, error) {
+	bypass := false
+	if strings.HasPrefix(line, "@@") {
+		line = line[2:]
+		bypass = true
+	}
+
+	switch {
+	case line == "" || strings.HasPrefix(line, "!") ||
+		strings.HasPrefix(line, "["):
+		return nil, nil
+
+	case strings.Contains(line, "$"):
+		return nil, errSiteListOptions
+
+	case strings.HasPrefix(line, "/"):
+		return nil, errSiteListRegexp
+	}
+
+	var domain string
+	rec := true
+
+	switch {
+	case strings.HasPrefix(line, "||"):
+		domain = line[2:]
+		if i := strings.IndexByte(domain, '^'); i >= 0 {
+			if i != len(domain)-1 {
+				return nil, errSiteListRule
+			}
+			domain = domain[:i]
+		}
+
+		if strings.ContainsAny(domain, "/|") {
+			return nil, errSiteListRule
+		}
+
+	case strings.HasPrefix(line, "|"):
+		domain = strings.TrimSuffix(line[1:], "^")
+		rec = false
+		if !strings.Contains(domain, "://") {
+			return nil, errSiteListRule
+		}
+
+	case strings.HasPrefix(line, "."):
+		domain = line[1:]
+
+	default:
+		domain = line
+	}
+
+	if strings.ContainsAny(domain, "^|") ||
+		(!strings.Contains(domain, "://") && strings.Contains(domain, "/")) {
+		return nil, errSiteListRule
+	}
+
+	site, err := siteListSite(domain, rec, block && !bypass)
+	if err != nil {
+		return nil, err
+	}
+
+	site.Bypass = bypass
+
+	return []SiteParams{site}, nil
+}
+
+//
+// Parse site list in JSON format. The format is the same,
+// as used by /api/sites
+//
+func siteListParseJSON(data []byte) ([]SiteParams, []SiteListError, error) {
+	var in []SiteParams
+	err := json.Unmarshal(data, &in)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sites := []SiteParams{}
+	errs := []SiteListError{}
+
+	for n, s := range in {
+		domain := s.Host
+		if s.Type == SiteTypeRegexp {
+			domain = "/" + domain + "/"
+		}
+
+		site, err := siteListSite(domain, s.Rec, s.Block)
+		if err == nil {
+			site.Bypass = s.Bypass
+			site.Mode = s.Mode
+			site.Expires = s.Expires
+			site.Schedule = s.Schedule
+			site.Port = s.Port
+			site.Scheme = s.Scheme
+			err = site.CheckConstraints()
+		}
+
+		if err != nil {
+			errs = append(errs, SiteListError{n + 1, domain, err.Error()})
+			continue
+		}
+
+		site.Server = s.Server
+		sites = append(sites, site)
+	}
+
+	return sites, errs, nil
+}
+
+// ----- Export -----
+//
+// Format site list
+//
+// Formats, that cannot represent all kinds of sites, export only
+// sites they can represent:
+//     hosts   - blocked domains
+//     adblock - blocked domains and wildcard patterns
+//     gfwlist - forwarded domains and wildcard patterns
+//
+// Bypassed sites are exported to adblock and gfwlist as exception
+// rules (prefixed with @@)
+//
+// Plain format exports all sites, but loses their parameters. All
+// formats, except JSON, skip sites with port or scheme constraints
+// or schedule
+//
+func SiteListFormatSites(sites []SiteParams, format SiteListFormat) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	switch format {
+	case SiteListPlain:
+		fmt.Fprintf(buf, "# Sites, exported by %s\n", PROGRAM_NAME)
+		for _, site := range sites {
+			if site.Constraints() != 0 {
+				fmt.Fprintf(buf, "# Skipped: %s (%s)\n",
+					site.Host, siteListSkipReason(&site))
+			} else if site.Type == SiteTypeRegexp {
+				fmt.Fprintf(buf, "/%s/\n", site.Host)
+			} else {
+				fmt.Fprintf(buf, "%s\n", IDNDecodePattern(site.Host, site.Type))
+			}
+		}
+
+	case SiteListHosts:
+		fmt.Fprintf(buf, "# Blocked sites, exported by %s\n", PROGRAM_NAME)
+		for _, site := range sites {
+			if site.Block && site.Type == SiteTypeDomain &&
+				site.Constraints() == 0 {
+				fmt.Fprintf(buf, "0.0.0.0 %s\n", site.Host)
+			}
+		}
+
+	case SiteListAdBlock, SiteListGFWList:
+		block := format == SiteListAdBlock
+		if block {
+			fmt.Fprintf(buf, "[Adblock Plus 2.0]\n")
+			fmt.Fprintf(buf, "! Blocked sites, exported by %s\n", PROGRAM_NAME)
+		} else {
+			fmt.Fprintf(buf, "[AutoProxy 0.2.9]\n")
+			fmt.Fprintf(buf, "! Forwarded sites, exported by %s\n", PROGRAM_NAME)
+		}
+
+		for _, site := range sites {
+			prefix := ""
+			if site.Bypass {
+				prefix = "@@"
+			}
+
+			switch {
+			case site.Block != block && !site.Bypass:
+			case site.Constraints() != 0:
+				fmt.Fprintf(buf, "! Skipped: %s (%s)\n",
+					site.Host, siteListSkipReason(&site))
+			case site.Type == SiteTypeRegexp:
+				fmt.Fprintf(buf, "! Skipped: /%s/\n", site.Host)
+			case site.Type == SiteTypeCIDR:
+				fmt.Fprintf(buf, "! Skipped: %s\n", site.Host)
+			case site.Type == SiteTypeDomain && !site.Rec:
+				fmt.Fprintf(buf, "%s|http://%s/\n", prefix, site.Host)
+				fmt.Fprintf(buf, "%s|https://%s/\n", prefix, site.Host)
+			default:
+				fmt.Fprintf(buf, "%s||%s^\n", prefix, site.Host)
+			}
+		}
+
+	case SiteListJSON:
+		list, err := json.MarshalIndent(IDNSiteParamsList(sites), "", "    ")
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(list)
+		buf.WriteByte('\n')
+
+	default:
+		return nil, errSiteListFormat
+	}
+
+	return buf.Bytes(), nil
+}
+
+//
+// Explain, why site with constraints is skipped on export
+//
+func siteListSkipReason(site *SiteParams) string {
+	reasons := []string{}
+	if site.Scheme != SiteSchemeAny {
+		reasons = append(reasons, "scheme "+string(site.Scheme))
+	}
+	if site.Port != "" {
+		reasons = append(reasons, "port "+site.Port)
+	}
+	if len(site.Schedule) != 0 {
+		reasons = append(reasons, "schedule")
+	}
+	return strings.Join(reasons, ", ")
+}
@@ -0,0 +1,298 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Import and export of site lists test
+
+package main
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//
+// Test site list format detection
+//
+func TestSiteListDetect(t *testing.T) {
+	gfwlist := base64.StdEncoding.EncodeToString(
+		[]byte("[AutoProxy 0.2.9]\n||example.com\n"))
+
+	tests := []struct {
+		data   string
+		format SiteListFormat
+	}{
+		{"", SiteListPlain},
+		{"example.com\nexample.org\n", SiteListPlain},
+		{"# comment\n\nexample.com\n", SiteListPlain},
+		{"10.0.0.0/8\n", SiteListPlain},
+		{"0.0.0.0 ads.example.com\n", SiteListHosts},
+		{"# hosts\n127.0.0.1 localhost\n", SiteListHosts},
+		{"::1 ip6-localhost\n", SiteListHosts},
+		{"||ads.example.com^\n", SiteListAdBlock},
+		{"! comment\nexample.com\n", SiteListAdBlock},
+		{"[Adblock Plus 2.0]\n||ads.example.com^\n", SiteListAdBlock},
+		{"[AutoProxy 0.2.9]\n||example.com\n", SiteListGFWList},
+		{gfwlist, SiteListGFWList},
+		{gfwlist[:20] + "\n" + gfwlist[20:], SiteListGFWList},
+		{`[{"host": "example.com"}]`, SiteListJSON},
+		{"  \n[]", SiteListJSON},
+
+		// Looks like base64, but doesn't decode to gfwlist
+		{"ZXhhbXBsZS5jb20=\n", SiteListPlain},
+	}
+
+	for _, test := range tests {
+		format := siteListDetect([]byte(test.data))
+		if format != test.format {
+			t.Errorf("%q: %q expected, %q detected",
+				test.data, test.format, format)
+		}
+	}
+}
+
+//
+// Test parsing of site lists in each format
+//
+func TestSiteListParse(t *testing.T) {
+	tests := []struct {
+		format SiteListFormat
+		data   string
+		sites  []SiteParams
+		errs   []int // Lines with errors
+	}{
+		{
+			format: SiteListPlain,
+			data:   "# comment\nexample.com\n\n*.example.org\n10.0.0.0/8\nbad host\n",
+			sites: []SiteParams{
+				{Host: "example.com", Type: SiteTypeDomain, Rec: true},
+				{Host: "*.example.org", Type: SiteTypeGlob},
+				{Host: "10.0.0.0/8", Type: SiteTypeCIDR},
+			},
+			errs: []int{6},
+		},
+		{
+			format: SiteListHosts,
+			data: "127.0.0.1 localhost\n" +
+				"0.0.0.0 ads.example.com track.example.com # ads\n" +
+				"::1 ip6-localhost bad.example.com\n" +
+				"192.168.1.1 router.lan\n" +
+				"bogus example.com\n",
+			sites: []SiteParams{
+				{Host: "ads.example.com", Type: SiteTypeDomain, Block: true},
+				{Host: "track.example.com", Type: SiteTypeDomain, Block: true},
+				{Host: "bad.example.com", Type: SiteTypeDomain, Block: true},
+			},
+			errs: []int{4, 5},
+		},
+		{
+			format: SiteListAdBlock,
+			data: "[Adblock Plus 2.0]\n! comment\n" +
+				"||ads.example.com^\n" +
+				"@@||good.example.com^\n" +
+				"|http://exact.example.com/\n" +
+				"||opts.example.com^$third-party\n" +
+				"/banner[0-9]+/\n" +
+				"||path.example.com/ads\n" +
+				"||mid.example.com^foo\n",
+			sites: []SiteParams{
+				{Host: "ads.example.com", Type: SiteTypeDomain,
+					Rec: true, Block: true},
+				{Host: "good.example.com", Type: SiteTypeDomain,
+					Rec: true, Bypass: true},
+				{Host: "exact.example.com", Type: SiteTypeDomain,
+					Block: true},
+			},
+			errs: []int{6, 7, 8, 9},
+		},
+		{
+			format: SiteListGFWList,
+			data: base64.StdEncoding.EncodeToString([]byte(
+				"[AutoProxy 0.2.9]\n" +
+					"||blocked.example.com\n" +
+					".dot.example.com\n" +
+					"bare.example.com\n" +
+					"@@||direct.example.com\n" +
+					"|https://exact.example.com/\n")),
+			sites: []SiteParams{
+				{Host: "blocked.example.com", Type: SiteTypeDomain, Rec: true},
+				{Host: "dot.example.com", Type: SiteTypeDomain, Rec: true},
+				{Host: "bare.example.com", Type: SiteTypeDomain, Rec: true},
+				{Host: "direct.example.com", Type: SiteTypeDomain,
+					Rec: true, Bypass: true},
+				{Host: "exact.example.com", Type: SiteTypeDomain},
+			},
+		},
+		{
+			format: SiteListJSON,
+			data: `[
+				{"host": "example.com", "rec": true, "server": "home"},
+				{"host": "Ads.Example.com", "block": true, "port": "8080"},
+				{"host": "bad host"},
+				{"host": "x.example.com", "port": "99999"},
+				{"host": "y.example.com", "block": true, "bypass": true}
+			]`,
+			sites: []SiteParams{
+				{Host: "example.com", Type: SiteTypeDomain, Rec: true,
+					Server: "home"},
+				{Host: "ads.example.com", Type: SiteTypeDomain,
+					Block: true, Port: "8080"},
+			},
+			errs: []int{3, 4, 5},
+		},
+	}
+
+	for _, test := range tests {
+		sites, errs, used, err := SiteListParse([]byte(test.data), SiteListAuto)
+		if err != nil {
+			t.Errorf("%s: %s", test.format, err)
+			continue
+		}
+
+		if used != test.format {
+			t.Errorf("%s: detected as %s", test.format, used)
+		}
+
+		if !reflect.DeepEqual(sites, test.sites) {
+			t.Errorf("%s: sites mismatch:\nexpected: %+v\nreceived: %+v",
+				test.format, test.sites, sites)
+		}
+
+		lines := []int{}
+		for _, e := range errs {
+			lines = append(lines, e.Line)
+		}
+
+		if test.errs == nil {
+			test.errs = []int{}
+		}
+
+		if !reflect.DeepEqual(lines, test.errs) {
+			t.Errorf("%s: errors at lines %v expected, %v received (%v)",
+				test.format, test.errs, lines, errs)
+		}
+	}
+}
+
+//
+// Test parsing of malformed lists as a whole
+//
+func TestSiteListParseMalformed(t *testing.T) {
+	_, _, _, err := SiteListParse([]byte(`[{"host": `), SiteListAuto)
+	if err == nil {
+		t.Errorf("truncated JSON: error expected")
+	}
+
+	_, _, _, err = SiteListParse([]byte("example.com"), "bad")
+	if err == nil {
+		t.Errorf("unknown format: error expected")
+	}
+}
+
+//
+// Test that exported sites are imported back unchanged. Each format
+// is tested with the sites it can represent, and sites it cannot
+// represent must be skipped with the reason
+//
+func TestSiteListRoundTrip(t *testing.T) {
+	tests := []struct {
+		format SiteListFormat
+		sites  []SiteParams
+	}{
+		{SiteListPlain, []SiteParams{
+			{Host: "example.com", Type: SiteTypeDomain, Rec: true},
+			{Host: "*.example.org", Type: SiteTypeGlob},
+			{Host: "10.0.0.0/8", Type: SiteTypeCIDR},
+			{Host: "xn--e1afmkfd.xn--p1ai", Type: SiteTypeDomain, Rec: true},
+		}},
+		{SiteListHosts, []SiteParams{
+			{Host: "ads.example.com", Type: SiteTypeDomain, Block: true},
+		}},
+		{SiteListAdBlock, []SiteParams{
+			{Host: "ads.example.com", Type: SiteTypeDomain,
+				Rec: true, Block: true},
+			{Host: "exact.example.com", Type: SiteTypeDomain, Block: true},
+			{Host: "good.example.com", Type: SiteTypeDomain,
+				Rec: true, Bypass: true},
+		}},
+		{SiteListGFWList, []SiteParams{
+			{Host: "blocked.example.com", Type: SiteTypeDomain, Rec: true},
+			{Host: "exact.example.com", Type: SiteTypeDomain},
+			{Host: "direct.example.com", Type: SiteTypeDomain,
+				Rec: true, Bypass: true},
+		}},
+		{SiteListJSON, []SiteParams{
+			{Host: "example.com", Type: SiteTypeDomain, Rec: true,
+				Server: "home"},
+			{Host: "ads.example.com", Type: SiteTypeDomain, Block: true,
+				Mode: BlockModePixel, Port: "443",
+				Scheme: SiteSchemeConnect},
+			{Host: "work.example.com", Type: SiteTypeDomain,
+				Schedule: []SiteWindow{"mon-fri 09:00-18:00"}},
+		}},
+	}
+
+	// Sites no format, except JSON, can represent
+	skipped := []struct {
+		site   SiteParams
+		reason string
+	}{
+		{SiteParams{Host: "port.example.com", Type: SiteTypeDomain,
+			Port: "8080"}, "port 8080"},
+		{SiteParams{Host: "timed.example.com", Type: SiteTypeDomain,
+			Schedule: []SiteWindow{"sat-sun"}}, "schedule"},
+		{SiteParams{Host: "both.example.com", Type: SiteTypeDomain,
+			Scheme: SiteSchemeHTTP, Port: "80"}, "scheme http, port 80"},
+	}
+
+	for _, test := range tests {
+		sites := test.sites
+		if test.format != SiteListJSON && test.format != SiteListHosts {
+			// gfwlist exports forwarded sites only
+			for _, s := range skipped {
+				s.site.Block = test.format != SiteListGFWList
+				sites = append(sites, s.site)
+			}
+		}
+
+		data, err := SiteListFormatSites(sites, test.format)
+		if err != nil {
+			t.Errorf("%s: export: %s", test.format, err)
+			continue
+		}
+
+		imported, errs, used, err := SiteListParse(data, SiteListAuto)
+		if err != nil {
+			t.Errorf("%s: import: %s", test.format, err)
+			continue
+		}
+
+		if used != test.format {
+			t.Errorf("%s: exported list detected as %s", test.format, used)
+		}
+
+		if len(errs) != 0 {
+			t.Errorf("%s: import errors: %v", test.format, errs)
+		}
+
+		if !reflect.DeepEqual(imported, test.sites) {
+			t.Errorf("%s: round trip mismatch:\nexpected: %+v\nreceived: %+v\n%s",
+				test.format, test.sites, imported, data)
+		}
+
+		if len(sites) == len(test.sites) {
+			continue
+		}
+
+		for _, s := range skipped {
+			line := "Skipped: " + s.site.Host + " (" + s.reason + ")"
+			if !strings.Contains(string(data), line) {
+				t.Errorf("%s: %q not found in:\n%s",
+					test.format, line, data)
+			}
+		}
+	}
+}
@@ -9,12 +9,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"net/http"
 	"reflect"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/alexpevzner/froxy/internal/keys"
 	"golang.org/x/crypto/ssh"
@@ -26,7 +29,10 @@ import (
 type SSHTransport struct {
 	http.Transport             // SSH-backed http.Transport
 	froxy          *Froxy      // Back link to Froxy
+	server         string      // Server ident, "" for all servers
 	ctx            *sshContext // Current context
+	counters       SSHCounters // Statistic counters
+	eager          bool        // Connect without waiting for requests
 
 	// Management of active sessions
 	sessionsLock      sync.Mutex               // Access lock
@@ -42,6 +48,14 @@ type SSHTransport struct {
 
 var _ = Transport(&SSHTransport{})
 
+//
+// SSHTransport statistic counters, for WebAPI
+//
+type SSHTransportCounters struct {
+	Server string `json:"server"` // Server ident, "" for all servers
+	SSHCounters
+}
+
 // ----- SSH connection context -- wraps context.Context -----
 //
 // SSH connection context
@@ -50,28 +64,31 @@ type sshContext struct {
 	context.Context                    // Underlying context
 	cancel          context.CancelFunc // Context cancel function
 	froxy           *Froxy             // Back link to Froxy
-	params          *ServerParams      // Server parameters
-	key             *keys.Key          // SSH key to use, if any
-	ok              bool               // Server parameters OK to connect
+	servers         []*sshServer       // Servers, in order of preference
+	active          int32              // Index of active server
+	ok              bool               // Some server is OK to connect
+
+	// Retry schedule, maintained by supervisor
+	retryLock     sync.Mutex    // Access lock
+	retryAttempts int           // Failed attempts in a row
+	retryNext     time.Time     // Time of next attempt, zero if none
+	retryNow      chan struct{} // Retry immediately
 }
 
 //
 // Create new sshContext
 //
-func newSshContext(froxy *Froxy, params *ServerParams) *sshContext {
+func newSshContext(froxy *Froxy, servers []ServerParams) *sshContext {
 	ctx := &sshContext{
-		froxy:  froxy,
-		params: params,
-		ok:     params.Addr != "" && params.Login != "",
+		froxy:    froxy,
+		servers:  make([]*sshServer, len(servers)),
+		retryNow: make(chan struct{}, 1),
 	}
 
-	if ctx.ok {
-		if params.Keyid != "" {
-			ctx.key = ctx.froxy.KeyById(params.Keyid)
-			ctx.ok = ctx.key != nil
-		} else {
-			ctx.ok = params.Password != ""
-		}
+	for i := range servers {
+		srv := newSshServer(ctx, i, servers[i])
+		ctx.servers[i] = srv
+		ctx.ok = ctx.ok || srv.ok
 	}
 
 	ctx.Context, ctx.cancel = context.WithCancel(context.Background())
@@ -90,26 +107,302 @@ func (ctx *sshContext) Cancel() {
 // Check of server parameters are equal to those associated
 // with the context
 //
-func (ctx *sshContext) ServerParamsEqual(params *ServerParams) bool {
-	return reflect.DeepEqual(ctx.params, params)
+func (ctx *sshContext) ServerParamsEqual(servers []ServerParams) bool {
+	if len(ctx.servers) != len(servers) {
+		return false
+	}
+
+	for i, srv := range ctx.servers {
+		if !srv.ServerParamsEqual(&servers[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//
+// Get retry schedule: count of failed attempts in a row and
+// time of the next attempt. Zero time means no retry is scheduled
+//
+func (ctx *sshContext) RetrySchedule() (int, time.Time) {
+	ctx.retryLock.Lock()
+	defer ctx.retryLock.Unlock()
+
+	return ctx.retryAttempts, ctx.retryNext
+}
+
+//
+// Set retry schedule
+//
+func (ctx *sshContext) setRetrySchedule(attempts int, next time.Time) {
+	ctx.retryLock.Lock()
+	ctx.retryAttempts = attempts
+	ctx.retryNext = next
+	ctx.retryLock.Unlock()
+
+	ctx.froxy.Raise(EventConnStateChanged)
+}
+
+//
+// Get active server
+//
+func (ctx *sshContext) Active() *sshServer {
+	return ctx.servers[atomic.LoadInt32(&ctx.active)]
+}
+
+//
+// Set active server. Returns true if active server was changed
+//
+func (ctx *sshContext) SetActive(srv *sshServer) bool {
+	return atomic.SwapInt32(&ctx.active, int32(srv.index)) != int32(srv.index)
+}
+
+// ----- SSH server -----
+//
+// SSH server, one of servers in the sshContext
+//
+type sshServer struct {
+	ctx         *sshContext  // Context that owns the server
+	index       int          // Index in ctx.servers, of owner for jumps
+	params      ServerParams // Server parameters
+	key         *keys.Key    // SSH key to use, if any
+	ok          bool         // Server parameters OK to connect
+	hops        []*sshServer // Jump hosts, in order of connection
+	hostKeyLock sync.Mutex   // Access lock for hostKey
+	hostKey     string       // Known host key fingerprint
+}
+
+//
+// Create new sshServer. The index is the server's index in
+// ctx.servers. Jump hosts share the index of their server
+//
+func newSshServer(ctx *sshContext, index int,
+	params ServerParams) *sshServer {
+
+	srv := &sshServer{
+		ctx:     ctx,
+		index:   index,
+		params:  params,
+		ok:      params.Addr != "" && params.Login != "",
+		hostKey: params.HostKey,
+	}
+
+	if srv.ok {
+		switch {
+		case params.Keyid != "":
+			srv.key = ctx.froxy.KeyById(params.Keyid)
+			srv.ok = srv.key != nil
+		case params.Agent:
+			// Agent availability is checked on connect
+		default:
+			srv.ok = params.Password != ""
+		}
+	}
+
+	for _, jump := range params.Jump {
+		hop := newSshServer(ctx, index, jump)
+		srv.hops = append(srv.hops, hop)
+		srv.ok = srv.ok && hop.ok
+	}
+
+	return srv
+}
+
+//
+// Check of server parameters are equal to those associated
+// with the server
+//
+// Host keys, learned at runtime, don't make parameters different,
+// so learning the key doesn't cause reconnect. If key was learned
+// by another transport, the server adopts it
+//
+func (srv *sshServer) ServerParamsEqual(params *ServerParams) bool {
+	if len(srv.hops) != len(params.Jump) ||
+		!srv.hostKeyEqual(params.HostKey) {
+		return false
+	}
+
+	p, q := srv.params, *params
+	p.HostKey, q.HostKey = "", ""
+	p.Jump, q.Jump = nil, nil
+	if !reflect.DeepEqual(&p, &q) {
+		return false
+	}
+
+	for i, hop := range srv.hops {
+		if !hop.ServerParamsEqual(&params.Jump[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//
+// Check if host key matches the key, known to the server. Key,
+// learned by another transport while this server doesn't know
+// any key yet, is adopted
+//
+func (srv *sshServer) hostKeyEqual(hostKey string) bool {
+	srv.hostKeyLock.Lock()
+	defer srv.hostKeyLock.Unlock()
+
+	switch {
+	case srv.hostKey == hostKey:
+		return true
+	case srv.hostKey == "" && srv.params.HostKey == "":
+		srv.hostKey = hostKey
+		return true
+	}
+
+	return false
+}
+
+//
+// Check server host key
+//
+// If host key is not known yet, it is trusted and saved
+// (trust on first use). Otherwise, received key must match
+// the known key, and *HostKeyMismatchError is returned
+// if it doesn't
+//
+func (srv *sshServer) CheckHostKey(key ssh.PublicKey) error {
+	fp := HostKeyFingerprint(key)
+	froxy := srv.ctx.froxy
+
+	srv.hostKeyLock.Lock()
+	known := srv.hostKey
+	if known == "" {
+		srv.hostKey = fp
+	}
+	srv.hostKeyLock.Unlock()
+
+	switch known {
+	case "":
+		froxy.Info("SSH: server %q host key %s trusted on first use",
+			srv.params.Addr, fp)
+		froxy.SetServerHostKey(srv.params.Addr, fp)
+		return nil
+
+	case fp:
+		return nil
+	}
+
+	return &HostKeyMismatchError{Addr: srv.params.Addr, Old: known, New: fp}
+}
+
+//
+// Answer keyboard-interactive authentication challenge
+//
+// Questions Froxy can answer by itself are answered automatically,
+// others are sent to user. Challenge, sent to user, is canceled
+// together with ctx
+//
+func (srv *sshServer) KeyboardInteractive(ctx context.Context,
+	name, instruction string, questions []string, echos []bool) (
+	[]string, error) {
+
+	answers, answered, err := challengeAutoAnswer(&srv.params,
+		questions, time.Now())
+
+	if err != nil || answered == len(questions) {
+		return answers, err
+	}
+
+	// Ask user for the rest
+	var ask []string
+	var askEchos []bool
+	for i, q := range questions {
+		if answers[i] == "" {
+			ask = append(ask, q)
+			askEchos = append(askEchos, echos[i])
+		}
+	}
+
+	replies, err := srv.ctx.froxy.challenges.Ask(ctx, srv.params.Addr,
+		srv.params.Login, name, instruction, ask, askEchos)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range answers {
+		if answers[i] == "" {
+			answers[i], replies = replies[0], replies[1:]
+		}
+	}
+
+	return answers, nil
 }
 
 //
 // Create SSH client configuration
 //
-func (ctx *sshContext) SshClientConfig() *ssh.ClientConfig {
+// Authentication methods, offered by the server, are recorded
+// into the offered structure during the handshake
+//
+// Keyboard-interactive questions are asked in the context of ctx
+//
+// It fails, if SSH agent is used, but not available
+//
+func (srv *sshServer) SshClientConfig(ctx context.Context,
+	offered *sshAuthOffered) (*ssh.ClientConfig, error) {
+
+	var signers []ssh.Signer
+	switch {
+	case srv.key != nil:
+		signers = []ssh.Signer{srv.key.Signer()}
+	case srv.params.Agent:
+		var err error
+		signers, err = SSHAgentSigners(srv.params.AgentKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// golang.org/x/crypto/ssh only calls method's callback, if
+	// method is offered by the server. Methods we don't use are
+	// probed at the end: publickey probe has no keys to try, and
+	// password probe aborts the authentication, as it has
+	// already failed anyway
+	publickey := ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		offered.add("publickey")
+		return signers, nil
+	})
+
+	password := ssh.PasswordCallback(func() (string, error) {
+		offered.add("password")
+		if signers != nil {
+			offered.rejected = true
+			return "", ErrSSHAuthRejected
+		}
+		return srv.params.Password, nil
+	})
+
+	interactive := ssh.KeyboardInteractive(func(user, instruction string,
+		questions []string, echos []bool) ([]string, error) {
+		offered.add("keyboard-interactive")
+		return srv.KeyboardInteractive(ctx, user, instruction,
+			questions, echos)
+	})
+
 	var auth []ssh.AuthMethod
-	if ctx.key != nil {
-		auth = []ssh.AuthMethod{ssh.PublicKeys(ctx.key.Signer())}
+	if signers != nil {
+		auth = []ssh.AuthMethod{publickey, interactive, password}
 	} else {
-		auth = []ssh.AuthMethod{ssh.Password(ctx.params.Password)}
+		auth = []ssh.AuthMethod{password, interactive, publickey}
 	}
 
-	return &ssh.ClientConfig{
-		User:            ctx.params.Login,
-		Auth:            auth,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	cfg := &ssh.ClientConfig{
+		User: srv.params.Login,
+		Auth: auth,
+		HostKeyCallback: func(hostname string, remote net.Addr,
+			key ssh.PublicKey) error {
+			return srv.CheckHostKey(key)
+		},
 	}
+
+	return cfg, nil
 }
 
 // ----- SSH session -----
@@ -120,6 +413,72 @@ type sshSession struct {
 	*ssh.Client               // Underlying ssh.Client
 	transport   *SSHTransport // Transport that owns the session
 	refcnt      uint32        // Reference count
+	done        chan struct{} // Closed when session terminates
+	abortErr    chan error    // Why session was aborted by Froxy
+}
+
+//
+// Send keepalive requests to the server. If server doesn't answer
+// during the configured count of intervals, the session is closed
+//
+// Only one request is outstanding at a time. Any answer, even the
+// failure, means that server is alive
+//
+func (ssn *sshSession) keepalive(params *ServerParams) {
+	interval := SSH_KEEPALIVE_INTERVAL
+	max := SSH_KEEPALIVE_MAX
+
+	switch {
+	case params.KeepAlive < 0:
+		return
+	case params.KeepAlive > 0:
+		interval = time.Duration(params.KeepAlive) * time.Second
+	}
+
+	if params.KeepAliveMax > 0 {
+		max = params.KeepAliveMax
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	replies := make(chan error, 1)
+	pending := false
+	missed := 0
+
+	for {
+		select {
+		case <-ssn.done:
+			return
+
+		case err := <-replies:
+			if err != nil {
+				return
+			}
+			pending = false
+			missed = 0
+
+		case <-ticker.C:
+			if !pending {
+				pending = true
+				go func() {
+					_, _, err := ssn.SendRequest(SSH_KEEPALIVE_REQUEST,
+						true, nil)
+					replies <- err
+				}()
+				continue
+			}
+
+			missed++
+			if missed >= max {
+				ssn.transport.froxy.Info("SSH: server %q: %s, closing session",
+					params.Addr, ErrSSHKeepAlive)
+				ssn.abortErr <- ErrSSHKeepAlive
+				ssn.Close()
+				return
+			}
+		}
+	}
 }
 
 //
@@ -161,6 +520,7 @@ func (conn *sshConn) Close() error {
 		err = conn.Conn.Close()
 
 		t.froxy.DecCounter(&t.froxy.Counters.SSHConnections)
+		t.froxy.DecCounter(&t.counters.SSHConnections)
 		conn.session.unref()
 	}
 
@@ -171,7 +531,15 @@ func (conn *sshConn) Close() error {
 //
 // Create new SSH transport
 //
-func NewSSHTransport(froxy *Froxy) *SSHTransport {
+// The server parameter is the ServerParams.Ident() of the
+// server this transport is bound to. For the transport that
+// uses all servers, server is "". Only this transport reports
+// its state as the Froxy connection state
+//
+// Transport, bound to the particular server, must be configured
+// by calling Reconnect() after creation
+//
+func NewSSHTransport(froxy *Froxy, server string) *SSHTransport {
 	t := &SSHTransport{
 		Transport: http.Transport{
 			Proxy:                 nil,
@@ -180,6 +548,7 @@ func NewSSHTransport(froxy *Froxy) *SSHTransport {
 			ExpectContinueTimeout: HTTP_EXPECT_CONTINUE_TIMEOUT,
 		},
 		froxy:    froxy,
+		server:   server,
 		sessions: make(map[*sshSession]struct{}),
 	}
 
@@ -189,16 +558,56 @@ func NewSSHTransport(froxy *Froxy) *SSHTransport {
 		return conn, err
 	}
 
-	t.Reconnect(t.froxy.GetServerParams())
+	if server == "" {
+		t.Reconnect(t.froxy.GetServers())
+	}
 
 	return t
 }
 
+//
+// Get statistic counters
+//
+func (t *SSHTransport) GetCounters() SSHTransportCounters {
+	return SSHTransportCounters{
+		Server: t.server,
+		SSHCounters: SSHCounters{
+			SSHSessions:    atomic.LoadInt32(&t.counters.SSHSessions),
+			SSHConnections: atomic.LoadInt32(&t.counters.SSHConnections),
+		},
+	}
+}
+
+//
+// Set connection state
+//
+// Only transport that uses all servers affects the Froxy
+// connection state. Per-server transports only report host
+// key mismatches
+//
+func (t *SSHTransport) setConnState(state ConnState, err error) {
+	if t.server == "" {
+		t.froxy.SetConnState(state, err)
+		return
+	}
+
+	if err != nil {
+		t.froxy.Debug("SSH: server %q: %s", t.server, err)
+	}
+
+	if state == ConnHostKeyMismatch {
+		t.froxy.SetServerHostKeyMismatch(t.server, err)
+	} else {
+		t.froxy.SetServerHostKeyMismatch(t.server, nil)
+	}
+}
+
 //
 // Reconnect to the server
 //
-// This function updates server connection parameters, which
-// may either cause a disconnect or [re]connect
+// This function updates servers connection parameters, which
+// may either cause a disconnect or [re]connect. Servers are
+// listed in order of preference
 //
 // In a case of [re]connect this function doesn't establish server
 // connection immediately, it only initiates asynchronous process of
@@ -207,13 +616,13 @@ func NewSSHTransport(froxy *Froxy) *SSHTransport {
 // In a case of disconnect, this function synchronously waits until
 // all active connections has gone away
 //
-func (t *SSHTransport) Reconnect(params ServerParams) {
+func (t *SSHTransport) Reconnect(servers []ServerParams) {
 	// Synchronize with disconnect logic
 	t.disconnectLock.Lock()
 	defer t.disconnectLock.Unlock()
 
 	// Something changed?
-	if t.ctx != nil && t.ctx.ServerParamsEqual(&params) {
+	if t.ctx != nil && t.ctx.ServerParamsEqual(servers) {
 		return
 	}
 
@@ -224,16 +633,88 @@ func (t *SSHTransport) Reconnect(params ServerParams) {
 		t.disconnectWait.Wait()
 	}
 
-	t.ctx = newSshContext(t.froxy, &params)
+	t.ctx = newSshContext(t.froxy, servers)
 
 	// Update connection state
 	if t.ctx.ok {
-		t.froxy.SetConnState(ConnTrying, "")
+		t.setConnState(ConnTrying, nil)
 	} else {
-		t.froxy.SetConnState(ConnNotConfigured, "")
+		t.setConnState(ConnNotConfigured, nil)
+	}
+
+	if t.eager {
+		t.startSupervisor()
+	}
+}
+
+//
+// Connect eagerly: keep at least one session established,
+// even without requests. See supervisor for details
+//
+func (t *SSHTransport) ConnectEagerly() {
+	t.disconnectLock.Lock()
+	defer t.disconnectLock.Unlock()
+
+	if !t.eager {
+		t.eager = true
+		t.startSupervisor()
+	}
+}
+
+//
+// Start supervisor for the current context
+//
+// MUST be called under t.disconnectLock
+//
+func (t *SSHTransport) startSupervisor() {
+	if t.ctx.ok {
+		t.disconnectWait.Add(1)
+		go t.supervisor(t.ctx)
 	}
 }
 
+//
+// Get retry schedule of the current context. See
+// sshContext.RetrySchedule for details
+//
+func (t *SSHTransport) RetrySchedule() (int, time.Time) {
+	t.disconnectLock.RLock()
+	ctx := t.ctx
+	t.disconnectLock.RUnlock()
+
+	return ctx.RetrySchedule()
+}
+
+//
+// Retry connection immediately, if retry is scheduled
+//
+func (t *SSHTransport) RetryNow() {
+	t.disconnectLock.RLock()
+	ctx := t.ctx
+	t.disconnectLock.RUnlock()
+
+	select {
+	case ctx.retryNow <- struct{}{}:
+	default:
+	}
+}
+
+//
+// Get address of the active server. Returns empty string
+// if servers are not configured
+//
+func (t *SSHTransport) ActiveServer() string {
+	t.disconnectLock.RLock()
+	ctx := t.ctx
+	t.disconnectLock.RUnlock()
+
+	if !ctx.ok {
+		return ""
+	}
+
+	return ctx.Active().params.Addr
+}
+
 //
 // Dial new TCP connection, routed via server
 //
@@ -253,7 +734,6 @@ func (t *SSHTransport) Dial(net, addr string) (net.Conn, error) {
 	// Obtain SSH session
 	session, err := t.getSession(ctx)
 	if err != nil {
-		err = fmt.Errorf("Can't connect to the server %q: %s", ctx.params.Addr, err)
 		return nil, err
 	}
 
@@ -262,12 +742,24 @@ func (t *SSHTransport) Dial(net, addr string) (net.Conn, error) {
 	if err != nil {
 		t.froxy.Debug("SSH conn: %s", err)
 		session.unref()
+
+		// Port forwarding, prohibited by the server, is reported
+		// as connection problem, as nothing works without it
+		var chanErr *ssh.OpenChannelError
+		if errors.As(err, &chanErr) && chanErr.Reason == ssh.Prohibited {
+			err = &SSHDialError{Addr: addr, Err: err}
+			t.setConnState(ConnEstablished, err)
+			return nil, err
+		}
+
 		err = fmt.Errorf("Server can't connect to %q: %s", addr, err)
 		return nil, err
 	}
 
 	t.froxy.Debug("SSH: connection established")
+	t.setConnState(ConnEstablished, nil)
 	t.froxy.IncCounter(&t.froxy.Counters.SSHConnections)
+	t.froxy.IncCounter(&t.counters.SSHConnections)
 
 	return &sshConn{Conn: conn, session: session}, nil
 }
@@ -346,34 +838,145 @@ func (t *SSHTransport) spareSession() *sshSession {
 //
 // Establish a new client session
 //
+// Servers are tried in order, starting from the active one,
+// until connection succeeds. On success, the server that
+// accepted the connection becomes active
+//
 func (t *SSHTransport) newSession(ctx *sshContext) (*sshSession, error) {
-	// Create SSH configuration
-	cfg := ctx.SshClientConfig()
+	active := ctx.Active()
+	var err error
+
+	for i := range ctx.servers {
+		srv := ctx.servers[(active.index+i)%len(ctx.servers)]
+		if !srv.ok {
+			continue
+		}
+
+		var session *sshSession
+		session, err = t.newServerSession(ctx, srv)
+		if err == nil {
+			if ctx.SetActive(srv) && t.server == "" {
+				t.froxy.Info("SSH: switched to the server %q",
+					srv.params.Addr)
+				t.froxy.Raise(EventConnStateChanged)
+			}
+			return session, nil
+		}
+
+		err = fmt.Errorf("Can't connect to the server %q: %w",
+			srv.params.Addr, err)
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		if len(ctx.servers) > 1 {
+			t.froxy.Info("SSH: %s", err)
+		}
+	}
+
+	return nil, err
+}
+
+//
+// Establish a new client session with the particular server
+//
+func (t *SSHTransport) newServerSession(ctx *sshContext,
+	srv *sshServer) (*sshSession, error) {
+
+	// Servers to connect to: jump hosts, then the server itself
+	hops := append(srv.hops[:len(srv.hops):len(srv.hops)], srv)
+	jumps := []*ssh.Client{}
+
+	closeJumps := func() {
+		for i := len(jumps) - 1; i >= 0; i-- {
+			jumps[i].Close()
+		}
+	}
 
-	// Dial a new network connection
-	addr := NetDefaultPort(ctx.params.Addr, "22")
-	conn, err := t.froxy.connMan.DialContext(ctx, "tcp", addr,
-		&t.froxy.Counters.SSHSessions)
+	// Dial a new network connection to the first hop, either
+	// directly, via the proxy command or via the tunnel. Direct
+	// and tunnel connections may go via the upstream proxy
+	var conn net.Conn
+	var err error
+	addr := NetDefaultPort(hops[0].params.Addr, "22")
+
+	var dial NetDialFunc = func(ctx context.Context, network, addr string) (
+		net.Conn, error) {
+		conn, err := t.froxy.connMan.DialContext(ctx, network, addr,
+			&t.froxy.Counters.SSHSessions)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	if srv.params.Proxy != "" {
+		dial, err = UpstreamProxyDialer(srv.params.Proxy, dial)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case srv.params.Command != "":
+		command := ProxyCommandExpand(srv.params.Command, addr,
+			hops[0].params.Login)
+		conn, err = ProxyCommandDial(ctx, t.froxy, command,
+			&t.froxy.Counters.SSHSessions)
+
+	case srv.params.Tunnel != SSHTunnelNone:
+		tunnel := srv.params
+		tunnel.Addr = hops[0].params.Addr
+		conn, err = SSHTunnelDial(ctx, &tunnel, dial)
+
+	default:
+		conn, err = dial(ctx, "tcp", addr)
+	}
 
 	if err != nil {
 		t.froxy.Debug("SSH connect: %s", err)
-		return nil, err
+		return nil, sshHopError(srv, hops[0], err)
 	}
 
-	// Perform SSH handshake
-	c, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
-	if err != nil {
-		t.froxy.Debug("SSH auth: %s", err)
-		return nil, err
+	// Connect to each hop via the previous one
+	var client *ssh.Client
+	for i, hop := range hops {
+		if i != 0 {
+			addr = NetDefaultPort(hop.params.Addr, "22")
+			conn, err = jumps[i-1].Dial("tcp", addr)
+			if err != nil {
+				t.froxy.Debug("SSH connect via %q: %s",
+					hops[i-1].params.Addr, err)
+				closeJumps()
+				return nil, sshHopError(srv, hop, err)
+			}
+		}
+
+		client, err = t.handshake(ctx, conn, addr, hop)
+		if err != nil {
+			closeJumps()
+			if _, ok := err.(*HostKeyMismatchError); ok {
+				return nil, err
+			}
+			return nil, sshHopError(srv, hop, err)
+		}
+
+		if hop != srv {
+			jumps = append(jumps, client)
+		}
 	}
 
-	t.froxy.SetConnState(ConnEstablished, "")
+	t.setConnState(ConnEstablished, nil)
+	t.froxy.IncCounter(&t.counters.SSHSessions)
 
 	// Create &sshSession structure
 	session := &sshSession{
-		Client:    ssh.NewClient(c, chans, reqs),
+		Client:    client,
 		transport: t,
 		refcnt:    1,
+		done:      make(chan struct{}),
+		abortErr:  make(chan error, 1),
 	}
 
 	t.sessionsLock.Lock()
@@ -385,14 +988,22 @@ func (t *SSHTransport) newSession(ctx *sshContext) (*sshSession, error) {
 	// Wait in background for connection termination
 	go func() {
 		err := session.Wait()
+		closeJumps()
+		close(session.done)
+
+		select {
+		case err = <-session.abortErr:
+		default:
+		}
 
 		t.sessionsLock.Lock()
 
 		delete(t.sessions, session)
+		t.froxy.DecCounter(&t.counters.SSHSessions)
 
 		t.sessionsCount--
 		if t.sessionsCount == 0 && ctx.Err() == nil {
-			t.froxy.SetConnState(ConnTrying, err.Error())
+			t.setConnState(ConnTrying, err)
 		}
 
 		t.sessionsLock.Unlock()
@@ -401,5 +1012,162 @@ func (t *SSHTransport) newSession(ctx *sshContext) (*sshSession, error) {
 		t.disconnectWait.Done()
 	}()
 
+	go session.keepalive(&srv.params)
+
 	return session, nil
 }
+
+//
+// Perform SSH handshake with the server over the established
+// connection
+//
+// Handshake is aborted, if ctx is canceled while in progress
+//
+func (t *SSHTransport) handshake(ctx context.Context, conn net.Conn,
+	addr string, srv *sshServer) (*ssh.Client, error) {
+
+	// Create SSH configuration
+	offered := &sshAuthOffered{}
+	cfg, err := srv.SshClientConfig(ctx, offered)
+	if err != nil {
+		t.froxy.Debug("SSH auth: %s", err)
+		conn.Close()
+		return nil, err
+	}
+
+	// Perform SSH handshake
+	//
+	// ssh.NewClientConn doesn't preserve the error, returned by
+	// the HostKeyCallback, so we have to catch it here
+	var hostKeyErr error
+	hostKeyCallback := cfg.HostKeyCallback
+	cfg.HostKeyCallback = func(hostname string, remote net.Addr,
+		key ssh.PublicKey) error {
+		hostKeyErr = hostKeyCallback(hostname, remote, key)
+		return hostKeyErr
+	}
+
+	// Close connection, if ctx is canceled during handshake
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	close(done)
+
+	if err != nil {
+		t.froxy.Debug("SSH auth: %s", err)
+
+		if hostKeyErr != nil {
+			t.setConnState(ConnHostKeyMismatch, hostKeyErr)
+			return nil, hostKeyErr
+		}
+
+		if offered.Rejected(err) {
+			err = &SSHAuthError{Methods: offered.methods, Err: err}
+		}
+
+		return nil, err
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+//
+// Wrap the error, so it reports jump host that failed. Errors of
+// the server itself are returned as is
+//
+func sshHopError(srv, hop *sshServer, err error) error {
+	if hop == srv {
+		return err
+	}
+	return fmt.Errorf("jump host %q: %w", hop.params.Addr, err)
+}
+
+// ----- Connection supervisor -----
+//
+// Keep at least one session with the server established
+//
+// After failure, connection is retried with exponential backoff
+// and jitter. The backoff is reset when local IP addresses change,
+// as it is likely that network is available again. Supervisor exits
+// when context is canceled
+//
+func (t *SSHTransport) supervisor(ctx *sshContext) {
+	defer t.disconnectWait.Done()
+
+	events := t.froxy.Sub(EventIpAddrChanged)
+	defer t.froxy.Unsub(events)
+
+	attempts := 0
+	for ctx.Err() == nil {
+		// Hold the session, while it is alive
+		session, err := t.getSession(ctx)
+		if err == nil {
+			attempts = 0
+			ctx.setRetrySchedule(0, time.Time{})
+
+			for alive := true; alive; {
+				select {
+				case <-events:
+				case <-session.done:
+					alive = false
+				case <-ctx.Done():
+					alive = false
+				}
+			}
+
+			session.unref()
+			continue
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		// Schedule the next attempt
+		attempts++
+		delay := sshRetryDelay(attempts)
+		ctx.setRetrySchedule(attempts, time.Now().Add(delay))
+
+		t.froxy.Debug("SSH: attempt %d failed, retry in %s",
+			attempts, delay)
+
+		if t.froxy.mainConnState() != ConnHostKeyMismatch {
+			t.setConnState(ConnTrying, err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.retryNow:
+		case <-events:
+			attempts = 0
+		case <-ctx.Done():
+		}
+		timer.Stop()
+
+		ctx.setRetrySchedule(attempts, time.Time{})
+	}
+}
+
+//
+// Compute delay before the next connection attempt. Delay grows
+// exponentially, and randomized to avoid synchronized retries
+//
+func sshRetryDelay(attempts int) time.Duration {
+	delay := SSH_RETRY_MAX
+	if attempts < 32 {
+		delay = SSH_RETRY_MIN << uint(attempts-1)
+		if delay > SSH_RETRY_MAX || delay <= 0 {
+			delay = SSH_RETRY_MAX
+		}
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,619 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// SSH transport test
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alexpevzner/froxy/internal/keys"
+	"golang.org/x/crypto/ssh"
+)
+
+//
+// Create minimal Froxy instance, sufficient for SSHTransport.
+// State is saved into the dir
+//
+func sshTestFroxy(dir string, servers []ServerParams) *Froxy {
+	env := &Env{
+		state:             &State{Servers: servers},
+		PathUserStateFile: filepath.Join(dir, "state"),
+	}
+
+	froxy := &Froxy{
+		Env:    env,
+		Ebus:   NewEbus(),
+		KeySet: &KeySet{env: env, keys: make(map[string]*keys.Key)},
+	}
+
+	froxy.challenges = NewChallenges(froxy)
+	froxy.connMan = NewConnMan(froxy)
+
+	return froxy
+}
+
+//
+// Start in-process SSH server. If cfg is nil, server accepts
+// any password. Server forwards direct-tcpip channels, so it
+// can be used as a jump host. Returns its listener
+//
+func sshTestServer(t *testing.T, cfg *ssh.ServerConfig) net.Listener {
+	return sshTestServerRequests(t, cfg, ssh.DiscardRequests)
+}
+
+//
+// Start in-process SSH server, like sshTestServer, but global
+// requests are handled by the reqHandler
+//
+func sshTestServerRequests(t *testing.T, cfg *ssh.ServerConfig,
+	reqHandler func(<-chan *ssh.Request)) net.Listener {
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if cfg == nil {
+		cfg = &ssh.ServerConfig{
+			PasswordCallback: func(ssh.ConnMetadata, []byte) (
+				*ssh.Permissions, error) {
+				return nil, nil
+			},
+		}
+	}
+	cfg.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+				if err == nil {
+					go reqHandler(reqs)
+					for ch := range chans {
+						go sshTestForward(ch)
+					}
+				}
+			}()
+		}
+	}()
+
+	return l
+}
+
+//
+// Forward direct-tcpip channel to its destination
+//
+func sshTestForward(ch ssh.NewChannel) {
+	// RFC 4254, 7.2: host, port, originator host, originator port
+	data := ch.ExtraData()
+	if ch.ChannelType() != "direct-tcpip" || len(data) < 4 {
+		ch.Reject(ssh.Prohibited, "test")
+		return
+	}
+
+	l := binary.BigEndian.Uint32(data)
+	if len(data) < 8+int(l) {
+		ch.Reject(ssh.ConnectionFailed, "test")
+		return
+	}
+
+	host := string(data[4 : 4+l])
+	port := binary.BigEndian.Uint32(data[4+l:])
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(host,
+		strconv.Itoa(int(port))))
+	if err != nil {
+		ch.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	c, reqs, err := ch.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(c, conn)
+		c.Close()
+	}()
+
+	io.Copy(conn, c)
+	conn.Close()
+}
+
+//
+// Test failover to the next server, when active server fails
+//
+func TestSSHFailover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "froxy")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	l0 := sshTestServer(t, nil)
+	defer l0.Close()
+	l1 := sshTestServer(t, nil)
+	defer l1.Close()
+
+	servers := []ServerParams{
+		{Addr: l0.Addr().String(), Login: "test", Password: "test"},
+		{Addr: l1.Addr().String(), Login: "test", Password: "test"},
+	}
+
+	froxy := sshTestFroxy(dir, servers)
+	tr := NewSSHTransport(froxy, "")
+	defer tr.Reconnect(nil)
+
+	// Connect to the first server
+	session, err := tr.getSession(tr.ctx)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if active := tr.ActiveServer(); active != servers[0].Addr {
+		t.Fatalf("active server %q, expected %q", active, servers[0].Addr)
+	}
+
+	// Fail the first server
+	l0.Close()
+	session.Close()
+	<-session.done
+	session.unref()
+
+	// Reconnect must switch to the second server
+	session, err = tr.getSession(tr.ctx)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer session.unref()
+
+	if active := tr.ctx.Active(); active != tr.ctx.servers[1] {
+		t.Fatalf("active server %q, expected %q",
+			active.params.Addr, servers[1].Addr)
+	}
+}
+
+//
+// Test that host keys, learned at runtime, don't cause reconnect,
+// and host key mismatch of per-server transport is reported
+//
+func TestSSHHostKeyLearned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "froxy")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	servers := []ServerParams{
+		{Addr: "example.com", Login: "test", Password: "test",
+			Jump: []ServerParams{{Addr: "jump.example.com",
+				Login: "test", Password: "test"}}},
+	}
+
+	froxy := sshTestFroxy(dir, servers)
+	ctx := newSshContext(froxy, servers)
+
+	// Keys, learned by another transport, are adopted
+	learned := []ServerParams{servers[0]}
+	learned[0].HostKey = "SHA256:server"
+	learned[0].Jump = []ServerParams{servers[0].Jump[0]}
+	learned[0].Jump[0].HostKey = "SHA256:jump"
+
+	if !ctx.ServerParamsEqual(learned) {
+		t.Fatalf("learned host keys cause reconnect")
+	}
+
+	if !ctx.ServerParamsEqual(learned) {
+		t.Fatalf("adopted host keys cause reconnect")
+	}
+
+	// Another key, or forgotten key, means reconnect
+	changed := []ServerParams{learned[0]}
+	changed[0].HostKey = "SHA256:other"
+	if ctx.ServerParamsEqual(changed) {
+		t.Fatalf("changed host key doesn't cause reconnect")
+	}
+
+	changed[0].HostKey = ""
+	if ctx.ServerParamsEqual(changed) {
+		t.Fatalf("forgotten host key doesn't cause reconnect")
+	}
+
+	// Mismatch, seen by per-server transport, is reported until resolved
+	tr := &SSHTransport{froxy: froxy, server: "example.com"}
+	mismatch := &HostKeyMismatchError{Addr: "example.com",
+		Old: "SHA256:server", New: "SHA256:other"}
+
+	tr.setConnState(ConnHostKeyMismatch, mismatch)
+	state, _, err := froxy.GetConnState()
+	if state != ConnHostKeyMismatch || err != mismatch {
+		t.Fatalf("mismatch not reported: %v %v", state, err)
+	}
+
+	tr.setConnState(ConnEstablished, nil)
+	if state, _, _ = froxy.GetConnState(); state == ConnHostKeyMismatch {
+		t.Fatalf("resolved mismatch still reported")
+	}
+}
+
+//
+// Start SSH server, that accepts password of the given user,
+// and sends names of authenticated users into the channel
+//
+func sshTestJumpServer(t *testing.T, user string,
+	users chan<- string) net.Listener {
+
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (
+			*ssh.Permissions, error) {
+			if conn.User() != user || string(password) != user {
+				return nil, errors.New("rejected")
+			}
+			users <- conn.User()
+			return nil, nil
+		},
+	}
+
+	return sshTestServer(t, cfg)
+}
+
+//
+// Test connection to the server via chain of jump hosts
+//
+func TestSSHJumpChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "froxy")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	users := make(chan string, 10)
+	l1 := sshTestJumpServer(t, "jump1", users)
+	defer l1.Close()
+	l2 := sshTestJumpServer(t, "jump2", users)
+	defer l2.Close()
+	ls := sshTestJumpServer(t, "server", users)
+	defer ls.Close()
+
+	servers := []ServerParams{
+		{Addr: ls.Addr().String(), Login: "server", Password: "server",
+			Jump: []ServerParams{
+				{Addr: l1.Addr().String(), Login: "jump1",
+					Password: "jump1"},
+				{Addr: l2.Addr().String(), Login: "jump2",
+					Password: "jump2"},
+			}},
+	}
+
+	froxy := sshTestFroxy(dir, servers)
+	tr := NewSSHTransport(froxy, "")
+	defer tr.Reconnect(nil)
+
+	session, err := tr.getSession(tr.ctx)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	session.unref()
+
+	// Hops are connected in order, each via the previous one
+	order := []string{<-users, <-users, <-users}
+
+	if !reflect.DeepEqual(order, []string{"jump1", "jump2", "server"}) {
+		t.Errorf("connection order: %v", order)
+	}
+
+	// Host keys of all hops are learned
+	saved := froxy.GetServers()[0]
+	for _, s := range []ServerParams{saved, saved.Jump[0], saved.Jump[1]} {
+		if s.HostKey == "" {
+			t.Errorf("%s: host key not learned", s.Addr)
+		}
+	}
+
+	// Failed hop is reported
+	l2.Close()
+	tr2 := NewSSHTransport(froxy, "")
+	defer tr2.Reconnect(nil)
+
+	_, err = tr2.getSession(tr2.ctx)
+	if err == nil {
+		t.Fatalf("connect via closed jump host: error expected")
+	}
+
+	hop := fmt.Sprintf("jump host %q", servers[0].Jump[1].Addr)
+	if !strings.Contains(err.Error(), hop) {
+		t.Errorf("%s: %s not reported", err, hop)
+	}
+}
+
+//
+// Test that parameters of jump hosts are checked
+//
+func TestSSHJumpCheck(t *testing.T) {
+	jump := func(hop ServerParams) ServerParams {
+		return ServerParams{Addr: "example.com", Login: "test",
+			Password: "test", Jump: []ServerParams{
+				{Addr: "jump1.example.com", Login: "test",
+					Password: "test", Jump: []ServerParams{hop}},
+			}}
+	}
+
+	hop := ServerParams{Addr: "jump2.example.com", Login: "test",
+		Password: "test"}
+	if err := webapiCheckServer(&[]ServerParams{jump(hop)}[0]); err != nil {
+		t.Errorf("%s", err)
+	}
+
+	bad := []ServerParams{
+		{Addr: "jump2.example.com", TOTP: "not base32!"},
+		{Addr: "jump2.example.com", Tunnel: "unknown"},
+		{Addr: "jump2.example.com", Tunnel: SSHTunnelWebSocket},
+		{Addr: "jump2.example.com", Proxy: "ftp://proxy.example.com"},
+	}
+
+	for _, hop := range bad {
+		s := jump(hop)
+		err := webapiCheckServer(&s)
+		if err == nil {
+			t.Errorf("%+v: error expected", hop)
+		} else if !strings.Contains(err.Error(), "jump2.example.com") {
+			t.Errorf("%s: bad hop not reported", err)
+		}
+	}
+}
+
+//
+// Test that session, which stops answering keepalive requests,
+// is closed, and session, which answers, is kept
+//
+func TestSSHKeepAlive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "froxy")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Dead server receives requests, but never replies
+	dead := sshTestServerRequests(t, nil, func(reqs <-chan *ssh.Request) {
+		for range reqs {
+		}
+	})
+	defer dead.Close()
+
+	alive := sshTestServer(t, nil)
+	defer alive.Close()
+
+	sessions := []*sshSession{}
+	for _, l := range []net.Listener{dead, alive} {
+		servers := []ServerParams{
+			{Addr: l.Addr().String(), Login: "test", Password: "test",
+				KeepAlive: 1, KeepAliveMax: 1},
+		}
+
+		froxy := sshTestFroxy(dir, servers)
+		tr := NewSSHTransport(froxy, "")
+		defer tr.Reconnect(nil)
+
+		session, err := tr.getSession(tr.ctx)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		defer session.unref()
+
+		sessions = append(sessions, session)
+	}
+
+	select {
+	case <-sessions[0].done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("dead session is not closed")
+	}
+
+	// Connection state is updated after session is done
+	froxy := sessions[0].transport.froxy
+	state, _, err := froxy.GetConnState()
+	for i := 0; i < 100 && state != ConnTrying; i++ {
+		time.Sleep(10 * time.Millisecond)
+		state, _, err = froxy.GetConnState()
+	}
+
+	if state != ConnTrying || err != ErrSSHKeepAlive {
+		t.Errorf("dead session: state %v, error %v", state, err)
+	}
+
+	select {
+	case <-sessions[1].done:
+		t.Errorf("alive session is closed")
+	default:
+	}
+}
+
+//
+// Test bounds of the retry delay
+//
+func TestSSHRetryDelay(t *testing.T) {
+	for attempts := 1; attempts <= 40; attempts++ {
+		max := SSH_RETRY_MAX
+		if attempts < 10 {
+			max = SSH_RETRY_MIN * time.Duration(1<<uint(attempts-1))
+			if max > SSH_RETRY_MAX {
+				max = SSH_RETRY_MAX
+			}
+		}
+
+		for i := 0; i < 100; i++ {
+			delay := sshRetryDelay(attempts)
+			if delay < max/2 || delay > max {
+				t.Fatalf("attempt %d: delay %s out of [%s, %s]",
+					attempts, delay, max/2, max)
+			}
+		}
+	}
+}
+
+//
+// Wait until condition becomes true
+//
+func sshTestWait(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("timeout waiting for %s", what)
+}
+
+//
+// Test that supervisor connects eagerly
+//
+func TestSSHSupervisorConnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "froxy")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := sshTestServer(t, nil)
+	defer l.Close()
+
+	froxy := sshTestFroxy(dir, []ServerParams{
+		{Addr: l.Addr().String(), Login: "test", Password: "test"},
+	})
+	tr := NewSSHTransport(froxy, "")
+	defer tr.Reconnect(nil)
+
+	if state, _, _ := froxy.GetConnState(); state != ConnTrying {
+		t.Fatalf("connected before ConnectEagerly: %v", state)
+	}
+
+	tr.ConnectEagerly()
+	sshTestWait(t, "connection", func() bool {
+		state, _, _ := froxy.GetConnState()
+		return state == ConnEstablished
+	})
+
+	if attempts, next := tr.RetrySchedule(); attempts != 0 ||
+		!next.IsZero() {
+		t.Errorf("retry schedule: %d %s", attempts, next)
+	}
+
+	// Warm session is used for connections
+	session, err := tr.getSession(tr.ctx)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer session.unref()
+
+	if session.refcnt != 2 {
+		t.Errorf("supervisor's session is not reused")
+	}
+}
+
+//
+// Test retry with backoff, RetryNow and backoff reset on
+// change of IP addresses
+//
+func TestSSHSupervisorRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "froxy")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var authCount int32
+	l := sshTestServer(t, &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (
+			*ssh.Permissions, error) {
+			atomic.AddInt32(&authCount, 1)
+			return nil, errors.New("rejected")
+		},
+	})
+	defer l.Close()
+
+	froxy := sshTestFroxy(dir, []ServerParams{
+		{Addr: l.Addr().String(), Login: "test", Password: "test"},
+	})
+	tr := NewSSHTransport(froxy, "")
+	defer tr.Reconnect(nil)
+
+	// Wait for the retry schedule after given count of failed
+	// attempts in a row, check total count of attempts made
+	schedule := func(attempts, made int) time.Time {
+		var next time.Time
+		sshTestWait(t, fmt.Sprintf("attempt %d", attempts), func() bool {
+			var n int
+			n, next = tr.RetrySchedule()
+			return n == attempts && !next.IsZero()
+		})
+
+		if n := atomic.LoadInt32(&authCount); n != int32(made) {
+			t.Fatalf("%d attempts made, %d expected", n, made)
+		}
+
+		return next
+	}
+
+	start := time.Now()
+	tr.ConnectEagerly()
+
+	next := schedule(1, 1)
+	if delay := next.Sub(start); delay < SSH_RETRY_MIN/2 ||
+		delay > SSH_RETRY_MIN+time.Second {
+		t.Errorf("first retry in %s", delay)
+	}
+
+	state, _, err := froxy.GetConnState()
+	if state != ConnTrying || err == nil {
+		t.Errorf("state %v, error %v", state, err)
+	}
+
+	// Retry immediately, backoff grows
+	tr.RetryNow()
+	schedule(2, 2)
+	if time.Now().After(next) {
+		t.Errorf("RetryNow doesn't retry immediately")
+	}
+
+	// Change of IP addresses resets backoff
+	froxy.Raise(EventIpAddrChanged)
+	schedule(1, 3)
+}
@@ -10,9 +10,14 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/alexpevzner/froxy/internal/sysdep"
 )
@@ -21,28 +26,307 @@ import (
 // The persistent state
 //
 type State struct {
-	Port   int          `json:"port"`   // TCP port Froxy runs on
-	Server ServerParams `json:"server"` // Server parameters
-	Sites  []SiteParams `json:"sites"`  // List of forwarded sites
+	Port         int            `json:"port"`                    // TCP port Froxy runs on
+	Servers      []ServerParams `json:"servers"`                 // Servers, in order of preference
+	Sites        []SiteParams   `json:"sites"`                   // List of forwarded sites
+	ResolveHosts bool           `json:"resolve_hosts,omitempty"` // Match resolved addresses against CIDRs
+	Fallback     bool           `json:"fallback,omitempty"`      // Fallback to server if direct access fails
+	Learned      []LearnedSite  `json:"learned,omitempty"`       // Hosts that needed fallback
+	Subscribe    []Subscription `json:"subscribe,omitempty"`     // Subscriptions to site lists
+	Server       *ServerParams  `json:"server,omitempty"`        // Obsolete, single server
 }
 
 //
 // Server parameters
 //
+// Server authenticates by Froxy key, if Keyid is set, by key from
+// SSH agent, if Agent is set, or by password otherwise
+//
+// If Tunnel is set, SSH stream is wrapped into TLS or WebSocket, to
+// pass networks that allow only HTTP/HTTPS ports
+//
+// If Proxy is set, connection to the server goes via the upstream
+// HTTP CONNECT or SOCKS5 proxy, specified by URL
+//
+// If Command is set, Froxy runs it and uses its stdin/stdout instead
+// of the TCP connection, like OpenSSH ProxyCommand does. The command
+// reaches the first jump host, if any, or the server itself
+//
+// Froxy periodically sends keepalive requests to the server and
+// reconnects, if server stops answering. KeepAlive is the interval
+// in seconds, 0 for default, negative to disable; KeepAliveMax is
+// the count of unanswered intervals, 0 for default
+//
+// If Jump is not empty, Froxy connects to the server via chain of
+// jump hosts, each with its own login and authentication. The first
+// jump host is connected directly, and each next host, including
+// the server itself, via the previous one
+//
+// If server asks keyboard-interactive questions (i.e., for the
+// one-time code), Froxy answers them with password and, if TOTP
+// seed is set, with the one-time code, and asks user otherwise
+//
 type ServerParams struct {
+	Name     string `json:"name,omitempty"`     // Server name, optional
 	Addr     string `json:"addr,omitempty"`     // Server address
 	Login    string `json:"login,omitempty"`    // Server login
 	Password string `json:"password,omitempty"` // Server password
 	Keyid    string `json:"keyid,omitempty"`    // Key ID
+	Agent    bool   `json:"agent,omitempty"`    // Use SSH agent
+	AgentKey string `json:"agentkey,omitempty"` // Agent key fingerprint, "" for any
+	TOTP     string `json:"totp,omitempty"`     // TOTP seed, base32
+	HostKey  string `json:"hostkey,omitempty"`  // Host key fingerprint
+	Command  string `json:"command,omitempty"`  // Proxy command, "" if none
+
+	// SSH over TLS or WebSocket
+	Tunnel SSHTunnel `json:"tunnel,omitempty"` // How to wrap SSH stream
+	SNI    string    `json:"sni,omitempty"`    // TLS server name, "" for host
+	URL    string    `json:"url,omitempty"`    // WebSocket URL, ws:// or wss://
+
+	// Upstream proxy, http:// or socks5://, "" if none
+	Proxy string `json:"proxy,omitempty"`
+
+	// Keepalive
+	KeepAlive    int `json:"keepalive,omitempty"`     // Interval, seconds
+	KeepAliveMax int `json:"keepalive_max,omitempty"` // Max unanswered
+
+	// Jump hosts, in order of connection
+	Jump []ServerParams `json:"jump,omitempty"`
 }
 
+//
+// How SSH stream is carried to the server
+//
+type SSHTunnel string
+
+const (
+	SSHTunnelNone      = SSHTunnel("")          // Plain TCP
+	SSHTunnelTLS       = SSHTunnel("tls")       // TLS, with optional SNI
+	SSHTunnelWebSocket = SSHTunnel("websocket") // WebSocket, binary frames
+)
+
 //
 // Site parameters
 //
+// By default, requests to the site are forwarded via server. If Block
+// is set, requests are blocked. If Bypass is set, requests go directly;
+// it allows to make exceptions for some hosts from the recursive rules
+//
 type SiteParams struct {
-	Host  string `json:"host,omitempty"`  // Host name
-	Rec   bool   `json:"rec,omitempty"`   // Recursive (with subdomains)
-	Block bool   `json:"block,omitempty"` // Block the site
+	Host   string     `json:"host,omitempty"`   // Host name or pattern
+	Type   SiteType   `json:"type,omitempty"`   // Type of Host
+	Port   string     `json:"port,omitempty"`   // Port constraint, "" for any
+	Scheme SiteScheme `json:"scheme,omitempty"` // Scheme constraint
+	Rec    bool       `json:"rec,omitempty"`    // Recursive (with subdomains)
+	Block  bool       `json:"block,omitempty"`  // Block the site
+	Bypass bool       `json:"bypass,omitempty"` // Connect to the site directly
+	Mode   BlockMode  `json:"mode,omitempty"`   // How to respond, if blocked
+	Server string     `json:"server,omitempty"` // Server to forward via, "" for any
+
+	// Optional expiration time and weekly schedule
+	Expires  *time.Time   `json:"expires,omitempty"`  // Site expiration time
+	Schedule []SiteWindow `json:"schedule,omitempty"` // When site is active
+}
+
+//
+// Site key. Identifies the site in the list of sites
+//
+// Multiple sites may share the same host, if they differ
+// in port or scheme constraints
+//
+type SiteKey struct {
+	Host   string     // Host name or pattern
+	Port   string     // Port constraint
+	Scheme SiteScheme // Scheme constraint
+}
+
+//
+// Subscription to the remotely maintained list of sites
+//
+// List is fetched from URL (http://, https:// or file://) periodically,
+// either directly, or, if Forward is set, via server. Fetched sites
+// are used as read-only layer under the user's own sites
+//
+type Subscription struct {
+	URL     string         `json:"url"`               // List URL
+	Format  SiteListFormat `json:"format,omitempty"`  // List format, "" to auto-detect
+	Forward bool           `json:"forward,omitempty"` // Fetch via server
+	Server  string         `json:"server,omitempty"`  // Server to fetch via, "" for any
+}
+
+//
+// Host that needed fallback from direct access to the server
+//
+// Once count of fallbacks reaches FALLBACK_LEARN_COUNT, the host
+// is considered learned, and its requests are forwarded to the
+// server without attempt of direct access
+//
+type LearnedSite struct {
+	Host  string    `json:"host"`  // Host name
+	Count int       `json:"count"` // Count of fallbacks
+	Last  time.Time `json:"last"`  // Time of the last fallback
+}
+
+//
+// Check if host is learned
+//
+func (l *LearnedSite) Learned() bool {
+	return l.Count >= FALLBACK_LEARN_COUNT
+}
+
+//
+// Type of SiteParams.Host
+//
+type SiteType string
+
+const (
+	SiteTypeDomain = SiteType("")       // Domain name
+	SiteTypeGlob   = SiteType("glob")   // Wildcard pattern ('*' and '?')
+	SiteTypeRegexp = SiteType("regexp") // Anchored regular expression
+	SiteTypeCIDR   = SiteType("cidr")   // IPv4 or IPv6 CIDR block
+)
+
+//
+// Scheme of request, used as site constraint
+//
+type SiteScheme string
+
+const (
+	SiteSchemeAny     = SiteScheme("")        // Any scheme
+	SiteSchemeHTTP    = SiteScheme("http")    // HTTP requests
+	SiteSchemeFTP     = SiteScheme("ftp")     // FTP requests
+	SiteSchemeConnect = SiteScheme("connect") // CONNECT (HTTPS and tunnels)
+)
+
+//
+// How to respond to the blocked request
+//
+type BlockMode string
+
+const (
+	BlockModePage  = BlockMode("")      // Error page with 403 status
+	BlockModeEmpty = BlockMode("empty") // Empty response with 204 status
+	BlockModePixel = BlockMode("pixel") // Transparent GIF, empty JS or CSS
+	BlockModeClose = BlockMode("close") // Close connection immediately
+)
+
+//
+// Get site key
+//
+func (s *SiteParams) Key() SiteKey {
+	return SiteKey{s.Host, s.Port, s.Scheme}
+}
+
+//
+// Check if site matches the key. Hosts are compared
+// case-insensitively
+//
+func (s *SiteParams) MatchKey(key SiteKey) bool {
+	return strings.EqualFold(s.Host, key.Host) &&
+		s.Port == key.Port && s.Scheme == key.Scheme
+}
+
+//
+// Validate site port and scheme constraints, schedule and site action
+//
+func (s *SiteParams) CheckConstraints() error {
+	if s.Block && s.Bypass {
+		return errors.New("Site cannot be both blocked and bypassed")
+	}
+
+	switch s.Mode {
+	case BlockModePage, BlockModeEmpty, BlockModePixel, BlockModeClose:
+	default:
+		return fmt.Errorf("Invalid block mode %q", s.Mode)
+	}
+
+	switch s.Scheme {
+	case SiteSchemeAny, SiteSchemeHTTP, SiteSchemeFTP, SiteSchemeConnect:
+	default:
+		return fmt.Errorf("Invalid scheme %q", s.Scheme)
+	}
+
+	if s.Port != "" {
+		port, err := strconv.Atoi(s.Port)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("Invalid port %q", s.Port)
+		}
+	}
+
+	for _, w := range s.Schedule {
+		if err := w.Check(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//
+// Count site constraints. Site with more constraints
+// is more specific. Schedule counts as constraint
+//
+func (s *SiteParams) Constraints() int {
+	n := 0
+	if s.Port != "" {
+		n++
+	}
+	if s.Scheme != SiteSchemeAny {
+		n++
+	}
+	if len(s.Schedule) != 0 {
+		n++
+	}
+	return n
+}
+
+//
+// Check if site is timed, i.e., has expiration time or schedule
+//
+func (s *SiteParams) Timed() bool {
+	return s.Expires != nil || len(s.Schedule) != 0
+}
+
+//
+// Check if site is active at the given time: not expired
+// and within the schedule, if any
+//
+func (s *SiteParams) Active(t time.Time) bool {
+	if s.Expires != nil && !t.Before(*s.Expires) {
+		return false
+	}
+
+	if len(s.Schedule) == 0 {
+		return true
+	}
+
+	for _, w := range s.Schedule {
+		if w.Match(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//
+// Check if request port and scheme satisfy site constraints
+//
+func (s *SiteParams) MatchConstraints(port string, scheme SiteScheme) bool {
+	return (s.Port == "" || s.Port == port) &&
+		(s.Scheme == SiteSchemeAny || s.Scheme == scheme)
+}
+
+//
+// Get server identifier, used to refer the server from
+// the SiteParams. This is the server name, if set, or
+// server address otherwise
+//
+func (s *ServerParams) Ident() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.Addr
 }
 
 //
@@ -50,8 +334,13 @@ type SiteParams struct {
 //
 func (state *State) Load(file string) error {
 	// Reset the state
-	state.Server = ServerParams{}
+	state.Servers = []ServerParams{}
 	state.Sites = []SiteParams{}
+	state.ResolveHosts = false
+	state.Fallback = false
+	state.Learned = []LearnedSite{}
+	state.Subscribe = []Subscription{}
+	state.Server = nil
 
 	// Read the state file
 	f, err := os.Open(file)
@@ -76,6 +365,14 @@ func (state *State) Load(file string) error {
 	// Parse the state
 	err = json.Unmarshal(data, &state)
 
+	// Upgrade from single-server state
+	if state.Server != nil {
+		if len(state.Servers) == 0 && state.Server.Addr != "" {
+			state.Servers = []ServerParams{*state.Server}
+		}
+		state.Server = nil
+	}
+
 	return err
 }
 
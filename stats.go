@@ -0,0 +1,293 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Per-site usage statistics
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// Per-site usage statistics
+//
+// Statistics is collected for user's sites (see SiteParams) that
+// match requests, and is kept in memory only. When site is deleted,
+// its statistics is deleted too. Subscribed and learned sites are
+// not counted, as they are not listed in the user's sites
+//
+type SiteStats struct {
+	froxy *Froxy                   // Back link to Froxy
+	lock  sync.Mutex               // Access lock
+	sites map[SiteKey]*SiteCounter // Per-site counters
+	keys  map[SiteKey]struct{}     // Keys of user's sites
+}
+
+//
+// Usage counters of the particular site
+//
+// All fields are updated atomically
+//
+type SiteCounter struct {
+	Requests int64 `json:"requests"`  // Count of regular HTTP requests
+	Connects int64 `json:"connects"`  // Count of CONNECT requests
+	BytesIn  int64 `json:"bytes_in"`  // Bytes received from site
+	BytesOut int64 `json:"bytes_out"` // Bytes sent to site
+	Errors   int64 `json:"errors"`    // Count of errors
+	LastUsed int64 `json:"last_used"` // Last use time, Unix time in ms
+}
+
+//
+// Create new SiteStats
+//
+func NewSiteStats(froxy *Froxy) *SiteStats {
+	stats := &SiteStats{
+		froxy: froxy,
+		sites: make(map[SiteKey]*SiteCounter),
+	}
+
+	events := froxy.Sub(EventSitesChanged)
+	stats.update()
+	go stats.goroutine(events)
+
+	return stats
+}
+
+//
+// SiteStats goroutine. Drops statistics of deleted sites
+//
+func (stats *SiteStats) goroutine(events <-chan Event) {
+	for range events {
+		stats.update()
+		stats.froxy.Raise(EventSiteStatsChanged)
+	}
+}
+
+//
+// Update keys of user's sites and drop statistics of deleted sites
+//
+func (stats *SiteStats) update() {
+	keys := make(map[SiteKey]struct{})
+	for _, site := range stats.froxy.GetSites() {
+		keys[stats.key(&site)] = struct{}{}
+	}
+
+	stats.lock.Lock()
+	stats.keys = keys
+	for key := range stats.sites {
+		if _, found := keys[key]; !found {
+			delete(stats.sites, key)
+		}
+	}
+	stats.lock.Unlock()
+}
+
+//
+// Get SiteCounter of the site. New counter is created, if needed
+//
+// Returns nil, if site is not in the user's sites, so
+// statistics is not collected for it
+//
+func (stats *SiteStats) Counter(site *SiteParams) *SiteCounter {
+	key := stats.key(site)
+
+	stats.lock.Lock()
+	cnt := stats.sites[key]
+	if cnt == nil {
+		if _, found := stats.keys[key]; found {
+			cnt = &SiteCounter{}
+			stats.sites[key] = cnt
+		}
+	}
+	stats.lock.Unlock()
+
+	return cnt
+}
+
+//
+// Get statistics snapshot for the list of sites. Sites without
+// statistics get zero counters
+//
+func (stats *SiteStats) Get(sites []SiteParams) []SiteCounter {
+	counters := make([]SiteCounter, len(sites))
+
+	stats.lock.Lock()
+	for i := range sites {
+		cnt := stats.sites[stats.key(&sites[i])]
+		if cnt != nil {
+			counters[i] = SiteCounter{
+				Requests: atomic.LoadInt64(&cnt.Requests),
+				Connects: atomic.LoadInt64(&cnt.Connects),
+				BytesIn:  atomic.LoadInt64(&cnt.BytesIn),
+				BytesOut: atomic.LoadInt64(&cnt.BytesOut),
+				Errors:   atomic.LoadInt64(&cnt.Errors),
+				LastUsed: atomic.LoadInt64(&cnt.LastUsed),
+			}
+		}
+	}
+	stats.lock.Unlock()
+
+	return counters
+}
+
+//
+// Make statistics key for the site
+//
+func (stats *SiteStats) key(site *SiteParams) SiteKey {
+	key := site.Key()
+	key.Host = strings.ToLower(key.Host)
+	return key
+}
+
+//
+// Count the request. cnt may be nil
+//
+func (stats *SiteStats) Request(cnt *SiteCounter, connect bool) {
+	if cnt == nil {
+		return
+	}
+
+	if connect {
+		atomic.AddInt64(&cnt.Connects, 1)
+	} else {
+		atomic.AddInt64(&cnt.Requests, 1)
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	atomic.StoreInt64(&cnt.LastUsed, now)
+
+	stats.froxy.Raise(EventSiteStatsChanged)
+}
+
+//
+// Count the error. cnt may be nil
+//
+func (stats *SiteStats) Error(cnt *SiteCounter) {
+	if cnt != nil {
+		stats.Add(&cnt.Errors, 1)
+	}
+}
+
+//
+// Add value to the site counter
+//
+func (stats *SiteStats) Add(cnt *int64, val int64) {
+	atomic.AddInt64(cnt, val)
+	stats.froxy.Raise(EventSiteStatsChanged)
+}
+
+// ----- Statistics collecting transport -----
+//
+// Transport wrapper that collects statistics
+//
+type siteStatsTransport struct {
+	Transport              // Underlying transport
+	stats     *SiteStats   // Statistics
+	cnt       *SiteCounter // Site counter
+}
+
+//
+// Wrap transport, so statistics is collected for the site. If cnt
+// is nil, transport is returned as is
+//
+func (stats *SiteStats) Transport(t Transport, cnt *SiteCounter) Transport {
+	if cnt == nil {
+		return t
+	}
+	return &siteStatsTransport{t, stats, cnt}
+}
+
+//
+// Perform HTTP round-trip
+//
+func (t *siteStatsTransport) RoundTrip(rq *http.Request) (*http.Response, error) {
+	if rq.Body != nil && rq.Body != http.NoBody {
+		rq = rq.WithContext(rq.Context())
+		rq.Body = &siteStatsReader{rq.Body, t.stats, &t.cnt.BytesOut}
+	}
+
+	resp, err := t.Transport.RoundTrip(rq)
+	if err != nil {
+		t.stats.Add(&t.cnt.Errors, 1)
+		return nil, err
+	}
+
+	if resp.Body != nil {
+		resp.Body = &siteStatsReader{resp.Body, t.stats, &t.cnt.BytesIn}
+	}
+
+	return resp, nil
+}
+
+//
+// Dial new TCP connection
+//
+func (t *siteStatsTransport) Dial(network, addr string) (net.Conn, error) {
+	conn, err := t.Transport.Dial(network, addr)
+	if err != nil {
+		t.stats.Add(&t.cnt.Errors, 1)
+		return nil, err
+	}
+
+	return &siteStatsConn{conn, t.stats, t.cnt}, nil
+}
+
+//
+// Body reader that counts bytes
+//
+type siteStatsReader struct {
+	io.ReadCloser            // Underlying reader
+	stats         *SiteStats // Statistics
+	cnt           *int64     // Counter of bytes
+}
+
+//
+// Read from the body
+//
+func (r *siteStatsReader) Read(buf []byte) (int, error) {
+	n, err := r.ReadCloser.Read(buf)
+	if n > 0 {
+		r.stats.Add(r.cnt, int64(n))
+	}
+	return n, err
+}
+
+//
+// Connection that counts bytes
+//
+type siteStatsConn struct {
+	net.Conn              // Underlying connection
+	stats    *SiteStats   // Statistics
+	cnt      *SiteCounter // Site counter
+}
+
+//
+// Read from connection
+//
+func (c *siteStatsConn) Read(buf []byte) (int, error) {
+	n, err := c.Conn.Read(buf)
+	if n > 0 {
+		c.stats.Add(&c.cnt.BytesIn, int64(n))
+	}
+	return n, err
+}
+
+//
+// Write to connection
+//
+func (c *siteStatsConn) Write(data []byte) (int, error) {
+	n, err := c.Conn.Write(data)
+	if n > 0 {
+		c.stats.Add(&c.cnt.BytesOut, int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,567 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Subscriptions to remotely maintained site lists
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// Subscriptions to site lists
+//
+// Subscribed lists are periodically fetched in background and
+// cached in the PathUserSubsDir directory, so they survive restart.
+// Sites of all lists form the read-only layer under the user's own
+// sites (see Router)
+//
+type Subscriptions struct {
+	froxy *Froxy                       // Back link to Froxy
+	lock  sync.Mutex                   // Access lock
+	lists map[string]*subscriptionList // Lists, by URL
+	order []string                     // URLs, in order of subscriptions
+	force map[string]struct{}          // Lists to be updated immediately
+	sites atomic.Value                 // Sites of all lists, []SiteParams
+	wake  chan struct{}                // Wakes up the goroutine
+}
+
+//
+// Status of the subscription, as returned by Subscriptions.Status
+//
+type SubscriptionStatus struct {
+	Subscription
+	Used    SiteListFormat `json:"used,omitempty"` // Actually used format
+	Sites   int            `json:"sites"`          // Count of sites
+	Errors  int            `json:"errors"`         // Count of per-line errors
+	Error   string         `json:"error"`          // Last update error, if any
+	Updated int64          `json:"updated"`        // Last content change, Unix ms
+	Checked int64          `json:"checked"`        // Last update attempt, Unix ms
+	Next    int64          `json:"next"`           // Next update time, Unix ms
+}
+
+//
+// Subscribed site list. This is also the format of the cache file
+//
+type subscriptionList struct {
+	Sub          Subscription   `json:"sub"`                     // Subscription parameters
+	Used         SiteListFormat `json:"used,omitempty"`          // Actually used format
+	ETag         string         `json:"etag,omitempty"`          // ETag of the list
+	LastModified string         `json:"last_modified,omitempty"` // Last-Modified of the list
+	Updated      time.Time      `json:"updated"`                 // Last content change
+	Checked      time.Time      `json:"checked"`                 // Last update attempt
+	Error        string         `json:"error,omitempty"`         // Last update error
+	Errors       int            `json:"errors"`                  // Count of per-line errors
+	Sites        []SiteParams   `json:"sites"`                   // Sites of the list
+}
+
+//
+// Create new Subscriptions. Cached lists are loaded synchronously,
+// so sites of subscriptions are available immediately
+//
+func NewSubscriptions(froxy *Froxy) *Subscriptions {
+	subs := &Subscriptions{
+		froxy: froxy,
+		lists: make(map[string]*subscriptionList),
+		force: make(map[string]struct{}),
+		wake:  make(chan struct{}, 1),
+	}
+
+	for _, sub := range froxy.GetSubscriptions() {
+		list := &subscriptionList{Sub: sub}
+		subs.load(list)
+		subs.lists[sub.URL] = list
+		subs.order = append(subs.order, sub.URL)
+	}
+
+	subs.rebuild()
+
+	return subs
+}
+
+//
+// Get sites of all subscribed lists, in order of subscriptions
+//
+func (subs *Subscriptions) Sites() []SiteParams {
+	sites, _ := subs.sites.Load().([]SiteParams)
+	return sites
+}
+
+//
+// Get status of all subscriptions, in order of subscriptions
+//
+func (subs *Subscriptions) Status() []SubscriptionStatus {
+	ms := func(t time.Time) int64 {
+		if t.IsZero() {
+			return 0
+		}
+		return t.UnixNano() / int64(time.Millisecond)
+	}
+
+	status := []SubscriptionStatus{}
+
+	subs.lock.Lock()
+	for _, url := range subs.order {
+		list := subs.lists[url]
+		status = append(status, SubscriptionStatus{
+			Subscription: list.Sub,
+			Used:         list.Used,
+			Sites:        len(list.Sites),
+			Errors:       list.Errors,
+			Error:        list.Error,
+			Updated:      ms(list.Updated),
+			Checked:      ms(list.Checked),
+			Next:         ms(list.next()),
+		})
+	}
+	subs.lock.Unlock()
+
+	return status
+}
+
+//
+// Request update. If url is not "", the list is fetched immediately,
+// otherwise subscriptions are synchronized with the configuration
+// and only due lists are fetched
+//
+func (subs *Subscriptions) Update(url string) {
+	if url != "" {
+		subs.lock.Lock()
+		subs.force[url] = struct{}{}
+		subs.lock.Unlock()
+	}
+
+	select {
+	case subs.wake <- struct{}{}:
+	default:
+	}
+}
+
+//
+// Subscriptions goroutine. Fetches due lists
+//
+func (subs *Subscriptions) goroutine() {
+	timer := time.NewTimer(0)
+
+	for {
+		select {
+		case <-subs.wake:
+		case <-timer.C:
+		}
+
+		next := subs.update()
+
+		timer.Stop()
+		select {
+		case <-timer.C:
+		default:
+		}
+
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+//
+// Synchronize lists with configuration and fetch due lists.
+// Returns time of the next update, zero if there is nothing
+// to update
+//
+func (subs *Subscriptions) update() time.Time {
+	froxy := subs.froxy
+	configured := froxy.GetSubscriptions()
+	changed := false
+
+	// Synchronize lists with configuration
+	subs.lock.Lock()
+
+	lists := make(map[string]*subscriptionList)
+	order := []string{}
+	for i, sub := range configured {
+		order = append(order, sub.URL)
+		if i >= len(subs.order) || subs.order[i] != sub.URL {
+			changed = true
+		}
+
+		list := subs.lists[sub.URL]
+		switch {
+		case list == nil:
+			list = &subscriptionList{Sub: sub}
+			subs.load(list)
+		case list.Sub != sub:
+			// Parameters changed, refetch the whole list
+			list.Sub = sub
+			list.ETag = ""
+			list.LastModified = ""
+			subs.force[sub.URL] = struct{}{}
+		}
+		lists[sub.URL] = list
+	}
+
+	for url := range subs.lists {
+		if lists[url] == nil {
+			os.Remove(subs.cacheFile(url))
+		}
+	}
+
+	if len(order) != len(subs.order) {
+		changed = true
+	}
+
+	subs.lists = lists
+	subs.order = order
+
+	// Collect due lists
+	now := time.Now()
+	due := []subscriptionList{}
+	for _, sub := range configured {
+		list := lists[sub.URL]
+		_, forced := subs.force[sub.URL]
+		if forced || !now.Before(list.next()) {
+			due = append(due, *list)
+		}
+	}
+
+	subs.force = make(map[string]struct{})
+	subs.lock.Unlock()
+
+	// Fetch due lists. Lists are fetched into copies, so
+	// status is available while fetching is in progress
+	for i := range due {
+		list := &due[i]
+		updated, err := subs.fetch(list)
+
+		if err != nil {
+			froxy.Error("subscription %s: %s", list.Sub.URL, err)
+		} else if updated {
+			froxy.Info("subscription %s: %d sites updated",
+				list.Sub.URL, len(list.Sites))
+		}
+
+		subs.lock.Lock()
+		if old := subs.lists[list.Sub.URL]; old != nil && old.Sub == list.Sub {
+			subs.lists[list.Sub.URL] = list
+			subs.save(list)
+			changed = changed || updated
+		}
+		subs.lock.Unlock()
+
+		froxy.Raise(EventSubscriptionsChanged)
+	}
+
+	if changed {
+		subs.rebuild()
+		froxy.Raise(EventSitesChanged)
+	}
+
+	// Compute time of the next update
+	var next time.Time
+
+	subs.lock.Lock()
+	for _, list := range subs.lists {
+		if t := list.next(); next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	subs.lock.Unlock()
+
+	return next
+}
+
+//
+// Rebuild the list of subscribed sites
+//
+func (subs *Subscriptions) rebuild() {
+	sites := []SiteParams{}
+
+	subs.lock.Lock()
+	for _, url := range subs.order {
+		sites = append(sites, subs.lists[url].Sites...)
+	}
+	subs.lock.Unlock()
+
+	subs.sites.Store(sites)
+}
+
+//
+// Fetch the list, either directly or via server
+//
+func (subs *Subscriptions) fetch(list *subscriptionList) (bool, error) {
+	var transport Transport = subs.froxy.directTransport
+	if list.Sub.Forward {
+		transport = subs.froxy.ServerTransport(list.Sub.Server)
+	}
+
+	var err error
+	updated := false
+
+	if transport == nil {
+		err = fmt.Errorf("Server %q not configured", list.Sub.Server)
+	} else {
+		client := &http.Client{
+			Transport: transport,
+			Timeout:   SUBSCRIPTION_TIMEOUT,
+		}
+		updated, err = subscriptionFetch(client, list)
+	}
+
+	list.Checked = time.Now()
+	list.Error = ""
+	if err != nil {
+		list.Error = err.Error()
+	}
+
+	return updated, err
+}
+
+//
+// Get path to the cache file of the list
+//
+func (subs *Subscriptions) cacheFile(url string) string {
+	hash := sha1.Sum([]byte(url))
+	name := hex.EncodeToString(hash[:]) + ".json"
+	return filepath.Join(subs.froxy.PathUserSubsDir, name)
+}
+
+//
+// Load the list from cache. Missed or broken cache is silently
+// ignored, the list will be refetched
+//
+func (subs *Subscriptions) load(list *subscriptionList) {
+	data, err := ioutil.ReadFile(subs.cacheFile(list.Sub.URL))
+	if err != nil {
+		return
+	}
+
+	var cached subscriptionList
+	err = json.Unmarshal(data, &cached)
+	if err != nil || cached.Sub != list.Sub {
+		return
+	}
+
+	*list = cached
+}
+
+//
+// Save the list into cache
+//
+func (subs *Subscriptions) save(list *subscriptionList) {
+	data, err := json.Marshal(list)
+	if err != nil {
+		panic(err) // Should never happen
+	}
+
+	err = ioutil.WriteFile(subs.cacheFile(list.Sub.URL), data, 0600)
+	if err != nil {
+		subs.froxy.Error("subscription %s: %s", list.Sub.URL, err)
+	}
+}
+
+//
+// Time of the next update of the list
+//
+func (list *subscriptionList) next() time.Time {
+	if list.Error != "" {
+		return list.Checked.Add(SUBSCRIPTION_RETRY_INTERVAL)
+	}
+	return list.Checked.Add(SUBSCRIPTION_UPDATE_INTERVAL)
+}
+
+// ----- Fetching lists -----
+//
+// Check subscription URL
+//
+func SubscriptionCheckURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host == "" {
+			return fmt.Errorf("%q: missed host", s)
+		}
+	case "file":
+		if u.Path == "" {
+			return fmt.Errorf("%q: missed path", s)
+		}
+	default:
+		return fmt.Errorf("%q: unsupported URL scheme", s)
+	}
+
+	return nil
+}
+
+//
+// Fetch the list. Unchanged list is not refetched, if server
+// supports conditional requests
+//
+// Returns true if content of the list has changed
+//
+func subscriptionFetch(client *http.Client, list *subscriptionList) (
+	bool, error) {
+
+	u, err := url.Parse(list.Sub.URL)
+	if err != nil {
+		return false, err
+	}
+
+	var data []byte
+	var etag, modified string
+
+	if u.Scheme == "file" {
+		data, modified, err = subscriptionFetchFile(u, list)
+	} else {
+		data, etag, modified, err = subscriptionFetchHTTP(client, list)
+	}
+
+	if err != nil || data == nil {
+		return false, err
+	}
+
+	sites, errs, used, err := SiteListParse(data, list.Sub.Format)
+	if err != nil {
+		return false, err
+	}
+
+	for i := range sites {
+		if sites[i].Type != SiteTypeRegexp {
+			sites[i].Host = strings.ToLower(sites[i].Host)
+		}
+	}
+
+	list.Used = used
+	list.ETag = etag
+	list.LastModified = modified
+	list.Updated = time.Now()
+	list.Errors = len(errs)
+	list.Sites = sites
+
+	return true, nil
+}
+
+//
+// Fetch the list from file. Returns nil data, if file
+// modification time is not changed
+//
+func subscriptionFetchFile(u *url.URL, list *subscriptionList) (
+	data []byte, modified string, err error) {
+
+	path := filepath.FromSlash(
+		subscriptionFilePath(u.Path, runtime.GOOS == "windows"))
+
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	modified = stat.ModTime().UTC().Format(time.RFC3339Nano)
+	if modified == list.LastModified && list.Used != "" {
+		return nil, modified, nil
+	}
+
+	data, err = subscriptionRead(f)
+	return
+}
+
+//
+// Get path of the file:// URL in the slash-separated form
+//
+// On Windows, path of the file:///C:/dir/list.txt URL is
+// /C:/dir/list.txt, and the leading slash before the drive
+// letter must be removed
+//
+func subscriptionFilePath(path string, windows bool) string {
+	if windows && len(path) >= 3 && path[0] == '/' && path[2] == ':' {
+		drive := path[1] | 0x20 // Lower case
+		if 'a' <= drive && drive <= 'z' {
+			return path[1:]
+		}
+	}
+
+	return path
+}
+
+//
+// Fetch the list via HTTP. Returns nil data, if list is
+// not modified
+//
+func subscriptionFetchHTTP(client *http.Client, list *subscriptionList) (
+	data []byte, etag, modified string, err error) {
+
+	rq, err := http.NewRequest("GET", list.Sub.URL, nil)
+	if err != nil {
+		return
+	}
+
+	if list.Used != "" {
+		if list.ETag != "" {
+			rq.Header.Set("If-None-Match", list.ETag)
+		}
+		if list.LastModified != "" {
+			rq.Header.Set("If-Modified-Since", list.LastModified)
+		}
+	}
+
+	resp, err := client.Do(rq)
+	if err != nil {
+		return
+	}
+
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, list.ETag, list.LastModified, nil
+	default:
+		err = fmt.Errorf("HTTP %s", resp.Status)
+		return
+	}
+
+	data, err = subscriptionRead(resp.Body)
+	if err != nil {
+		return
+	}
+
+	return data, resp.Header.Get("ETag"),
+		resp.Header.Get("Last-Modified"), nil
+}
+
+//
+// Read the list, up to SUBSCRIPTION_MAX_SIZE bytes
+//
+func subscriptionRead(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, SUBSCRIPTION_MAX_SIZE+1))
+	if err == nil && len(data) > SUBSCRIPTION_MAX_SIZE {
+		err = errors.New("List is too large")
+	}
+	return data, err
+}
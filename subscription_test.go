@@ -0,0 +1,224 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Subscriptions test
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+// Test fetching list via HTTP with ETag
+//
+func TestSubscriptionFetchETag(t *testing.T) {
+	list := "example.com\n||ads.example.net^\n"
+	etag := `"v1"`
+	requests := 0
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", etag)
+			w.Write([]byte(list))
+		}))
+	defer srv.Close()
+
+	l := &subscriptionList{
+		Sub: Subscription{URL: srv.URL, Format: SiteListAdBlock},
+	}
+
+	// The first fetch gets the list
+	updated, err := subscriptionFetch(srv.Client(), l)
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+
+	if !updated || len(l.Sites) != 2 || l.ETag != etag {
+		t.Fatalf("fetch: updated=%v sites=%d etag=%s",
+			updated, len(l.Sites), l.ETag)
+	}
+
+	if l.Sites[1].Host != "ads.example.net" || !l.Sites[1].Block {
+		t.Fatalf("fetch: unexpected site %+v", l.Sites[1])
+	}
+
+	// The second fetch gets 304
+	updated, err = subscriptionFetch(srv.Client(), l)
+	if err != nil {
+		t.Fatalf("refetch: %s", err)
+	}
+
+	if updated || len(l.Sites) != 2 || requests != 2 {
+		t.Fatalf("refetch: updated=%v sites=%d requests=%d",
+			updated, len(l.Sites), requests)
+	}
+
+	// Changed list is fetched again
+	list = "example.org\n"
+	etag = `"v2"`
+
+	updated, err = subscriptionFetch(srv.Client(), l)
+	if err != nil {
+		t.Fatalf("update: %s", err)
+	}
+
+	if !updated || len(l.Sites) != 1 || l.ETag != etag {
+		t.Fatalf("update: updated=%v sites=%d etag=%s",
+			updated, len(l.Sites), l.ETag)
+	}
+}
+
+//
+// Test fetching list via HTTP with If-Modified-Since
+//
+func TestSubscriptionFetchModified(t *testing.T) {
+	modified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "list.txt", modified,
+				strings.NewReader("example.com\nexample.org\n"))
+		}))
+	defer srv.Close()
+
+	l := &subscriptionList{Sub: Subscription{URL: srv.URL}}
+
+	updated, err := subscriptionFetch(srv.Client(), l)
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+
+	if !updated || len(l.Sites) != 2 || l.Used != SiteListPlain ||
+		l.LastModified == "" {
+		t.Fatalf("fetch: updated=%v sites=%d used=%s modified=%s",
+			updated, len(l.Sites), l.Used, l.LastModified)
+	}
+
+	updated, err = subscriptionFetch(srv.Client(), l)
+	if err != nil || updated {
+		t.Fatalf("refetch: updated=%v err=%v", updated, err)
+	}
+}
+
+//
+// Test HTTP errors
+//
+func TestSubscriptionFetchError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	l := &subscriptionList{Sub: Subscription{URL: srv.URL}}
+
+	_, err := subscriptionFetch(srv.Client(), l)
+	if err == nil {
+		t.Fatalf("fetch: error expected")
+	}
+}
+
+//
+// Test fetching list from file
+//
+func TestSubscriptionFetchFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "froxy")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hosts")
+	err = ioutil.WriteFile(path, []byte("0.0.0.0 ads.example.com\n"), 0600)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	l := &subscriptionList{
+		Sub: Subscription{URL: "file:///" +
+			strings.TrimPrefix(filepath.ToSlash(path), "/")},
+	}
+
+	updated, err := subscriptionFetch(nil, l)
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+
+	if !updated || len(l.Sites) != 1 || l.Used != SiteListHosts {
+		t.Fatalf("fetch: updated=%v sites=%d used=%s",
+			updated, len(l.Sites), l.Used)
+	}
+
+	updated, err = subscriptionFetch(nil, l)
+	if err != nil || updated {
+		t.Fatalf("refetch: updated=%v err=%v", updated, err)
+	}
+}
+
+//
+// Test conversion of file:// URL path to the file path
+//
+func TestSubscriptionFilePath(t *testing.T) {
+	tests := []struct {
+		url     string
+		windows bool
+		path    string
+	}{
+		{"file:///etc/hosts", false, "/etc/hosts"},
+		{"file:///etc/hosts", true, "/etc/hosts"},
+		{"file:///C:/x/list.txt", true, "C:/x/list.txt"},
+		{"file:///d:/list.txt", true, "d:/list.txt"},
+		{"file:///C:/x/list.txt", false, "/C:/x/list.txt"},
+		{"file:///1:/list.txt", true, "/1:/list.txt"},
+	}
+
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatalf("%s: %s", test.url, err)
+		}
+
+		path := subscriptionFilePath(u.Path, test.windows)
+		if path != test.path {
+			t.Errorf("%s (windows=%v): %q expected, %q received",
+				test.url, test.windows, test.path, path)
+		}
+	}
+}
+
+//
+// Test that user's sites take precedence over subscriptions
+//
+func TestSubscriptionRouting(t *testing.T) {
+	table := newRouterTable(&Env{}, []SiteParams{
+		{Host: "example.com", Rec: true},
+	})
+
+	table.under = newRouterTable(&Env{}, []SiteParams{
+		{Host: "www.example.com", Block: true},
+		{Host: "example.org", Block: true},
+	})
+
+	site, _ := table.Lookup("www.example.com", "80", SiteSchemeHTTP)
+	if site == nil || site.Block {
+		t.Fatalf("www.example.com: user's site expected, got %+v", site)
+	}
+
+	site, _ = table.Lookup("example.org", "80", SiteSchemeHTTP)
+	if site == nil || !site.Block {
+		t.Fatalf("example.org: subscribed site expected, got %+v", site)
+	}
+}
@@ -0,0 +1,181 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// SSH over TLS and WebSocket
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//
+// Check tunnel parameters of the server
+//
+func (p *ServerParams) CheckTunnel() error {
+	switch p.Tunnel {
+	case SSHTunnelNone:
+		return nil
+
+	case SSHTunnelTLS:
+
+	case SSHTunnelWebSocket:
+		if p.URL == "" {
+			return ErrTunnelURLMissed
+		}
+
+		u, err := url.Parse(p.URL)
+		if err != nil {
+			return fmt.Errorf("Invalid WebSocket URL: %s", err)
+		}
+
+		if u.Scheme != "ws" && u.Scheme != "wss" {
+			return fmt.Errorf("Invalid WebSocket URL %q: ws:// or wss:// expected",
+				p.URL)
+		}
+
+	default:
+		return fmt.Errorf("Invalid tunnel %q", p.Tunnel)
+	}
+
+	if p.Command != "" {
+		return ErrTunnelAndCommand
+	}
+
+	return nil
+}
+
+//
+// Connect to the SSH server via the tunnel, specified by server
+// parameters. TCP connections are dialed via dial function
+//
+// Server certificate is not verified: TLS here only helps to pass
+// through the restrictive networks, and server is authenticated by
+// its SSH host key anyway. Relays often use self-signed certificates
+//
+func SSHTunnelDial(ctx context.Context, params *ServerParams,
+	dial NetDialFunc) (net.Conn, error) {
+
+	cfg := &tls.Config{
+		ServerName:         params.SNI,
+		InsecureSkipVerify: true,
+	}
+
+	switch params.Tunnel {
+	case SSHTunnelTLS:
+		addr := NetDefaultPort(params.Addr, "443")
+		if cfg.ServerName == "" {
+			cfg.ServerName, _ = NetSplitHostPort(addr, "")
+		}
+
+		conn, err := dial(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConn := tls.Client(conn, cfg)
+		err = NetDoContext(ctx, tlsConn, SSH_TUNNEL_HANDSHAKE_TIMEOUT,
+			tlsConn.Handshake)
+		if err != nil {
+			tlsConn.Close()
+			return nil, fmt.Errorf("TLS: %w", err)
+		}
+
+		return tlsConn, nil
+
+	case SSHTunnelWebSocket:
+		dialer := &websocket.Dialer{
+			NetDialContext:   dial,
+			TLSClientConfig:  cfg,
+			HandshakeTimeout: SSH_TUNNEL_HANDSHAKE_TIMEOUT,
+			Subprotocols:     []string{"binary"},
+		}
+
+		ws, rsp, err := dialer.DialContext(ctx, params.URL, nil)
+		if err != nil {
+			if rsp != nil {
+				err = fmt.Errorf("WebSocket: %s: %s", params.URL, rsp.Status)
+			} else {
+				err = fmt.Errorf("WebSocket: %w", err)
+			}
+			return nil, err
+		}
+
+		return &sshTunnelWSConn{Conn: ws}, nil
+	}
+
+	return nil, fmt.Errorf("Invalid tunnel %q", params.Tunnel)
+}
+
+// ----- WebSocket connection -----
+//
+// net.Conn over WebSocket. Data is sent as binary messages;
+// received messages are concatenated into the byte stream
+//
+type sshTunnelWSConn struct {
+	*websocket.Conn            // Underlying WebSocket
+	reader          io.Reader  // Current message reader
+	writeLock       sync.Mutex // Serializes writers
+}
+
+var _ = net.Conn(&sshTunnelWSConn{})
+
+//
+// Read from the connection -- implements net.Conn interface
+//
+func (conn *sshTunnelWSConn) Read(b []byte) (int, error) {
+	for {
+		if conn.reader == nil {
+			_, r, err := conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			conn.reader = r
+		}
+
+		n, err := conn.reader.Read(b)
+		if err == io.EOF {
+			conn.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+//
+// Write to the connection -- implements net.Conn interface
+//
+func (conn *sshTunnelWSConn) Write(b []byte) (int, error) {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+
+	err := conn.WriteMessage(websocket.BinaryMessage, b)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+//
+// Set I/O deadline -- implements net.Conn interface
+//
+func (conn *sshTunnelWSConn) SetDeadline(t time.Time) error {
+	conn.SetWriteDeadline(t)
+	return conn.SetReadDeadline(t)
+}
@@ -0,0 +1,231 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// SSH over TLS and WebSocket test
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+)
+
+//
+// Start in-process SSH server, that accepts any password.
+// Returns its listener
+//
+func tunnelTestSSHServer(t *testing.T) net.Listener {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (
+			*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	cfg.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+				if err == nil {
+					go ssh.DiscardRequests(reqs)
+					for ch := range chans {
+						ch.Reject(ssh.Prohibited, "test")
+					}
+				}
+			}()
+		}
+	}()
+
+	return l
+}
+
+//
+// Connect to the SSH server over the tunnel
+//
+func tunnelTestConnect(t *testing.T, params *ServerParams) {
+	dialer := &net.Dialer{}
+	conn, err := SSHTunnelDial(context.Background(), params,
+		dialer.DialContext)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+
+	cfg := &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password("test")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, params.Addr, cfg)
+	if err != nil {
+		t.Fatalf("handshake: %s", err)
+	}
+
+	ssh.NewClient(c, chans, reqs).Close()
+}
+
+//
+// Test SSH over TLS with SNI
+//
+func TestSSHTunnelTLS(t *testing.T) {
+	backend := tunnelTestSSHServer(t)
+	defer backend.Close()
+
+	// Borrow self-signed certificate from httptest
+	https := httptest.NewTLSServer(http.NotFoundHandler())
+	cert := https.TLS.Certificates
+	https.Close()
+
+	// TLS relay, like nginx stream with ssl_preread
+	sni := make(chan string, 1)
+	relay, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: cert,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (
+			*tls.Config, error) {
+			sni <- hello.ServerName
+			return nil, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer relay.Close()
+
+	go func() {
+		conn, err := relay.Accept()
+		if err != nil {
+			return
+		}
+
+		up, err := net.Dial("tcp", backend.Addr().String())
+		if err != nil {
+			conn.Close()
+			return
+		}
+
+		go io.Copy(up, conn)
+		io.Copy(conn, up)
+		conn.Close()
+	}()
+
+	tunnelTestConnect(t, &ServerParams{
+		Addr:   relay.Addr().String(),
+		Tunnel: SSHTunnelTLS,
+		SNI:    "ssh.example.com",
+	})
+
+	if s := <-sni; s != "ssh.example.com" {
+		t.Fatalf("SNI: %q received", s)
+	}
+}
+
+//
+// Test SSH over WebSocket
+//
+func TestSSHTunnelWebSocket(t *testing.T) {
+	backend := tunnelTestSSHServer(t)
+	defer backend.Close()
+
+	// WebSocket relay, like websockify
+	upgrader := &websocket.Upgrader{Subprotocols: []string{"binary"}}
+	relay := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/ssh" {
+				http.NotFound(w, r)
+				return
+			}
+
+			ws, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+
+			up, err := net.Dial("tcp", backend.Addr().String())
+			if err != nil {
+				ws.Close()
+				return
+			}
+
+			conn := &sshTunnelWSConn{Conn: ws}
+			go io.Copy(up, conn)
+			io.Copy(conn, up)
+			conn.Close()
+		}))
+	defer relay.Close()
+
+	url := "ws" + strings.TrimPrefix(relay.URL, "http") + "/ssh"
+	tunnelTestConnect(t, &ServerParams{
+		Addr:   "ssh.example.com",
+		Tunnel: SSHTunnelWebSocket,
+		URL:    url,
+	})
+
+	// Wrong URL must fail
+	_, err := SSHTunnelDial(context.Background(), &ServerParams{
+		Tunnel: SSHTunnelWebSocket,
+		URL:    url + "/wrong",
+	}, (&net.Dialer{}).DialContext)
+
+	if err == nil {
+		t.Fatalf("wrong URL: error expected")
+	}
+}
+
+//
+// Test tunnel parameters validation
+//
+func TestSSHTunnelCheck(t *testing.T) {
+	tests := []struct {
+		params ServerParams
+		ok     bool
+	}{
+		{ServerParams{}, true},
+		{ServerParams{Tunnel: SSHTunnelTLS}, true},
+		{ServerParams{Tunnel: SSHTunnelWebSocket, URL: "wss://x/ssh"}, true},
+		{ServerParams{Tunnel: SSHTunnelWebSocket}, false},
+		{ServerParams{Tunnel: SSHTunnelWebSocket, URL: "http://x/"}, false},
+		{ServerParams{Tunnel: SSHTunnelTLS, Command: "nc %h %p"}, false},
+		{ServerParams{Tunnel: "bad"}, false},
+	}
+
+	for _, test := range tests {
+		err := test.params.CheckTunnel()
+		if (err == nil) != test.ok {
+			t.Errorf("%+v: unexpected result %v", test.params, err)
+		}
+	}
+}
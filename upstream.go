@@ -0,0 +1,195 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Upstream proxy for connections to the SSH server
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+//
+// Check upstream proxy parameters of the server
+//
+func (p *ServerParams) CheckProxy() error {
+	if p.Proxy == "" {
+		return nil
+	}
+
+	u, err := url.Parse(p.Proxy)
+	if err != nil {
+		return fmt.Errorf("Invalid proxy URL: %s", err)
+	}
+
+	switch {
+	case u.Scheme != "http" && u.Scheme != "socks5":
+		return fmt.Errorf("Invalid proxy URL %q: http:// or socks5:// expected",
+			p.Proxy)
+	case u.Host == "":
+		return fmt.Errorf("Invalid proxy URL %q: proxy host missed", p.Proxy)
+	case p.Command != "":
+		return ErrProxyAndCommand
+	}
+
+	return nil
+}
+
+//
+// Create dial function that connects via the upstream proxy,
+// specified by URL:
+//   http://[user:password@]host[:port]   - HTTP CONNECT proxy
+//   socks5://[user:password@]host[:port] - SOCKS5 proxy
+//
+// Connections to the proxy itself are dialed via dial function
+//
+func UpstreamProxyDialer(proxyURL string, dial NetDialFunc) (
+	NetDialFunc, error) {
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid proxy URL: %s", err)
+	}
+
+	switch u.Scheme {
+	case "http":
+		return upstreamHTTPDialer(u, dial), nil
+
+	case "socks5":
+		var auth *proxy.Auth
+		if u.User != nil {
+			auth = &proxy.Auth{User: u.User.Username()}
+			auth.Password, _ = u.User.Password()
+		}
+
+		addr := NetDefaultPort(u.Host, "1080")
+		d, err := proxy.SOCKS5("tcp", addr, auth, upstreamForward(dial))
+		if err != nil {
+			return nil, err
+		}
+
+		return func(ctx context.Context, network, addr string) (
+			net.Conn, error) {
+			conn, err := d.(proxy.ContextDialer).DialContext(ctx,
+				network, addr)
+			if err != nil {
+				return nil, fmt.Errorf("proxy %s: %w", u.Host, err)
+			}
+			return conn, nil
+		}, nil
+	}
+
+	return nil, fmt.Errorf("Invalid proxy URL %q: http:// or socks5:// expected",
+		proxyURL)
+}
+
+//
+// Create dial function that connects via HTTP CONNECT proxy
+//
+func upstreamHTTPDialer(u *url.URL, dial NetDialFunc) NetDialFunc {
+	proxyAddr := NetDefaultPort(u.Host, "80")
+
+	var auth string
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = "Basic " + base64.StdEncoding.EncodeToString(
+			[]byte(u.User.Username()+":"+password))
+	}
+
+	return func(ctx context.Context, network, addr string) (
+		net.Conn, error) {
+
+		conn, err := dial(ctx, network, proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		rq := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+
+		if auth != "" {
+			rq.Header.Set("Proxy-Authorization", auth)
+		}
+
+		// Server may start talking immediately after the proxy
+		// response, so bytes, buffered while reading the response,
+		// must not be lost
+		reader := bufio.NewReader(conn)
+		err = NetDoContext(ctx, conn, SSH_UPSTREAM_TIMEOUT, func() error {
+			err := rq.Write(conn)
+			if err != nil {
+				return err
+			}
+
+			rsp, err := http.ReadResponse(reader, rq)
+			if err != nil {
+				return err
+			}
+
+			rsp.Body.Close()
+			if rsp.StatusCode != http.StatusOK {
+				return fmt.Errorf("%s", rsp.Status)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy %s: %w", u.Host, err)
+		}
+
+		return &upstreamConn{Conn: conn, reader: reader}, nil
+	}
+}
+
+// ----- Helper types -----
+//
+// proxy.Dialer and proxy.ContextDialer on top of NetDialFunc
+//
+type upstreamForward NetDialFunc
+
+//
+// Dial the connection -- implements proxy.Dialer interface
+//
+func (dial upstreamForward) Dial(network, addr string) (net.Conn, error) {
+	return dial(context.Background(), network, addr)
+}
+
+//
+// Dial the connection -- implements proxy.ContextDialer interface
+//
+func (dial upstreamForward) DialContext(ctx context.Context,
+	network, addr string) (net.Conn, error) {
+	return dial(ctx, network, addr)
+}
+
+//
+// Connection via HTTP CONNECT proxy. Reads start from
+// the bytes, buffered while reading proxy response
+//
+type upstreamConn struct {
+	net.Conn               // Underlying connection
+	reader   *bufio.Reader // Buffered reader
+}
+
+//
+// Read from the connection -- implements net.Conn interface
+//
+func (conn *upstreamConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
@@ -0,0 +1,292 @@
+// Froxy - HTTP over SSH proxy
+//
+// Copyright (C) 2019 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Upstream proxy test
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+//
+// Banner, the stand-in SSH server sends immediately
+//
+const upstreamTestBanner = "SSH-2.0-Test\r\n"
+
+//
+// Start stand-in SSH server: it sends banner, then echoes
+// everything it receives. Returns its listener
+//
+func upstreamTestServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				conn.Write([]byte(upstreamTestBanner))
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return l
+}
+
+//
+// Start stand-in proxy. For each accepted connection, handshake
+// function returns destination address, or "" to reject
+//
+func upstreamTestProxy(t *testing.T,
+	handshake func(conn net.Conn, r *bufio.Reader) string) net.Listener {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				addr := handshake(conn, r)
+				if addr == "" {
+					return
+				}
+
+				up, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+
+				go io.Copy(up, r)
+				io.Copy(conn, up)
+				up.Close()
+			}()
+		}
+	}()
+
+	return l
+}
+
+//
+// Stand-in HTTP CONNECT proxy handshake
+//
+func upstreamTestHTTP(conn net.Conn, r *bufio.Reader) string {
+	rq, err := http.ReadRequest(r)
+	if err != nil || rq.Method != "CONNECT" {
+		return ""
+	}
+
+	user, password, ok := (&http.Request{Header: http.Header{
+		"Authorization": rq.Header["Proxy-Authorization"],
+	}}).BasicAuth()
+
+	if !ok || user != "user" || password != "secret" {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+			"Content-Length: 0\r\n\r\n")
+		return ""
+	}
+
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return rq.Host
+}
+
+//
+// Stand-in SOCKS5 proxy handshake, with username/password
+// authentication (RFC 1928, RFC 1929)
+//
+func upstreamTestSOCKS5(conn net.Conn, r *bufio.Reader) string {
+	// Methods negotiation
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil || hdr[0] != 5 {
+		return ""
+	}
+
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return ""
+	}
+
+	conn.Write([]byte{5, 2})
+
+	// Username/password
+	readString := func() string {
+		l, _ := r.ReadByte()
+		s := make([]byte, l)
+		io.ReadFull(r, s)
+		return string(s)
+	}
+
+	r.ReadByte()
+	user := readString()
+	password := readString()
+
+	if user != "user" || password != "secret" {
+		conn.Write([]byte{1, 1})
+		return ""
+	}
+
+	conn.Write([]byte{1, 0})
+
+	// CONNECT request
+	var rq [4]byte
+	if _, err := io.ReadFull(r, rq[:]); err != nil || rq[1] != 1 {
+		return ""
+	}
+
+	var host string
+	switch rq[3] {
+	case 1:
+		ip := make(net.IP, 4)
+		io.ReadFull(r, ip)
+		host = ip.String()
+	case 3:
+		host = readString()
+	default:
+		return ""
+	}
+
+	var port [2]byte
+	io.ReadFull(r, port[:])
+
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	return net.JoinHostPort(host,
+		strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+}
+
+//
+// Dial via proxy and check that connection works
+//
+func upstreamTestDial(t *testing.T, proxyURL, addr string) error {
+	dial, err := UpstreamProxyDialer(proxyURL, (&net.Dialer{}).DialContext)
+	if err != nil {
+		t.Fatalf("%s: %s", proxyURL, err)
+	}
+
+	conn, err := dial(context.Background(), "tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	banner := make([]byte, len(upstreamTestBanner))
+	if _, err = io.ReadFull(conn, banner); err != nil {
+		t.Fatalf("%s: read banner: %s", proxyURL, err)
+	}
+
+	if string(banner) != upstreamTestBanner {
+		t.Fatalf("%s: banner %q received", proxyURL, banner)
+	}
+
+	msg := []byte("hello")
+	conn.Write(msg)
+
+	echo := make([]byte, len(msg))
+	if _, err = io.ReadFull(conn, echo); err != nil {
+		t.Fatalf("%s: read echo: %s", proxyURL, err)
+	}
+
+	if string(echo) != string(msg) {
+		t.Fatalf("%s: echo %q received", proxyURL, echo)
+	}
+
+	return nil
+}
+
+//
+// Test connecting via HTTP CONNECT proxy
+//
+func TestUpstreamHTTP(t *testing.T) {
+	server := upstreamTestServer(t)
+	defer server.Close()
+
+	proxy := upstreamTestProxy(t, upstreamTestHTTP)
+	defer proxy.Close()
+
+	addr := server.Addr().String()
+
+	err := upstreamTestDial(t, "http://user:secret@"+proxy.Addr().String(), addr)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	err = upstreamTestDial(t, "http://user:wrong@"+proxy.Addr().String(), addr)
+	if err == nil {
+		t.Fatalf("wrong password: error expected")
+	}
+}
+
+//
+// Test connecting via SOCKS5 proxy
+//
+func TestUpstreamSOCKS5(t *testing.T) {
+	server := upstreamTestServer(t)
+	defer server.Close()
+
+	proxy := upstreamTestProxy(t, upstreamTestSOCKS5)
+	defer proxy.Close()
+
+	addr := server.Addr().String()
+
+	err := upstreamTestDial(t, "socks5://user:secret@"+proxy.Addr().String(), addr)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	err = upstreamTestDial(t, "socks5://user:wrong@"+proxy.Addr().String(), addr)
+	if err == nil {
+		t.Fatalf("wrong password: error expected")
+	}
+}
+
+//
+// Test upstream proxy parameters validation
+//
+func TestUpstreamCheck(t *testing.T) {
+	tests := []struct {
+		params ServerParams
+		ok     bool
+	}{
+		{ServerParams{}, true},
+		{ServerParams{Proxy: "http://proxy:3128"}, true},
+		{ServerParams{Proxy: "socks5://u:p@proxy"}, true},
+		{ServerParams{Proxy: "https://proxy"}, false},
+		{ServerParams{Proxy: "http://"}, false},
+		{ServerParams{Proxy: "http://proxy", Command: "nc %h %p"}, false},
+	}
+
+	for _, test := range tests {
+		err := test.params.CheckProxy()
+		if (err == nil) != test.ok {
+			t.Errorf("%+v: unexpected result %v", test.params, err)
+		}
+	}
+}
@@ -10,11 +10,14 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -53,9 +56,15 @@ func NewWebAPI(froxy *Froxy) *WebAPI {
 	webapi.handlers = map[string]http.Handler{
 		"/api/server":   &HandlerWithPoll{froxy, EventServerParamsChanged, webapi.handleServer},
 		"/api/sites":    &HandlerWithPoll{froxy, EventSitesChanged, webapi.handleSites},
+		"/api/routing":  &HandlerWithPoll{froxy, EventSitesChanged, webapi.handleRouting},
 		"/api/state":    &HandlerWithPoll{froxy, EventConnStateChanged, webapi.handleState},
 		"/api/counters": &HandlerWithPoll{froxy, EventCountersChanged, webapi.handleCounters},
 		"/api/keys":     &HandlerWithPoll{froxy, EventKeysChanged, webapi.handleKeys},
+		"/api/learned":  &HandlerWithPoll{froxy, EventLearnedChanged, webapi.handleLearned},
+
+		"/api/stats/sites":   &HandlerWithPoll{froxy, EventSiteStatsChanged, webapi.handleSiteStats},
+		"/api/subscriptions": &HandlerWithPoll{froxy, EventSubscriptionsChanged, webapi.handleSubscriptions},
+		"/api/challenges":    &HandlerWithPoll{froxy, EventChallengesChanged, webapi.handleChallenges},
 	}
 
 	for path, handler := range webapi.handlers {
@@ -63,9 +72,14 @@ func NewWebAPI(froxy *Froxy) *WebAPI {
 	}
 
 	// Non-pollable endpoints
+	webapi.mux.HandleFunc("/api/agent", webapi.handleAgent)
 	webapi.mux.HandleFunc("/api/domain", webapi.handleDomain)
+	webapi.mux.HandleFunc("/api/knownhosts", webapi.handleKnownHosts)
+	webapi.mux.HandleFunc("/api/patterns", webapi.handlePatterns)
 	webapi.mux.HandleFunc("/api/poll", webapi.handlePoll)
+	webapi.mux.HandleFunc("/api/route", webapi.handleRoute)
 	webapi.mux.HandleFunc("/api/shutdown", webapi.handleShutdown)
+	webapi.mux.HandleFunc("/api/sitelist", webapi.handleSiteList)
 
 	return webapi
 }
@@ -73,18 +87,23 @@ func NewWebAPI(froxy *Froxy) *WebAPI {
 //
 // Handle /api/server requests
 //
-// GET - get server parameters. Returns IDNServerParams structure
-// PUT - set server parameters. Receives IDNServerParams structure
+// GET - get servers parameters. Returns array of IDNServerParams
+//       structures, in order of preference
+// PUT - set servers parameters. Receives array of IDNServerParams
+//       structures, in order of preference
+//
+// Servers are tried in order; if connection to the server
+// fails, the next server is tried
 //
 func (webapi *WebAPI) handleServer(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		conf := IDNServerParams(webapi.froxy.GetServerParams())
+		conf := IDNServerParamsList(webapi.froxy.GetServers())
 		webapi.replyJSON(w, conf)
 
 	case "PUT":
 		body, err := ioutil.ReadAll(r.Body)
-		var data IDNServerParams
+		var data IDNServerParamsList
 
 		if err != nil {
 			goto FAIL
@@ -95,7 +114,19 @@ func (webapi *WebAPI) handleServer(w http.ResponseWriter, r *http.Request) {
 			goto FAIL
 		}
 
-		webapi.froxy.SetServerParams((ServerParams)(data))
+		for i := range data {
+			err = webapiCheckServer(&data[i])
+			if err != nil {
+				goto FAIL
+			}
+		}
+
+		err = webapi.froxy.CheckServersInUse(([]ServerParams)(data))
+		if err != nil {
+			goto FAIL
+		}
+
+		webapi.froxy.SetServers(([]ServerParams)(data))
 		webapi.froxy.Raise(EventServerParamsChanged)
 		return
 
@@ -107,29 +138,62 @@ func (webapi *WebAPI) handleServer(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+//
+// Check server parameters, received via WebAPI, including
+// parameters of its jump hosts
+//
+func webapiCheckServer(s *ServerParams) error {
+	if s.TOTP != "" {
+		_, err := TOTPDecodeSeed(s.TOTP)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := s.CheckTunnel()
+	if err == nil {
+		err = s.CheckProxy()
+	}
+
+	for i := 0; err == nil && i < len(s.Jump); i++ {
+		err = webapiCheckServer(&s.Jump[i])
+		if err != nil {
+			err = fmt.Errorf("Jump host %q: %w", s.Jump[i].Addr, err)
+		}
+	}
+
+	return err
+}
+
 //
 // Handle /api/sites requests
 //
-// GET /api/sites      - get all sites
-// DEL /api/sites?host - del particular site
-// PUT /api/sites?host - set particular site.
-//                       Receives IDNSiteParams structure
+// GET /api/sites                           - get all sites
+// DEL /api/sites?host=...&port=...&scheme=... - del particular site
+// PUT /api/sites?host=...&port=...&scheme=... - set particular site.
+//                                             Receives IDNSiteParams
+//                                             structure
+//
+// Site is identified by host, port and scheme (see SiteKey). Port
+// and scheme may be omitted, if site has no such constraints. For
+// compatibility, query may also consist of the host name only
+// (/api/sites?host)
 //
-// Note, PUT identifies site by query parameter, not by the Host
-// field of the IDNSiteParams structure. So to change host name
-// in the existing record, query parameter must point to the
-// existent host, and structure must contain a new host name
+// Note, PUT identifies site by query parameters, not by the
+// fields of the IDNSiteParams structure. So to change host name
+// in the existing record, query parameters must point to the
+// existent site, and structure must contain a new host name
 //
 //
 func (webapi *WebAPI) handleSites(w http.ResponseWriter, r *http.Request) {
-	var host string
+	var key SiteKey
 
-	// Decode host, if required (for PUT and DEL requests)
+	// Decode site key, if required (for PUT and DEL requests)
 	if r.Method == "PUT" || r.Method == "DEL" {
 		var err error
-		host, err = url.QueryUnescape(r.URL.RawQuery)
+		key, err = webapi.siteKey(r)
 
-		if err == nil && r.Method == "DEL" && host == "" {
+		if err == nil && r.Method == "DEL" && key.Host == "" {
 			err = ErrHttpHostMissed
 		}
 
@@ -138,8 +202,6 @@ func (webapi *WebAPI) handleSites(w http.ResponseWriter, r *http.Request) {
 				http.StatusInternalServerError, err)
 			return
 		}
-
-		host = IDNEncode(host)
 	}
 
 	// Handle request
@@ -157,14 +219,18 @@ func (webapi *WebAPI) handleSites(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if err == nil {
-			webapi.froxy.SetSite(host, SiteParams(data))
+			err = (*SiteParams)(&data).CheckConstraints()
+		}
+
+		if err == nil {
+			webapi.froxy.SetSite(key, SiteParams(data))
 			webapi.froxy.Raise(EventSitesChanged)
 		} else {
 			webapi.replyError(w, r, http.StatusInternalServerError, err)
 		}
 
 	case "DEL":
-		webapi.froxy.DelSite(host)
+		webapi.froxy.DelSite(key)
 		webapi.froxy.Raise(EventSitesChanged)
 
 	default:
@@ -172,36 +238,393 @@ func (webapi *WebAPI) handleSites(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+//
+// Decode site key from the /api/sites query
+//
+func (webapi *WebAPI) siteKey(r *http.Request) (SiteKey, error) {
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	if err == nil && query["host"] != nil {
+		key := SiteKey{
+			Host:   IDNEncode(query.Get("host")),
+			Port:   query.Get("port"),
+			Scheme: SiteScheme(query.Get("scheme")),
+		}
+		return key, nil
+	}
+
+	host, err := url.QueryUnescape(r.URL.RawQuery)
+	if err != nil {
+		return SiteKey{}, err
+	}
+
+	return SiteKey{Host: IDNEncode(host)}, nil
+}
+
+//
+// Handle /api/routing requests
+//
+// GET /api/routing - get routing options
+// PUT /api/routing - set routing options
+//
+// Routing options are represented by the following JSON object:
+//     {
+//         "resolve_hosts": true - resolve host names that don't
+//                                 match any site, and match resolved
+//                                 addresses against CIDR blocks
+//         "fallback": true      - if direct access fails, retry
+//                                 via server
+//     }
+//
+func (webapi *WebAPI) handleRouting(w http.ResponseWriter, r *http.Request) {
+	type routing struct {
+		ResolveHosts bool `json:"resolve_hosts"`
+		Fallback     bool `json:"fallback"`
+	}
+
+	switch r.Method {
+	case "GET":
+		webapi.replyJSON(w, routing{
+			webapi.froxy.GetResolveHosts(),
+			webapi.froxy.GetFallback(),
+		})
+
+	case "PUT":
+		var data routing
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(body, &data)
+		}
+
+		if err != nil {
+			webapi.replyError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		webapi.froxy.SetResolveHosts(data.ResolveHosts)
+		webapi.froxy.SetFallback(data.Fallback)
+		webapi.froxy.Raise(EventSitesChanged)
+
+	default:
+		webapi.replyError(w, r, http.StatusMethodNotAllowed, nil)
+	}
+}
+
+//
+// Handle /api/learned requests
+//
+// GET  /api/learned         - get hosts that needed fallback to server
+// DEL  /api/learned?host    - forget the host
+// POST /api/learned?host    - promote the host to the permanent site
+//
+// GET returns array of the following objects:
+//     {
+//         "host":    "example.com",
+//         "count":   3,           - count of fallbacks
+//         "last":    "...",       - time of the last fallback
+//         "learned": true         - host is routed via server
+//     }
+//
+func (webapi *WebAPI) handleLearned(w http.ResponseWriter, r *http.Request) {
+	var host string
+
+	// Decode host, if required (for DEL and POST requests)
+	if r.Method == "DEL" || r.Method == "POST" {
+		var err error
+		host, err = url.QueryUnescape(r.URL.RawQuery)
+
+		if err == nil && host == "" {
+			err = ErrHttpHostMissed
+		}
+
+		if err != nil {
+			webapi.replyError(w, r,
+				http.StatusInternalServerError, err)
+			return
+		}
+
+		host = IDNEncode(host)
+	}
+
+	// Handle request
+	switch r.Method {
+	case "GET":
+		type learned struct {
+			LearnedSite
+			Learned bool `json:"learned"`
+		}
+
+		reply := []learned{}
+		for _, l := range webapi.froxy.GetLearned() {
+			l.Host = IDNDecode(l.Host)
+			reply = append(reply, learned{l, l.Learned()})
+		}
+
+		webapi.replyJSON(w, reply)
+
+	case "DEL":
+		webapi.froxy.DelLearned(host)
+		webapi.froxy.Raise(EventLearnedChanged)
+
+	case "POST":
+		webapi.froxy.SetSite(SiteKey{Host: host}, SiteParams{Host: host})
+		webapi.froxy.DelLearned(host)
+		webapi.froxy.Raise(EventSitesChanged)
+		webapi.froxy.Raise(EventLearnedChanged)
+
+	default:
+		webapi.replyError(w, r, http.StatusMethodNotAllowed, nil)
+	}
+}
+
+//
+// Handle /api/sitelist requests
+//
+// GET /api/sitelist?format=fmt - export list of sites. Returns:
+//     { "format": "fmt", "list": "..." }
+//
+// POST /api/sitelist - import list of sites. Receives the following
+//                      JSON object:
+//     {
+//         "format": "fmt",               - list format, "" to auto-detect
+//         "replace": true,               - replace existent sites, if true,
+//                                          merge with them otherwise
+//         "list": "..."                  - the list
+//     }
+//
+// Returns:
+//     {
+//         "format": "fmt",               - actually used format
+//         "imported": 123,               - count of imported sites
+//         "errors": [                    - per-line errors
+//             { "line": 1, "text": "...", "err": "..." },
+//             ...
+//         ]
+//     }
+//
+// Formats are: "plain", "hosts", "adblock", "gfwlist" and "json".
+// See SiteListFormat for details
+//
+func (webapi *WebAPI) handleSiteList(w http.ResponseWriter, r *http.Request) {
+	type siteList struct {
+		Format   SiteListFormat  `json:"format"`
+		Replace  bool            `json:"replace,omitempty"`
+		List     string          `json:"list,omitempty"`
+		Imported int             `json:"imported"`
+		Errors   []SiteListError `json:"errors,omitempty"`
+	}
+
+	switch r.Method {
+	case "GET":
+		format := SiteListFormat(r.URL.Query().Get("format"))
+		if format == SiteListAuto {
+			format = SiteListPlain
+		}
+
+		list, err := SiteListFormatSites(webapi.froxy.GetSites(), format)
+		if err != nil {
+			webapi.replyError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		webapi.replyJSON(w, map[string]interface{}{
+			"format": format,
+			"list":   string(list),
+		})
+
+	case "POST":
+		var data siteList
+		var sites []SiteParams
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(body, &data)
+		}
+
+		if err == nil {
+			sites, data.Errors, data.Format, err =
+				SiteListParse([]byte(data.List), data.Format)
+		}
+
+		if err != nil {
+			webapi.replyError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		data.Imported = webapi.froxy.ImportSites(sites, data.Replace)
+		webapi.froxy.Raise(EventSitesChanged)
+
+		data.List = ""
+		data.Replace = false
+		webapi.replyJSON(w, data)
+
+	default:
+		webapi.replyError(w, r, http.StatusMethodNotAllowed, nil)
+	}
+}
+
+//
+// Handle /api/subscriptions requests
+//
+// GET /api/subscriptions - get subscriptions with their status.
+//                          Returns array of the following objects:
+//     {
+//         "url":     "https://...", - list URL
+//         "format":  "adblock",     - list format, "" to auto-detect
+//         "forward": true,          - fetch the list via server
+//         "server":  "name",        - server to fetch via, "" for any
+//         "used":    "adblock",     - actually used format
+//         "sites":   123,           - count of sites in the list
+//         "errors":  0,             - count of per-line errors
+//         "error":   "...",         - last update error, if any
+//         "updated": 1234567890000, - last content change, Unix ms
+//         "checked": 1234567890000, - last update attempt, Unix ms
+//         "next":    1234567890000  - next update time, Unix ms
+//     }
+//
+// PUT /api/subscriptions - set subscriptions. Receives array of
+//                          the following objects, in order of
+//                          preference:
+//     { "url": "...", "format": "...", "forward": true, "server": "..." }
+//
+// POST /api/subscriptions?url - update the list immediately
+//
+func (webapi *WebAPI) handleSubscriptions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		webapi.replyJSON(w, webapi.froxy.subs.Status())
+
+	case "PUT":
+		var subs []Subscription
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(body, &subs)
+		}
+
+		seen := make(map[string]struct{})
+		for i := 0; err == nil && i < len(subs); i++ {
+			sub := &subs[i]
+			sub.URL = strings.TrimSpace(sub.URL)
+			if !sub.Forward {
+				sub.Server = ""
+			}
+
+			err = SubscriptionCheckURL(sub.URL)
+			if err == nil && !sub.Format.Valid() {
+				err = fmt.Errorf("Invalid format %q", sub.Format)
+			}
+
+			if _, dup := seen[sub.URL]; err == nil && dup {
+				err = fmt.Errorf("%q: duplicated subscription", sub.URL)
+			}
+
+			seen[sub.URL] = struct{}{}
+		}
+
+		if err != nil {
+			webapi.replyError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		if subs == nil {
+			subs = []Subscription{}
+		}
+
+		webapi.froxy.SetSubscriptions(subs)
+		webapi.froxy.subs.Update("")
+		webapi.froxy.Raise(EventSubscriptionsChanged)
+
+	case "POST":
+		u, err := url.QueryUnescape(r.URL.RawQuery)
+		if err == nil && u == "" {
+			err = ErrSubURLMissed
+		}
+
+		if err != nil {
+			webapi.replyError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		webapi.froxy.subs.Update(u)
+
+	default:
+		webapi.replyError(w, r, http.StatusMethodNotAllowed, nil)
+	}
+}
+
 //
 // Handle /api/state requests
 //
-// GET /api/state - get connectivity state
+// GET /api/state  - get connectivity state
+// POST /api/state - retry connection now, if retry is scheduled
 //
 // Returns the following JSON object:
 //     {
-//         "state": "noconfig" | "trying" | "established",
-//         "info":  "some human-readable explanation"
+//         "state": "noconfig" | "trying" | "established" | "hostkey",
+//         "info":  "some human-readable explanation",
+//         "server": "host:port",       // Active server
+//         "attempts": 3,               // Failed attempts in a row
+//         "retry": "2020-01-01T...",   // Time of the next attempt
+//         "code": "auth",              // Error code, see ConnErrorCode
+//         "methods": ["publickey"],    // "auth" code only, offered methods
+//         "hostkey_addr": "host:port", // "hostkey" state only
+//         "hostkey_old": "SHA256:...", // "hostkey" state only
+//         "hostkey_new": "SHA256:..."  // "hostkey" state only
 //     }
 //
 // If query parameter present, GET waits until state becomes
 // different from the previous state, as set in the query
 //
 func (webapi *WebAPI) handleState(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		webapi.froxy.sshTransport.RetryNow()
+		return
+	default:
 		webapi.replyError(w, r, http.StatusMethodNotAllowed, nil)
 		return
 	}
 
-	state, info := webapi.froxy.GetConnState()
+	state, info, err := webapi.froxy.GetConnState()
 	stateName, stateInfo := state.Strings()
 	if info == "" {
 		info = stateInfo
 	}
 
 	data := struct {
-		State string `json:"state"`
-		Info  string `json:"info"`
-	}{stateName, info}
+		State       string        `json:"state"`
+		Info        string        `json:"info"`
+		Server      string        `json:"server,omitempty"`
+		Attempts    int           `json:"attempts,omitempty"`
+		Retry       *time.Time    `json:"retry,omitempty"`
+		Code        ConnErrorCode `json:"code,omitempty"`
+		Methods     []string      `json:"methods,omitempty"`
+		HostKeyAddr string        `json:"hostkey_addr,omitempty"`
+		HostKeyOld  string        `json:"hostkey_old,omitempty"`
+		HostKeyNew  string        `json:"hostkey_new,omitempty"`
+	}{State: stateName, Info: info}
+
+	data.Server = IDNDecode(webapi.froxy.sshTransport.ActiveServer())
+
+	attempts, retry := webapi.froxy.sshTransport.RetrySchedule()
+	data.Attempts = attempts
+	if !retry.IsZero() {
+		data.Retry = &retry
+	}
+
+	data.Code = ConnErrorClassify(err)
+	var authErr *SSHAuthError
+	if errors.As(err, &authErr) {
+		data.Methods = authErr.Methods
+	}
+
+	if mismatch, ok := err.(*HostKeyMismatchError); ok {
+		data.HostKeyAddr = IDNDecode(mismatch.Addr)
+		data.HostKeyOld = mismatch.Old
+		data.HostKeyNew = mismatch.New
+	}
 
 	webapi.replyJSON(w, &data)
 }
@@ -275,7 +698,14 @@ func (webapi *WebAPI) handleKeys(w http.ResponseWriter, r *http.Request) {
 //
 // Handle /api/counters requests
 //
-// GET /api/counters - returns Counters structure
+// GET /api/counters - returns Counters structure, extended with
+//                     per-server SSH counters, as array of
+//                     SSHTransportCounters structures:
+//     {
+//         "user_conns": 5,
+//         ...
+//         "servers": [ { "server": "", "ssh_sessions": 1, ... }, ...]
+//     }
 //
 func (webapi *WebAPI) handleCounters(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
@@ -283,19 +713,67 @@ func (webapi *WebAPI) handleCounters(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	webapi.replyJSON(w, &webapi.froxy.Counters)
+	data := struct {
+		*Counters
+		Servers []SSHTransportCounters `json:"servers"`
+	}{&webapi.froxy.Counters, webapi.froxy.GetServerCounters()}
+
+	webapi.replyJSON(w, &data)
+}
+
+//
+// Handle /api/stats/sites requests
+//
+// GET /api/stats/sites - get per-site usage statistics
+//
+// Returns array of the following objects, one per site:
+//     {
+//         "site":      { ... },  - the site (see IDNSiteParams)
+//         "requests":  123,      - count of regular HTTP requests
+//         "connects":  123,      - count of CONNECT requests
+//         "bytes_in":  123,      - bytes received from site
+//         "bytes_out": 123,      - bytes sent to site
+//         "errors":    123,      - count of errors
+//         "last_used": 123       - last use time, Unix time in ms, or 0
+//     }
+//
+func (webapi *WebAPI) handleSiteStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		webapi.replyError(w, r, http.StatusMethodNotAllowed, nil)
+		return
+	}
+
+	type stats struct {
+		Site *IDNSiteParams `json:"site"`
+		SiteCounter
+	}
+
+	sites := webapi.froxy.GetSites()
+	counters := webapi.froxy.siteStats.Get(sites)
+
+	reply := []stats{}
+	for i := range sites {
+		reply = append(reply,
+			stats{(*IDNSiteParams)(&sites[i]), counters[i]})
+	}
+
+	webapi.replyJSON(w, reply)
 }
 
 //
 // Handle /api/domain requests
 //
-// GET /api/domain?domain - validate a domain
+// GET /api/domain?domain - validate a domain or domain pattern
 //
 // Returns:
-//     on success: { "host": "..." } - extracted host part of input string
-//                                     (which can be URL, for example)
+//     on success: { "host": "...", - extracted host part of input string
+//                                    (which can be URL, for example)
+//                   "type": "..." }  detected SiteType, omitted for
+//                                    plain domains
 //     on error:   { "err": "..." }  - error text
 //
+// See DomainValidate for syntax of domain patterns
+//
 func (webapi *WebAPI) handleDomain(w http.ResponseWriter, r *http.Request) {
 	// Decode request
 	host, err := url.QueryUnescape(r.URL.RawQuery)
@@ -306,18 +784,366 @@ func (webapi *WebAPI) handleDomain(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate domain
-	host, err = DomainValidate(host)
+	host, typ, err := DomainValidate(host)
 
 	// Send a reply
 	reply := map[string]string{}
 	if err == nil {
 		reply["host"] = host
+		if typ != SiteTypeDomain {
+			reply["type"] = string(typ)
+		}
 	} else {
 		reply["err"] = err.Error()
 	}
 	webapi.replyJSON(w, reply)
 }
 
+//
+// Handle /api/patterns requests
+//
+// GET /api/patterns - get kinds of site matches, in order of precedence
+//
+// Returns array of the following objects:
+//     {
+//         "match": "exact" | "suffix" | "glob" | "regexp" | "cidr" |
+//                  "learned",
+//         "text":  "human-readable description"
+//     }
+//
+func (webapi *WebAPI) handlePatterns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		webapi.replyError(w, r, http.StatusMethodNotAllowed, nil)
+		return
+	}
+
+	type pattern struct {
+		Match string `json:"match"`
+		Text  string `json:"text"`
+	}
+
+	reply := []pattern{}
+	for _, m := range RouterMatchAll {
+		name, text := m.Strings()
+		reply = append(reply, pattern{name, text})
+	}
+
+	webapi.replyJSON(w, reply)
+}
+
+//
+// Handle /api/route requests
+//
+// GET /api/route?host=...[&port=...][&scheme=...] - explain routing
+//                                                   decision
+//
+// Host may be either host name, or full URL. URL scheme and port,
+// if present, are used, unless overridden by the port and scheme
+// parameters. For https:// and wss:// URLs the "connect" scheme is
+// assumed, as browsers use CONNECT for them
+//
+// Returns the following object:
+//     {
+//         "host":       "example.com",
+//         "port":       "443",
+//         "scheme":     "connect",
+//         "answer":     "bypass" | "forward" | "block",
+//         "site":       { ... },      - matched site, or null
+//         "match":      "exact",      - kind of match, if site matched
+//         "subscribed": false,        - site comes from subscription
+//         "resolved":   "1.2.3.4",    - if host was resolved
+//         "reason":     "...",        - why the decision was made
+//         "candidates": [             - other sites that were considered
+//             {
+//                 "site":   { ... },
+//                 "match":  "suffix",
+//                 "subscribed": true,
+//                 "reason": "..."     - why the site didn't win
+//             },
+//             ...
+//         ]
+//     }
+//
+func (webapi *WebAPI) handleRoute(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		webapi.replyError(w, r, http.StatusMethodNotAllowed, nil)
+		return
+	}
+
+	// Parse request
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	host := strings.TrimSpace(query.Get("host"))
+	port := query.Get("port")
+	scheme := SiteScheme(query.Get("scheme"))
+
+	if err == nil && host == "" {
+		err = ErrHttpHostMissed
+	}
+
+	if err == nil && strings.Contains(host, "://") {
+		var u *url.URL
+		u, err = url.Parse(host)
+		if err == nil {
+			host = u.Host
+			if scheme == "" {
+				switch strings.ToLower(u.Scheme) {
+				case "https", "wss":
+					scheme = SiteSchemeConnect
+				case "ftp":
+					scheme = SiteSchemeFTP
+				}
+			}
+		}
+	}
+
+	if scheme == "" {
+		scheme = SiteSchemeHTTP
+	}
+
+	var p string
+	host, p = NetSplitHostPort(strings.ToLower(host), "")
+	if port == "" {
+		port = p
+	}
+
+	if err == nil {
+		err = (&SiteParams{Port: port, Scheme: scheme}).CheckConstraints()
+	}
+
+	if err != nil {
+		webapi.replyError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Explain the route
+	ex := webapi.froxy.router.Explain(IDNEncode(host), port, scheme)
+
+	type candidate struct {
+		Site       *IDNSiteParams `json:"site"`
+		Match      string         `json:"match"`
+		Subscribed bool           `json:"subscribed,omitempty"`
+		Reason     string         `json:"reason"`
+	}
+
+	reply := struct {
+		Host       string         `json:"host"`
+		Port       string         `json:"port"`
+		Scheme     SiteScheme     `json:"scheme"`
+		Answer     string         `json:"answer"`
+		Site       *IDNSiteParams `json:"site"`
+		Match      string         `json:"match,omitempty"`
+		Subscribed bool           `json:"subscribed,omitempty"`
+		Resolved   string         `json:"resolved,omitempty"`
+		Reason     string         `json:"reason"`
+		Candidates []candidate    `json:"candidates"`
+	}{
+		Host:       IDNDecode(ex.Host),
+		Port:       ex.Port,
+		Scheme:     ex.Scheme,
+		Answer:     ex.Answer.String(),
+		Site:       (*IDNSiteParams)(ex.Site),
+		Subscribed: ex.Subscribed,
+		Reason:     ex.Reason,
+		Candidates: []candidate{},
+	}
+
+	if ex.Site != nil {
+		reply.Match, _ = ex.Match.Strings()
+	}
+
+	if ex.Resolved != nil {
+		reply.Resolved = ex.Resolved.String()
+	}
+
+	for _, c := range ex.Candidates {
+		match, _ := c.Match.Strings()
+		reply.Candidates = append(reply.Candidates,
+			candidate{(*IDNSiteParams)(c.Site), match,
+				c.Subscribed, c.Reason})
+	}
+
+	webapi.replyJSON(w, reply)
+}
+
+//
+// Handle /api/challenges requests
+//
+// GET /api/challenges - get pending keyboard-interactive
+//                       authentication challenges. Returns
+//                       array of the following objects:
+//     {
+//         "id":          "1",            - challenge ID
+//         "server":      "host:port",    - server address
+//         "user":        "login",        - user name
+//         "name":        "...",          - challenge name
+//         "instruction": "...",          - instruction from server
+//         "questions":   ["Code: ", ...] - questions to answer
+//         "echos":       [false, ...]    - echo answers, per question
+//     }
+//
+// POST /api/challenges?id - answer the challenge. Receives array
+//                           of answers, one per question
+// DEL /api/challenges?id  - cancel the challenge
+//
+func (webapi *WebAPI) handleChallenges(w http.ResponseWriter, r *http.Request) {
+	var id string
+
+	// Decode challenge ID, if required (for DEL and POST requests)
+	if r.Method == "DEL" || r.Method == "POST" {
+		var err error
+		id, err = url.QueryUnescape(r.URL.RawQuery)
+		if err != nil {
+			webapi.replyError(w, r,
+				http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	// Handle request
+	var err error
+
+	switch r.Method {
+	case "GET":
+		webapi.replyJSON(w, webapi.froxy.challenges.List())
+		return
+
+	case "DEL":
+		err = webapi.froxy.challenges.Answer(id, nil)
+
+	case "POST":
+		var body []byte
+		answers := []string{}
+
+		body, err = ioutil.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(body, &answers)
+		}
+
+		if err == nil {
+			if answers == nil {
+				answers = []string{}
+			}
+			err = webapi.froxy.challenges.Answer(id, answers)
+		}
+
+	default:
+		webapi.replyError(w, r, http.StatusMethodNotAllowed, nil)
+		return
+	}
+
+	if err != nil {
+		webapi.replyError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+//
+// Handle /api/agent requests
+//
+// GET /api/agent - get identities, available in the SSH agent.
+//                  Returns array of the following objects:
+//     {
+//         "fingerprint": "SHA256:...", - key fingerprint
+//         "type":        "ssh-ed25519",
+//         "comment":     "..."
+//     }
+//
+// If SSH agent is not available, the error is returned
+//
+func (webapi *WebAPI) handleAgent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		webapi.replyError(w, r, http.StatusMethodNotAllowed, nil)
+		return
+	}
+
+	keys, err := SSHAgentKeys()
+	if err != nil {
+		webapi.replyError(w, r, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	webapi.replyJSON(w, keys)
+}
+
+//
+// Handle /api/knownhosts requests
+//
+// POST /api/knownhosts - import servers host keys from the OpenSSH
+//                        known_hosts file. Receives the following
+//                        JSON object:
+//     { "known_hosts": "..." } - known_hosts file content
+//
+// Returns:
+//     { "hostkeys": { "host:port": "...", ... } } - fingerprints of
+//                                                  imported keys
+//
+// Servers not found in the known_hosts file are left intact. If
+// none of servers are found, an error is returned
+//
+func (webapi *WebAPI) handleKnownHosts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		webapi.replyError(w, r, http.StatusMethodNotAllowed, nil)
+		return
+	}
+
+	// Decode request
+	var data struct {
+		KnownHosts string `json:"known_hosts"`
+	}
+
+	servers := webapi.froxy.GetServers()
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err == nil {
+		err = json.Unmarshal(body, &data)
+	}
+
+	if err == nil && len(servers) == 0 {
+		err = ErrServerNotConfigured
+	}
+
+	// Lookup the keys
+	hostkeys := make(map[string]string)
+	if err == nil {
+		var lookup func([]ServerParams) []ServerParams
+		lookup = func(list []ServerParams) []ServerParams {
+			list = append([]ServerParams(nil), list...)
+			for i := range list {
+				s := &list[i]
+
+				var hostkey string
+				hostkey, err = KnownHostsLookup([]byte(data.KnownHosts), s.Addr)
+				if err == nil {
+					s.HostKey = hostkey
+					hostkeys[IDNDecode(s.Addr)] = hostkey
+				}
+
+				// Jump hosts need their keys too
+				if len(s.Jump) != 0 {
+					s.Jump = lookup(s.Jump)
+				}
+			}
+			return list
+		}
+
+		servers = lookup(servers)
+
+		if len(hostkeys) != 0 {
+			err = nil
+		}
+	}
+
+	if err != nil {
+		webapi.replyError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Update servers parameters
+	webapi.froxy.SetServers(servers)
+	webapi.froxy.Raise(EventServerParamsChanged)
+
+	webapi.replyJSON(w, map[string]interface{}{"hostkeys": hostkeys})
+}
+
 //
 // Handle /api/poll requests
 //